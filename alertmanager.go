@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// AlertmanagerAlertsPath is the path of the Alertmanager API alerts are posted to
+const AlertmanagerAlertsPath = "/api/v2/alerts"
+
+// Names of the alerts sent to Alertmanager
+const (
+	AlertResourceUnavailable = "AzureResourceUnavailable"
+	AlertServiceHealthEvent  = "AzureServiceHealthEvent"
+)
+
+// Defaults of the Alertmanager options
+const (
+	DefaultAlertmanagerResendInterval = time.Minute
+	DefaultAlertmanagerTimeout        = 10 * time.Second
+)
+
+// alertmanagerResolveFactor is the number of resend intervals after which Alertmanager resolves an alert which is not sent anymore
+const alertmanagerResolveFactor = 4
+
+// AlertmanagerConfig is the Alertmanager instances the exporter sends alerts to
+type AlertmanagerConfig struct {
+	// URLs of the Alertmanager instances, alerts being sent to each of them
+	URLs           []string          `yaml:"urls"`
+	Headers        map[string]string `yaml:"headers"`
+	ResendInterval time.Duration     `yaml:"resend_interval"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	// Labels are added to all the alerts, such as a severity
+	Labels map[string]string `yaml:"labels"`
+}
+
+// Alert is an alert as posted to the Alertmanager API
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+}
+
+// init validates the Alertmanager configuration and sets its defaults
+func (a *AlertmanagerConfig) init() error {
+	if len(a.URLs) == 0 {
+		return errors.New("alertmanager urls are mandatory")
+	}
+	for _, alertmanagerURL := range a.URLs {
+		if parsed, err := url.Parse(alertmanagerURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.Errorf("alertmanager url %q must be an absolute http(s) URL", alertmanagerURL)
+		}
+	}
+	if a.ResendInterval < 0 || a.Timeout < 0 {
+		return errors.New("alertmanager resend interval and timeout must not be negative")
+	}
+	if a.ResendInterval == 0 {
+		a.ResendInterval = DefaultAlertmanagerResendInterval
+	}
+	if a.Timeout == 0 {
+		a.Timeout = DefaultAlertmanagerTimeout
+	}
+	return nil
+}
+
+// AlertmanagerNotifier sends the unavailable resources and their active service health events as alerts to Alertmanager
+// Active alerts are sent again on each resend interval, and once more as resolved when they end.
+type AlertmanagerNotifier struct {
+	collector *ResourceHealthCollector
+	config    *AlertmanagerConfig
+	client    *http.Client
+	trigger   chan struct{}
+	now       func() time.Time
+
+	mutex         sync.Mutex
+	active        map[string]*Alert
+	resolved      map[string]*Alert
+	notifications *prometheus.CounterVec
+}
+
+// NewAlertmanagerNotifier returns a notifier of the alerts of the collector resources
+func NewAlertmanagerNotifier(collector *ResourceHealthCollector, alertmanager *AlertmanagerConfig) *AlertmanagerNotifier {
+	return &AlertmanagerNotifier{
+		collector: collector,
+		config:    alertmanager,
+		client:    &http.Client{Timeout: alertmanager.Timeout},
+		trigger:   make(chan struct{}, 1),
+		now:       time.Now,
+		active:    make(map[string]*Alert),
+		resolved:  make(map[string]*Alert),
+		notifications: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "azure_health_exporter_alertmanager_notifications_total",
+				Help: "Total number of alert batches sent to an Alertmanager by result",
+			},
+			[]string{"url", "result"},
+		),
+	}
+}
+
+// Notify makes the alerts be sent right away, without waiting for the resend interval
+func (n *AlertmanagerNotifier) Notify(transitions []StateTransition) {
+	select {
+	case n.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// NotifyServiceHealthEvents makes the alerts be sent right away as well
+func (n *AlertmanagerNotifier) NotifyServiceHealthEvents(updates []ServiceHealthEventUpdate) {
+	n.Notify(nil)
+}
+
+// Run sends the alerts on each resend interval and state transition, until ctx is done
+func (n *AlertmanagerNotifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.config.ResendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-n.trigger:
+		}
+		n.Send()
+	}
+}
+
+// Send sends the alerts of the latest snapshot, along with the ones resolved since the previous send
+// Resolved alerts are sent again until an Alertmanager accepts them. Alerts are not resolved while their resources are unknown,
+// either because their subscription failed to be fetched or because the snapshot is partial.
+func (n *AlertmanagerNotifier) Send() {
+	snapshot := n.collector.LatestSnapshot()
+	if snapshot == nil {
+		return
+	}
+
+	n.mutex.Lock()
+	now := n.now()
+	current, unknownSubscriptions := n.alerts(snapshot, now)
+	endsAt := now.Add(alertmanagerResolveFactor * n.config.ResendInterval)
+	for fingerprint, alert := range n.active {
+		if _, ok := current[fingerprint]; ok {
+			continue
+		}
+		if snapshot.TimedOut || unknownSubscriptions[alert.Labels["subscription_id"]] {
+			alert.EndsAt = endsAt
+			current[fingerprint] = alert
+			continue
+		}
+		alert.EndsAt = now
+		n.resolved[fingerprint] = alert
+	}
+	for fingerprint := range current {
+		delete(n.resolved, fingerprint)
+	}
+	n.active = current
+
+	alerts := make([]*Alert, 0, len(n.active)+len(n.resolved))
+	for _, fingerprint := range sortedAlertFingerprints(n.active) {
+		alerts = append(alerts, n.active[fingerprint])
+	}
+	for _, fingerprint := range sortedAlertFingerprints(n.resolved) {
+		alerts = append(alerts, n.resolved[fingerprint])
+	}
+	n.mutex.Unlock()
+
+	if len(alerts) == 0 {
+		return
+	}
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		log.Errorf("Error encoding alerts: %v", err)
+		return
+	}
+	sent := false
+	for _, alertmanagerURL := range n.config.URLs {
+		if err := n.post(alertmanagerURL, body); err != nil {
+			log.Errorf("Error sending alerts to Alertmanager %s: %v", alertmanagerURL, err)
+			n.notifications.WithLabelValues(alertmanagerURL, NotificationResultFailure).Inc()
+			continue
+		}
+		n.notifications.WithLabelValues(alertmanagerURL, NotificationResultSuccess).Inc()
+		sent = true
+	}
+
+	if sent {
+		n.mutex.Lock()
+		for _, alert := range alerts {
+			fingerprint := alertFingerprint(alert.Labels)
+			if n.resolved[fingerprint] == alert {
+				delete(n.resolved, fingerprint)
+			}
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// alerts returns the alerts of a snapshot by fingerprint, keeping the start of the ones already active,
+// along with the subscriptions which failed to be fetched, whose resources are unknown
+func (n *AlertmanagerNotifier) alerts(snapshot *Snapshot, now time.Time) (map[string]*Alert, map[string]bool) {
+	var maintenanceWindows []*MaintenanceWindow
+	maintenanceEnabled := n.collector.maintenance.Enabled()
+	if maintenanceEnabled {
+		maintenanceWindows = n.collector.maintenance.ActiveWindows()
+	}
+
+	endsAt := now.Add(alertmanagerResolveFactor * n.config.ResendInterval)
+	alerts := make(map[string]*Alert)
+	unknownSubscriptions := make(map[string]bool)
+	add := func(alert *Alert) {
+		fingerprint := alertFingerprint(alert.Labels)
+		if active, ok := n.active[fingerprint]; ok {
+			alert.StartsAt = active.StartsAt
+		}
+		if alert.StartsAt.IsZero() || alert.StartsAt.After(now) {
+			alert.StartsAt = now
+		}
+		alert.EndsAt = endsAt
+		alerts[fingerprint] = alert
+	}
+
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		if !subscriptionSnapshot.Fetched() {
+			unknownSubscriptions[subscriptionSnapshot.SubscriptionID] = true
+			continue
+		}
+		for i := range subscriptionSnapshot.Resources {
+			resource := &subscriptionSnapshot.Resources[i]
+			if maintenanceEnabled && InMaintenance(resource, maintenanceWindows) != nil {
+				continue
+			}
+			properties := resource.AvailabilityStatus.Properties
+			if properties == nil {
+				continue
+			}
+
+			if n.collector.states.SettledState(resource) == string(resourcehealth.Unavailable) {
+				alert := &Alert{
+					Labels:      n.alertLabels(AlertResourceUnavailable, resource),
+					Annotations: make(map[string]string),
+				}
+				setIfNotEmpty(alert.Annotations, "summary", properties.Summary)
+				setIfNotEmpty(alert.Annotations, "description", properties.DetailedStatus)
+				setIfNotEmpty(alert.Annotations, "reason_type", properties.ReasonType)
+				if properties.OccuredTime != nil {
+					alert.StartsAt = properties.OccuredTime.Time
+				}
+				add(alert)
+			}
+
+			if properties.ServiceImpactingEvents == nil {
+				continue
+			}
+			for i := range *properties.ServiceImpactingEvents {
+				event := &(*properties.ServiceImpactingEvents)[i]
+				if !isActiveServiceHealthEvent(event) || event.CorrelationID == nil {
+					continue
+				}
+				alert := &Alert{
+					Labels:      n.alertLabels(AlertServiceHealthEvent, resource),
+					Annotations: make(map[string]string),
+				}
+				alert.Labels["event_id"] = *event.CorrelationID
+				if incident := event.IncidentProperties; incident != nil {
+					setIfNotEmpty(alert.Annotations, "summary", incident.Title)
+					setIfNotEmpty(alert.Labels, "service", incident.Service)
+					setIfNotEmpty(alert.Labels, "region", incident.Region)
+					setIfNotEmpty(alert.Labels, "incident_type", incident.IncidentType)
+				}
+				if event.EventStartTime != nil {
+					alert.StartsAt = event.EventStartTime.Time
+				}
+				add(alert)
+			}
+		}
+	}
+	return alerts, unknownSubscriptions
+}
+
+// alertLabels returns the labels of an alert of a resource, the same as the ones of its metrics and tags
+func (n *AlertmanagerNotifier) alertLabels(name string, resource *MonitoredResource) map[string]string {
+	labels := copyLabels(resource.Labels)
+	if resource.Resource.Type != nil {
+		labels = CreateAllLabels(resource.Resource.Tags, resource.Resource.Type, labels)
+	}
+	for labelName, value := range n.config.Labels {
+		if _, ok := labels[labelName]; !ok {
+			labels[labelName] = value
+		}
+	}
+	labels["alertname"] = name
+	return labels
+}
+
+// post sends a batch of alerts to an Alertmanager
+func (n *AlertmanagerNotifier) post(alertmanagerURL string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(alertmanagerURL, "/")+AlertmanagerAlertsPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range n.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Describe to satisfy the collector interface.
+func (n *AlertmanagerNotifier) Describe(ch chan<- *prometheus.Desc) {
+	n.notifications.Describe(ch)
+}
+
+// Collect exports the notification counts
+func (n *AlertmanagerNotifier) Collect(ch chan<- prometheus.Metric) {
+	n.notifications.Collect(ch)
+}
+
+// alertFingerprint identifies an alert by its labels
+func alertFingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fingerprint strings.Builder
+	for _, name := range names {
+		fingerprint.WriteString(name)
+		fingerprint.WriteByte(0)
+		fingerprint.WriteString(labels[name])
+		fingerprint.WriteByte(0)
+	}
+	return fingerprint.String()
+}
+
+func sortedAlertFingerprints(alerts map[string]*Alert) []string {
+	fingerprints := make([]string, 0, len(alerts))
+	for fingerprint := range alerts {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// setIfNotEmpty sets a label or an annotation to an optional value
+func setIfNotEmpty(values map[string]string, name string, value *string) {
+	if value != nil && *value != "" {
+		values[name] = *value
+	}
+}
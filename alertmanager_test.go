@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLoadConfigContent_Alertmanager(t *testing.T) {
+	got, err := loadConfigContent([]byte("alertmanager:\n  urls: [\"http://alertmanager:9093\"]\n"))
+	if err != nil {
+		t.Fatalf("Error on loading config %v", err)
+	}
+	if got.Alertmanager.ResendInterval != DefaultAlertmanagerResendInterval || got.Alertmanager.Timeout != DefaultAlertmanagerTimeout {
+		t.Errorf("Unexpected Alertmanager defaults: %+v", got.Alertmanager)
+	}
+
+	for _, configFile := range []string{
+		"alertmanager:\n  resend_interval: 1m\n",
+		"alertmanager:\n  urls: [\"alertmanager:9093\"]\n",
+		"alertmanager:\n  urls: [\"http://alertmanager:9093\"]\n  resend_interval: -1m\n",
+	} {
+		if _, err := loadConfigContent([]byte(configFile)); err == nil {
+			t.Errorf("Should have an error loading %v", configFile)
+		}
+	}
+}
+
+func TestAlertmanagerNotifier_Send(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.server.Close()
+
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	resourceID := trackedResourceID
+	asID := resourceID + AvailabilityStatusIDSuffix
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+
+	summary := "The virtual machine is down"
+	occurred := date.Time{Time: time.Unix(1500000000, 0).UTC()}
+	eventID := "ABC-123"
+	active := "Active"
+	title := "Virtual machines in Canada Central"
+	service := "Virtual Machines"
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{
+			AvailabilityState: resourcehealth.Unavailable,
+			Summary:           &summary,
+			OccuredTime:       &occurred,
+			ServiceImpactingEvents: &[]resourcehealth.ServiceImpactingEvent{
+				{CorrelationID: &eventID, Status: &resourcehealth.ServiceImpactingEventStatus{Value: &active}, IncidentProperties: &resourcehealth.ServiceImpactingEventIncidentProperties{Title: &title, Service: &service}},
+			},
+		}},
+	}, nil).Once()
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}},
+	}, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	configFile := `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+alertmanager:
+  urls: ["` + standIn.server.URL + `"]
+  labels:
+    severity: critical
+`
+	loadConfigContent([]byte(configFile))
+	notifier := NewAlertmanagerNotifier(collector, config.Alertmanager)
+	now := time.Unix(1500000600, 0).UTC()
+	notifier.now = func() time.Time { return now }
+
+	// Nothing is sent before the first fetch
+	notifier.Send()
+	if len(standIn.bodies) != 0 {
+		t.Fatalf("Unexpected alerts before the first fetch: %v", standIn.bodies)
+	}
+
+	CallExporterWithConfig(collector, configFile)
+	notifier.Send()
+	now = now.Add(time.Minute)
+	notifier.Send()
+	CallExporterWithConfig(collector, configFile)
+	now = now.Add(time.Minute)
+	notifier.Send()
+	notifier.Send()
+
+	if len(standIn.bodies) != 3 {
+		t.Fatalf("Unexpected number of posts: %v", standIn.bodies)
+	}
+	var posts [][]Alert
+	for _, body := range standIn.bodies {
+		var alerts []Alert
+		if err := json.Unmarshal([]byte(body), &alerts); err != nil {
+			t.Fatalf("Error decoding %v: %v", body, err)
+		}
+		posts = append(posts, alerts)
+	}
+
+	firing := posts[0]
+	if len(firing) != 2 {
+		t.Fatalf("Unexpected alerts: %+v", firing)
+	}
+	for _, alert := range firing {
+		labels := alert.Labels
+		if labels["resource_name"] != "my_instance" || labels["subscription_id"] != "my_subscription" || labels["tag_monitoring"] != "enabled" || labels["severity"] != "critical" {
+			t.Errorf("Unexpected labels: %v", labels)
+		}
+		if !alert.EndsAt.Equal(time.Unix(1500000600, 0).Add(4 * time.Minute)) {
+			t.Errorf("Unexpected end: %v", alert.EndsAt)
+		}
+		switch labels["alertname"] {
+		case AlertResourceUnavailable:
+			if alert.Annotations["summary"] != summary || !alert.StartsAt.Equal(occurred.Time) {
+				t.Errorf("Unexpected unavailability alert: %+v", alert)
+			}
+		case AlertServiceHealthEvent:
+			if labels["event_id"] != eventID || labels["service"] != service || alert.Annotations["summary"] != title {
+				t.Errorf("Unexpected service health event alert: %+v", alert)
+			}
+		default:
+			t.Errorf("Unexpected alert: %+v", alert)
+		}
+	}
+
+	// Alerts are sent again while they last, with the same start
+	if len(posts[1]) != 2 || !posts[1][0].StartsAt.Equal(firing[0].StartsAt) || !posts[1][0].EndsAt.After(firing[0].EndsAt) {
+		t.Errorf("Unexpected alerts sent again: %+v", posts[1])
+	}
+
+	// Resolved alerts are sent once, ending now
+	if len(posts[2]) != 2 || !posts[2][0].EndsAt.Equal(now) || !posts[2][1].EndsAt.Equal(now) {
+		t.Errorf("Unexpected resolved alerts: %+v", posts[2])
+	}
+}
+
+func TestAlertmanagerNotifier_SendFailure(t *testing.T) {
+	standIn := newWebhookStandIn(503)
+	defer standIn.server.Close()
+
+	notifier := NewAlertmanagerNotifier(NewMockedCollector(&MockedResourceHealth{}, &MockedResources{}), &AlertmanagerConfig{
+		URLs:           []string{standIn.server.URL},
+		ResendInterval: time.Minute,
+	})
+	notifier.collector.latest = &Snapshot{}
+	resolved := &Alert{Labels: map[string]string{"alertname": AlertResourceUnavailable}}
+	notifier.active[alertFingerprint(resolved.Labels)] = resolved
+
+	// Resolved alerts are sent again until accepted
+	notifier.Send()
+	notifier.Send()
+	notifier.Send()
+	if len(standIn.bodies) != 2 {
+		t.Errorf("Unexpected number of posts: %v", standIn.bodies)
+	}
+}
+
+func TestAlertmanagerNotifier_SendUnknownResources(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.server.Close()
+
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	resourceID := trackedResourceID
+	asID := resourceID + AvailabilityStatusIDSuffix
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable}},
+	}, nil).Once()
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(nil, errors.New("Unit test Error"))
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	configFile := `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+alertmanager:
+  urls: ["` + standIn.server.URL + `"]
+`
+	loadConfigContent([]byte(configFile))
+	notifier := NewAlertmanagerNotifier(collector, config.Alertmanager)
+	now := time.Unix(1500000600, 0).UTC()
+	notifier.now = func() time.Time { return now }
+
+	CallExporterWithConfig(collector, configFile)
+	notifier.Send()
+
+	// The subscription fails to be fetched, then the snapshot is partial: its resources are unknown, so the alert lasts
+	CallExporterWithConfig(collector, configFile)
+	now = now.Add(time.Minute)
+	notifier.Send()
+	notifier.collector.latest = &Snapshot{TimedOut: true}
+	now = now.Add(time.Minute)
+	notifier.Send()
+
+	if len(standIn.bodies) != 3 {
+		t.Fatalf("Unexpected number of posts: %v", standIn.bodies)
+	}
+	for _, body := range standIn.bodies {
+		var alerts []Alert
+		if err := json.Unmarshal([]byte(body), &alerts); err != nil {
+			t.Fatalf("Error decoding %v: %v", body, err)
+		}
+		if len(alerts) != 1 || alerts[0].Labels["alertname"] != AlertResourceUnavailable || !alerts[0].EndsAt.After(now) {
+			t.Errorf("Unexpected alerts: %+v", alerts)
+		}
+	}
+}
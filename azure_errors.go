@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+// Azure APIs called by the exporter, as exposed in the api label
+const (
+	ResourceHealthAPI = "resourcehealth"
+	ResourcesAPI      = "resources"
+	ResourceGraphAPI  = "resourcegraph"
+)
+
+// Azure API error classes, as exposed in the class label
+const (
+	AuthErrorClass        = "auth"
+	ThrottledErrorClass   = "throttled"
+	NotFoundErrorClass    = "not_found"
+	ServerErrorClass      = "server"
+	TimeoutErrorClass     = "timeout"
+	NetworkErrorClass     = "network"
+	CircuitOpenErrorClass = "circuit_open"
+	OtherErrorClass       = "other"
+)
+
+// ClassifyAzureError returns the class of an error returned by an Azure API client
+func ClassifyAzureError(err error) string {
+	err = errors.Cause(err)
+
+	if autorest.IsTokenRefreshError(err) {
+		return AuthErrorClass
+	}
+
+	if detailedErr, ok := err.(*autorest.DetailedError); ok {
+		err = *detailedErr
+	}
+	if detailedErr, ok := err.(autorest.DetailedError); ok {
+		if class := classifyStatusCode(detailedStatusCode(detailedErr)); class != "" {
+			return class
+		}
+		if detailedErr.Original == nil {
+			return OtherErrorClass
+		}
+		err = errors.Cause(detailedErr.Original)
+	}
+
+	if err == ErrCircuitOpen {
+		return CircuitOpenErrorClass
+	}
+
+	if err == context.DeadlineExceeded {
+		return TimeoutErrorClass
+	}
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return TimeoutErrorClass
+		}
+		return NetworkErrorClass
+	}
+
+	return OtherErrorClass
+}
+
+// detailedStatusCode returns the HTTP status code of a detailed error, or 0 if undefined
+func detailedStatusCode(detailedErr autorest.DetailedError) int {
+	if statusCode, ok := detailedErr.StatusCode.(int); ok && statusCode > 0 {
+		return statusCode
+	}
+	if detailedErr.Response != nil {
+		return detailedErr.Response.StatusCode
+	}
+	return 0
+}
+
+func classifyStatusCode(statusCode int) string {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return AuthErrorClass
+	case statusCode == http.StatusNotFound:
+		return NotFoundErrorClass
+	case statusCode == http.StatusTooManyRequests:
+		return ThrottledErrorClass
+	case statusCode >= http.StatusInternalServerError:
+		return ServerErrorClass
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+type tokenRefreshError struct{}
+
+func (e tokenRefreshError) Error() string            { return "token refresh failed" }
+func (e tokenRefreshError) Response() *http.Response { return nil }
+
+func TestClassifyAzureError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"unauthorized", autorest.NewErrorWithResponse("pkg", "method", &http.Response{StatusCode: http.StatusUnauthorized}, "failure"), AuthErrorClass},
+		{"forbidden", autorest.NewErrorWithResponse("pkg", "method", &http.Response{StatusCode: http.StatusForbidden}, "failure"), AuthErrorClass},
+		{"token refresh", autorest.NewErrorWithError(tokenRefreshError{}, "pkg", "method", nil, "failure"), AuthErrorClass},
+		{"not found", autorest.NewErrorWithResponse("pkg", "method", &http.Response{StatusCode: http.StatusNotFound}, "failure"), NotFoundErrorClass},
+		{"throttled", autorest.NewErrorWithResponse("pkg", "method", &http.Response{StatusCode: http.StatusTooManyRequests}, "failure"), ThrottledErrorClass},
+		{"server", autorest.NewErrorWithResponse("pkg", "method", &http.Response{StatusCode: http.StatusServiceUnavailable}, "failure"), ServerErrorClass},
+		{"deadline", autorest.NewErrorWithError(context.DeadlineExceeded, "pkg", "method", nil, "failure"), TimeoutErrorClass},
+		{"network timeout", autorest.NewErrorWithError(&url.Error{Op: "Get", URL: "https://management.azure.com", Err: timeoutError{}}, "pkg", "method", nil, "failure"), TimeoutErrorClass},
+		{"network", autorest.NewErrorWithError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "pkg", "method", nil, "failure"), NetworkErrorClass},
+		{"wrapped", errors.Wrap(autorest.NewErrorWithResponse("pkg", "method", &http.Response{StatusCode: http.StatusTooManyRequests}, "failure"), "wrapped"), ThrottledErrorClass},
+		{"circuit open", autorest.NewErrorWithError(ErrCircuitOpen, "pkg", "method", nil, "failure"), CircuitOpenErrorClass},
+		{"other", errors.New("Unit test Error"), OtherErrorClass},
+	}
+
+	for _, c := range cases {
+		if got := ClassifyAzureError(c.err); got != c.want {
+			t.Errorf("Unexpected class for %s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/prometheus/common/log"
+)
+
+// AzureMonitorWebhookPath is the path receiving the alerts of Azure Monitor action groups
+const AzureMonitorWebhookPath = "/webhook/azure-monitor"
+
+// CommonAlertSchemaID is the schema of the alerts sent by action groups enabling the common alert schema
+const CommonAlertSchemaID = "azureMonitorCommonAlertSchema"
+
+// Monitoring services of the alerts updating the cached state
+const (
+	MonitoringServiceResourceHealth = "Resource Health"
+	MonitoringServiceServiceHealth  = "ServiceHealth"
+)
+
+// CommonAlert is an alert in the Azure Monitor common alert schema, restricted to Resource Health and Service Health alerts
+type CommonAlert struct {
+	SchemaID string `json:"schemaId"`
+	Data     struct {
+		Essentials struct {
+			AlertID           string   `json:"alertId"`
+			AlertRule         string   `json:"alertRule"`
+			MonitorCondition  string   `json:"monitorCondition"`
+			MonitoringService string   `json:"monitoringService"`
+			AlertTargetIDs    []string `json:"alertTargetIDs"`
+		} `json:"essentials"`
+		AlertContext struct {
+			EventTimestamp *time.Time            `json:"eventTimestamp"`
+			Properties     CommonAlertProperties `json:"properties"`
+		} `json:"alertContext"`
+	} `json:"data"`
+}
+
+// CommonAlertProperties are the properties of the activity log event of a Resource Health or Service Health alert
+type CommonAlertProperties struct {
+	// Resource Health
+	Title                string `json:"title"`
+	Details              string `json:"details"`
+	CurrentHealthStatus  string `json:"currentHealthStatus"`
+	PreviousHealthStatus string `json:"previousHealthStatus"`
+	Cause                string `json:"cause"`
+	// Service Health
+	TrackingID      string `json:"trackingId"`
+	Service         string `json:"service"`
+	Region          string `json:"region"`
+	IncidentType    string `json:"incidentType"`
+	Stage           string `json:"stage"`
+	ImpactStartTime string `json:"impactStartTime"`
+}
+
+// AzureMonitorHandler receives the Resource Health and Service Health alerts of Azure Monitor action groups,
+// and updates the cached state of the affected resources right away
+// It is authenticated by a token, either as a bearer token or as the token query parameter,
+// action groups being unable to set headers.
+type AzureMonitorHandler struct {
+	collector *ResourceHealthCollector
+	token     string
+}
+
+// azureMonitorResponse is the response to a received alert
+type azureMonitorResponse struct {
+	UpdatedResources int `json:"updated_resources"`
+}
+
+// NewAzureMonitorHandler returns the receiver of the Azure Monitor alerts updating the resources of collector
+func NewAzureMonitorHandler(collector *ResourceHealthCollector, token string) *AzureMonitorHandler {
+	return &AzureMonitorHandler{collector: collector, token: token}
+}
+
+func (h *AzureMonitorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var alert CommonAlert
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&alert); err != nil {
+		http.Error(w, "Invalid alert: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if alert.SchemaID != CommonAlertSchemaID {
+		http.Error(w, "Unsupported alert schema "+alert.SchemaID+", the common alert schema must be enabled", http.StatusBadRequest)
+		return
+	}
+	if h.collector.LatestSnapshot() == nil {
+		http.Error(w, "No data fetched yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	essentials := &alert.Data.Essentials
+	var update func(resource *MonitoredResource) bool
+	switch {
+	case strings.EqualFold(essentials.MonitoringService, MonitoringServiceResourceHealth):
+		update = resourceHealthAlertUpdate(&alert)
+	case strings.EqualFold(essentials.MonitoringService, MonitoringServiceServiceHealth):
+		update = serviceHealthAlertUpdate(&alert)
+	default:
+		log.Infof("Ignoring Azure Monitor alert %s of %s", essentials.AlertRule, essentials.MonitoringService)
+		writeJSON(w, http.StatusOK, azureMonitorResponse{})
+		return
+	}
+
+	updated := 0
+	if update != nil {
+		updated = h.collector.UpdateResources(update)
+	}
+	log.Infof("Azure Monitor alert %s of %s updated %d resources", essentials.AlertRule, essentials.MonitoringService, updated)
+	writeJSON(w, http.StatusOK, azureMonitorResponse{UpdatedResources: updated})
+}
+
+// resourceHealthAlertUpdate returns the update of the availability status of the resources targeted by
+// a Resource Health alert, nil if the alert has no health status
+func resourceHealthAlertUpdate(alert *CommonAlert) func(resource *MonitoredResource) bool {
+	properties := &alert.Data.AlertContext.Properties
+	if properties.CurrentHealthStatus == "" {
+		return nil
+	}
+	targets := alertTargets(alert)
+	occurred := alert.Data.AlertContext.EventTimestamp
+
+	return func(resource *MonitoredResource) bool {
+		if !targets[normalizeResourceID(*resource.Resource.ID)] {
+			return false
+		}
+		status := copyAvailabilityStatusProperties(resource)
+		status.AvailabilityState = resourcehealth.AvailabilityStateValues(properties.CurrentHealthStatus)
+		status.Summary = optionalString(properties.Title)
+		status.DetailedStatus = optionalString(properties.Details)
+		status.ReasonType = optionalString(properties.Cause)
+		status.RecentlyResolvedState = nil
+		status.RecommendedActions = nil
+		if occurred != nil {
+			status.OccuredTime = &date.Time{Time: *occurred}
+		}
+		resource.AvailabilityStatus.Properties = status
+		return true
+	}
+}
+
+// serviceHealthAlertUpdate returns the update of the service impacting events of the resources located in
+// the regions of a Service Health alert, in the targeted subscriptions. Resolved events are removed.
+func serviceHealthAlertUpdate(alert *CommonAlert) func(resource *MonitoredResource) bool {
+	properties := &alert.Data.AlertContext.Properties
+	if properties.TrackingID == "" {
+		return nil
+	}
+	targets := alertTargets(alert)
+	regions := make(map[string]bool)
+	for _, region := range strings.Split(properties.Region, ",") {
+		if region = normalizeRegion(region); region != "" {
+			regions[region] = true
+		}
+	}
+	resolved := serviceHealthStageEnded(properties.Stage) || strings.EqualFold(alert.Data.Essentials.MonitorCondition, ServiceHealthEventStatusResolved)
+
+	event := resourcehealth.ServiceImpactingEvent{
+		CorrelationID: optionalString(properties.TrackingID),
+		Status:        &resourcehealth.ServiceImpactingEventStatus{Value: optionalString("Active")},
+		IncidentProperties: &resourcehealth.ServiceImpactingEventIncidentProperties{
+			Title:        optionalString(properties.Title),
+			Service:      optionalString(properties.Service),
+			Region:       optionalString(properties.Region),
+			IncidentType: optionalString(properties.IncidentType),
+		},
+	}
+	if start, err := time.Parse(time.RFC3339, properties.ImpactStartTime); err == nil {
+		event.EventStartTime = &date.Time{Time: start}
+	}
+	if timestamp := alert.Data.AlertContext.EventTimestamp; timestamp != nil {
+		event.EventStatusLastModifiedTime = &date.Time{Time: *timestamp}
+	}
+
+	return func(resource *MonitoredResource) bool {
+		if !targets[normalizeResourceID("/subscriptions/"+resource.Labels["subscription_id"])] {
+			return false
+		}
+		if !regions["global"] && (resource.Resource.Location == nil || !regions[normalizeRegion(*resource.Resource.Location)]) {
+			return false
+		}
+
+		status := copyAvailabilityStatusProperties(resource)
+		var events []resourcehealth.ServiceImpactingEvent
+		found := false
+		if status.ServiceImpactingEvents != nil {
+			for _, existing := range *status.ServiceImpactingEvents {
+				if existing.CorrelationID == nil || *existing.CorrelationID != properties.TrackingID {
+					events = append(events, existing)
+					continue
+				}
+				found = true
+			}
+		}
+		if resolved && !found {
+			return false
+		}
+		if !resolved {
+			events = append(events, event)
+		}
+		status.ServiceImpactingEvents = &events
+		resource.AvailabilityStatus.Properties = status
+		return true
+	}
+}
+
+// serviceHealthOngoingStages are the stages of a Service Health event which has not ended yet
+var serviceHealthOngoingStages = map[string]bool{"active": true, "inprogress": true, "planned": true}
+
+// serviceHealthStageEnded returns whether the stage of a Service Health alert ends its event,
+// such as Resolved or RCA for an incident, and Complete or Canceled for a planned maintenance
+func serviceHealthStageEnded(stage string) bool {
+	return stage != "" && !serviceHealthOngoingStages[strings.ToLower(stage)]
+}
+
+// alertTargets returns the normalized IDs of the resources or subscriptions targeted by an alert
+func alertTargets(alert *CommonAlert) map[string]bool {
+	targets := make(map[string]bool)
+	for _, target := range alert.Data.Essentials.AlertTargetIDs {
+		targets[normalizeResourceID(target)] = true
+	}
+	return targets
+}
+
+// copyAvailabilityStatusProperties returns a copy of the availability status properties of a resource,
+// which are shared with the previous snapshot
+func copyAvailabilityStatusProperties(resource *MonitoredResource) *resourcehealth.AvailabilityStatusProperties {
+	if resource.AvailabilityStatus.Properties == nil {
+		return &resourcehealth.AvailabilityStatusProperties{}
+	}
+	copied := *resource.AvailabilityStatus.Properties
+	return &copied
+}
+
+// normalizeRegion returns a region name comparable with a location, e.g. "Canada Central" as "canadacentral"
+func normalizeRegion(region string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(region), " ", "", -1))
+}
+
+// optionalString returns a pointer to value, nil if empty
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/stretchr/testify/mock"
+)
+
+const azureMonitorConfig = `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+`
+
+const resourceHealthAlert = `{
+  "schemaId": "azureMonitorCommonAlertSchema",
+  "data": {
+    "essentials": {
+      "alertId": "/subscriptions/my_subscription/providers/Microsoft.AlertsManagement/alerts/b9569717-bc32-442f-add5-83a997729330",
+      "alertRule": "vm-health",
+      "severity": "Sev4",
+      "signalType": "Activity Log",
+      "monitorCondition": "Fired",
+      "monitoringService": "Resource Health",
+      "alertTargetIDs": ["/subscriptions/my_subscription/resourcegroups/my_rg/providers/microsoft.compute/virtualmachines/web1"],
+      "firedDateTime": "2020-01-01T00:00:30Z"
+    },
+    "alertContext": {
+      "eventSource": "ResourceHealth",
+      "eventTimestamp": "2020-01-01T00:00:00Z",
+      "operationName": "Microsoft.Resourcehealth/healthevent/Activated/action",
+      "properties": {
+        "title": "Virtual machine is unavailable",
+        "details": "The virtual machine is stopped by a platform failure",
+        "currentHealthStatus": "Unavailable",
+        "previousHealthStatus": "Available",
+        "type": "Downtime",
+        "cause": "PlatformInitiated"
+      },
+      "status": "Active"
+    }
+  }
+}`
+
+const serviceHealthAlert = `{
+  "schemaId": "azureMonitorCommonAlertSchema",
+  "data": {
+    "essentials": {
+      "alertRule": "service-health",
+      "monitorCondition": "Fired",
+      "monitoringService": "ServiceHealth",
+      "alertTargetIDs": ["/subscriptions/my_subscription"]
+    },
+    "alertContext": {
+      "eventTimestamp": "2020-01-01T00:00:00Z",
+      "operationName": "Microsoft.ServiceHealth/incident/action",
+      "properties": {
+        "title": "Virtual machines in Canada Central",
+        "service": "Virtual Machines",
+        "region": "Canada Central, Canada East",
+        "incidentType": "Incident",
+        "trackingId": "ABC-123",
+        "impactStartTime": "2019-12-31T23:50:00Z",
+        "stage": "STAGE"
+      }
+    }
+  }
+}`
+
+func newAzureMonitorCollector() *ResourceHealthCollector {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r).WithCacheTTL(time.Hour)
+
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	for _, instance := range []struct {
+		name     string
+		location string
+	}{
+		{"web1", "canadacentral"},
+		{"web2", "eastus"},
+	} {
+		resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/" + instance.name
+		asID := resourceID + AvailabilityStatusIDSuffix
+		location := instance.location
+		resList = append(resList, resources.GenericResource{
+			ID:       &resourceID,
+			Type:     &resourceType,
+			Location: &location,
+			Tags:     map[string]*string{"Monitoring": &monitoring},
+		})
+		asList = append(asList, resourcehealth.AvailabilityStatus{
+			ID:         &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available},
+		})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+	return collector
+}
+
+func postAzureMonitorAlert(handler http.Handler, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", AzureMonitorWebhookPath+"?token="+token, bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAzureMonitorHandler_Errors(t *testing.T) {
+	collector := newAzureMonitorCollector()
+	handler := NewAzureMonitorHandler(collector, "secret")
+
+	if rr := postAzureMonitorAlert(handler, "wrong", resourceHealthAlert); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status code with a wrong token: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := postAzureMonitorAlert(handler, "secret", resourceHealthAlert); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status code before any fetch: got %v, want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	CallExporterWithConfig(collector, azureMonitorConfig)
+	for _, body := range []string{
+		"{",
+		`{"schemaId": "Microsoft.Insights/activityLogs", "data": {}}`,
+		strings.Replace(resourceHealthAlert, "Virtual machine is unavailable", strings.Repeat("a", MaxRequestBodySize), 1),
+	} {
+		if rr := postAzureMonitorAlert(handler, "secret", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Wrong status code posting %.100v: got %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	req := httptest.NewRequest("POST", AzureMonitorWebhookPath, bytes.NewBufferString(strings.Replace(resourceHealthAlert, "Resource Health", "Platform", 1)))
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"updated_resources":0}` {
+		t.Errorf("Unexpected response to an alert of another service: %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestAzureMonitorHandler_ResourceHealth(t *testing.T) {
+	collector := newAzureMonitorCollector()
+	stream := NewEventStream("/azure-health-exporter")
+	collector.WithNotifier(stream)
+	events, _, cancel := stream.Subscribe("")
+	defer cancel()
+	handler := NewAzureMonitorHandler(collector, "secret")
+
+	CallExporterWithConfig(collector, azureMonitorConfig)
+	previous := collector.LatestSnapshot()
+
+	rr := postAzureMonitorAlert(handler, "secret", resourceHealthAlert)
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"updated_resources":1}` {
+		t.Fatalf("Unexpected response: %v %v", rr.Code, rr.Body.String())
+	}
+
+	// The cached snapshot is updated without calling Azure, leaving the previous one untouched
+	body := callCollector(collector).Body.String()
+	for _, want := range []string{
+		`azure_resource_health_availability_up{resource_group="my_rg",resource_name="web1",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 0`,
+		`azure_resource_health_availability_up{resource_group="my_rg",resource_name="web2",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Missing %v in body %v", want, body)
+		}
+	}
+	if previous.Subscriptions[0].Resources[0].AvailabilityStatus.Properties.AvailabilityState != resourcehealth.Available {
+		t.Errorf("The previous snapshot was modified")
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Unexpected number of events: %v", len(events))
+	}
+	event := (<-events).Data.(*WebhookEvent)
+	if event.ResourceName != "web1" || event.State != "Unavailable" || event.Summary != "Virtual machine is unavailable" || event.ReasonType != "PlatformInitiated" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+func TestAzureMonitorHandler_ServiceHealth(t *testing.T) {
+	collector := newAzureMonitorCollector()
+	handler := NewAzureMonitorHandler(collector, "secret")
+	CallExporterWithConfig(collector, azureMonitorConfig)
+
+	tests := []struct {
+		stage   string
+		updated string
+		events  []int
+	}{
+		{"Active", `{"updated_resources":1}`, []int{1, 0}},
+		// The event is replaced by its update
+		{"Active", `{"updated_resources":1}`, []int{1, 0}},
+		{"Resolved", `{"updated_resources":1}`, []int{0, 0}},
+		{"Resolved", `{"updated_resources":0}`, []int{0, 0}},
+		// Any stage but Active, InProgress and Planned ends the event
+		{"Planned", `{"updated_resources":1}`, []int{1, 0}},
+		{"Complete", `{"updated_resources":1}`, []int{0, 0}},
+		{"InProgress", `{"updated_resources":1}`, []int{1, 0}},
+		{"RCA", `{"updated_resources":1}`, []int{0, 0}},
+		{"inprogress", `{"updated_resources":1}`, []int{1, 0}},
+		{"Canceled", `{"updated_resources":1}`, []int{0, 0}},
+	}
+
+	for i, test := range tests {
+		rr := postAzureMonitorAlert(handler, "secret", strings.Replace(serviceHealthAlert, "STAGE", test.stage, 1))
+		if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != test.updated {
+			t.Errorf("Unexpected response %d: %v %v", i, rr.Code, rr.Body.String())
+		}
+
+		for j, resource := range collector.LatestSnapshot().Subscriptions[0].Resources {
+			var events []resourcehealth.ServiceImpactingEvent
+			if resource.AvailabilityStatus.Properties.ServiceImpactingEvents != nil {
+				events = *resource.AvailabilityStatus.Properties.ServiceImpactingEvents
+			}
+			if len(events) != test.events[j] {
+				t.Errorf("Unexpected events %d of %s: %+v", i, resource.Labels["resource_name"], events)
+				continue
+			}
+			for _, event := range events {
+				if *event.CorrelationID != "ABC-123" || !isActiveServiceHealthEvent(&event) || *event.IncidentProperties.Service != "Virtual Machines" ||
+					!event.EventStartTime.Time.Equal(time.Date(2019, 12, 31, 23, 50, 0, 0, time.UTC)) {
+					t.Errorf("Unexpected event %d: %+v", i, event)
+				}
+			}
+		}
+	}
+}
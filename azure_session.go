@@ -10,6 +10,8 @@ import (
 type AzureSession struct {
 	SubscriptionID string
 	Authorizer     autorest.Authorizer
+	Sender         autorest.Sender
+	CircuitBreaker *CircuitBreaker
 }
 
 // NewAzureSession create a new Azure session
@@ -31,3 +33,28 @@ func NewAzureSession(subscriptionID string) (*AzureSession, error) {
 
 	return &session, nil
 }
+
+// SessionOptions configures how the session clients send requests to Azure
+type SessionOptions struct {
+	Retry          RetryOptions
+	CircuitBreaker CircuitBreakerOptions
+	// MaxConcurrentRequests bounds the requests sent at a time for the subscription, 0 meaning no limit
+	MaxConcurrentRequests int
+	// MaxRequestsPerSecond bounds the rate of requests sent for the subscription, 0 meaning no limit
+	MaxRequestsPerSecond float64
+}
+
+// WithOptions makes the session clients retry failed requests, stop sending requests
+// to Azure after repeated failures, and limit their concurrent requests and request rate
+func (s *AzureSession) WithOptions(options SessionOptions) *AzureSession {
+	s.CircuitBreaker = NewCircuitBreaker(options.CircuitBreaker)
+	// The last decorator is the outermost: the breaker records the outcome after retries,
+	// and the concurrency and rate limits apply to each attempt rather than during backoffs
+	s.Sender = autorest.DecorateSender(autorest.CreateSender(),
+		DoLimitRate(options.MaxRequestsPerSecond),
+		DoLimitConcurrency(s.SubscriptionID, options.MaxConcurrentRequests),
+		DoRetryWithBackoff(options.Retry),
+		DoCircuitBreaker(s.CircuitBreaker),
+	)
+	return s
+}
@@ -23,3 +23,19 @@ func TestNewAzureSession_MissingSubscriptionID(t *testing.T) {
 		t.Errorf("Want an error, got none")
 	}
 }
+
+func TestAzureSession_WithOptions(t *testing.T) {
+	session, err := NewAzureSession("subscriptionID")
+	if err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+
+	session.WithOptions(SessionOptions{
+		Retry:                 RetryOptions{MaxAttempts: 3},
+		CircuitBreaker:        CircuitBreakerOptions{FailureThreshold: 5},
+		MaxConcurrentRequests: 2,
+	})
+	if session.Sender == nil || session.CircuitBreaker == nil {
+		t.Errorf("Want a sender and a circuit breaker, got %v and %v", session.Sender, session.CircuitBreaker)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/pkg/errors"
+)
+
+// BackfillOptions configures the time range of a backfill
+type BackfillOptions struct {
+	Start time.Time
+	End   time.Time
+	// Step is the interval between two samples of a resource
+	Step time.Duration
+}
+
+var openMetricsLabelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Backfill writes the availability history of the configured resources to w, as azure_resource_health_availability_up
+// samples in the OpenMetrics format imported by `promtool tsdb create-blocks-from openmetrics`.
+// A failed subscription or resource is skipped, the failures being reported once the whole output is written.
+func Backfill(ctx context.Context, w io.Writer, subscriptions []subscriptionClients, options BackfillOptions) error {
+	if options.Step <= 0 {
+		return errors.New("backfill step must be positive")
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP azure_resource_health_availability_up Resource health availability that relies on signals from different Azure services to assess whether a resource is healthy")
+	fmt.Fprintln(bw, "# TYPE azure_resource_health_availability_up gauge")
+
+	failures := 0
+	for _, subscription := range subscriptions {
+		failures += forEachResourceHistory(ctx, subscription, nil, func(history *ResourceHistory) {
+			writeHistorySamples(bw, formatOpenMetricsSeries("azure_resource_health_availability_up", history.Labels), history.States, options)
+		})
+	}
+
+	fmt.Fprintln(bw, "# EOF")
+	if err := bw.Flush(); err != nil {
+		return errors.Wrap(err, "error writing backfill output")
+	}
+	if failures > 0 {
+		return errors.Errorf("failed to backfill %d subscriptions or resources", failures)
+	}
+	return nil
+}
+
+// writeHistorySamples writes a sample of a series every step, from the first known state in the time range
+// Samples are aligned on step, so that series of different resources share timestamps.
+func writeHistorySamples(w io.Writer, series string, history []HistoricalState, options BackfillOptions) {
+	t := options.Start.Truncate(options.Step)
+	if t.Before(options.Start) {
+		t = t.Add(options.Step)
+	}
+
+	current := -1
+	for ; !t.After(options.End); t = t.Add(options.Step) {
+		for current+1 < len(history) && !history[current+1].Occurred.After(t) {
+			current++
+		}
+		if current < 0 {
+			continue
+		}
+
+		// Only the `Unavailable` status can be used with confidence to consider availability "down"
+		up := 1
+		if history[current].State == string(resourcehealth.Unavailable) {
+			up = 0
+		}
+		fmt.Fprintf(w, "%s %d %d\n", series, up, t.Unix())
+	}
+}
+
+// formatOpenMetricsSeries returns the series of a metric name and labels, with labels sorted by name
+func formatOpenMetricsSeries(name string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for labelName := range labels {
+		names = append(names, labelName)
+	}
+	sort.Strings(names)
+
+	var series strings.Builder
+	series.WriteString(name)
+	series.WriteString("{")
+	for i, labelName := range names {
+		if i > 0 {
+			series.WriteString(",")
+		}
+		fmt.Fprintf(&series, `%s="%s"`, labelName, openMetricsLabelValueEscaper.Replace(labels[labelName]))
+	}
+	series.WriteString("}")
+	return series.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+)
+
+func backfillHistory(start time.Time) *[]resourcehealth.AvailabilityStatus {
+	// History is returned most recent first
+	return &[]resourcehealth.AvailabilityStatus{
+		{Properties: &resourcehealth.AvailabilityStatusProperties{
+			AvailabilityState: resourcehealth.Available,
+			OccuredTime:       &date.Time{Time: start.Add(150 * time.Second)},
+		}},
+		{Properties: &resourcehealth.AvailabilityStatusProperties{
+			AvailabilityState: resourcehealth.Unavailable,
+			OccuredTime:       &date.Time{Time: start.Add(90 * time.Second)},
+		}},
+		{Properties: &resourcehealth.AvailabilityStatusProperties{
+			AvailabilityState: resourcehealth.Available,
+			OccuredTime:       &date.Time{Time: start.Add(-time.Hour)},
+		}},
+	}
+}
+
+func TestBackfill_OK(t *testing.T) {
+	loadConfig("config/config_example.yml")
+	rh := MockedResourceHealth{}
+	r := MockedResources{}
+
+	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
+	otherID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/other_instance"
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+		{ID: &otherID, Type: &resourceType},
+	}, nil)
+
+	start := time.Unix(1500000000, 0)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("ForEachAvailabilityStatusHistory", resourceID).Return(backfillHistory(start), nil)
+
+	var output bytes.Buffer
+	err := Backfill(context.Background(), &output, []subscriptionClients{{resourceHealth: &rh, resources: &r}}, BackfillOptions{
+		Start: start.Add(-30 * time.Second),
+		End:   start.Add(3 * time.Minute),
+		Step:  time.Minute,
+	})
+	if err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+
+	series := `azure_resource_health_availability_up{resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"}`
+	want := `# HELP azure_resource_health_availability_up Resource health availability that relies on signals from different Azure services to assess whether a resource is healthy
+# TYPE azure_resource_health_availability_up gauge
+` + series + ` 1 1500000000
+` + series + ` 1 1500000060
+` + series + ` 0 1500000120
+` + series + ` 1 1500000180
+# EOF
+`
+	if output.String() != want {
+		t.Errorf("Unexpected output: got %v, want %v", output.String(), want)
+	}
+	rh.AssertNotCalled(t, "ForEachAvailabilityStatusHistory", otherID)
+}
+
+func TestBackfill_ResourceError(t *testing.T) {
+	loadConfig("config/config_example.yml")
+	rh := MockedResourceHealth{}
+	r := MockedResources{}
+
+	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("ForEachAvailabilityStatusHistory", resourceID).Return(&[]resourcehealth.AvailabilityStatus{}, errors.New("Unit test Error"))
+
+	var output bytes.Buffer
+	err := Backfill(context.Background(), &output, []subscriptionClients{{resourceHealth: &rh, resources: &r}}, BackfillOptions{
+		Start: time.Unix(1500000000, 0),
+		End:   time.Unix(1500000600, 0),
+		Step:  time.Minute,
+	})
+	if err == nil {
+		t.Error("Should fail")
+	}
+
+	want := `# HELP azure_resource_health_availability_up Resource health availability that relies on signals from different Azure services to assess whether a resource is healthy
+# TYPE azure_resource_health_availability_up gauge
+# EOF
+`
+	if output.String() != want {
+		t.Errorf("Unexpected output: got %v, want %v", output.String(), want)
+	}
+}
+
+func TestFormatOpenMetricsSeries(t *testing.T) {
+	series := formatOpenMetricsSeries("metric", map[string]string{"b": `quoted "value"`, "a": `back\slash`})
+	want := `metric{a="back\\slash",b="quoted \"value\""}`
+	if series != want {
+		t.Errorf("Unexpected series: got %v, want %v", series, want)
+	}
+}
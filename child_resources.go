@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// ChildResourcesResourceType is the resource type reported for child availability statuses collection
+const ChildResourcesResourceType = "Microsoft.ResourceHealth/childResources"
+
+// childResourcesEnabled returns whether any configuration selecting the resource enables child_resources
+func childResourcesEnabled(resource *resources.GenericResource) bool {
+	for i := range config.ResourceConfigurations {
+		if config.ResourceConfigurations[i].ChildResources && config.ResourceConfigurations[i].Matches(resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchChildren fetches the availability statuses of the children of the resources enabling child_resources
+// This costs one request per resource, so that a failure is isolated to its resource.
+// Resources are fetched in parallel in the worker pool, bounded by the concurrent requests limit of the subscription.
+func (c *ResourceHealthCollector) fetchChildren(ctx context.Context, subscription subscriptionClients, snapshot *SubscriptionSnapshot) {
+	var tasks []func()
+	var failures int32
+	for i := range snapshot.Resources {
+		resource := &snapshot.Resources[i]
+		if !childResourcesEnabled(&resource.Resource) {
+			continue
+		}
+		tasks = append(tasks, func() {
+			if ctx.Err() != nil {
+				atomic.AddInt32(&failures, 1)
+				return
+			}
+			var children []resourcehealth.AvailabilityStatus
+			err := subscription.resourceHealth.ForEachChildAvailabilityStatus(ctx, *resource.Resource.ID, func(as *resourcehealth.AvailabilityStatus) error {
+				children = append(children, *as)
+				return nil
+			})
+			if err != nil {
+				log.Errorf("Failed to get the child availability statuses of %s: %v", *resource.Resource.ID, err)
+				c.countAPIError(ResourceHealthAPI, snapshot.SubscriptionID, err)
+				atomic.AddInt32(&failures, 1)
+				return
+			}
+			resource.Children = children
+		})
+	}
+	if len(tasks) == 0 {
+		return
+	}
+
+	c.workers.Run(tasks)
+	c.setTypeResult(snapshot, ChildResourcesResourceType, failures == 0)
+}
+
+// childName returns the ID of a child relative to its parent, such as virtualMachines/0 for a scale set instance
+func childName(parentID string, as *resourcehealth.AvailabilityStatus) string {
+	if as.ID == nil {
+		return ""
+	}
+	id := *as.ID
+	if strings.HasSuffix(strings.ToLower(id), strings.ToLower(AvailabilityStatusIDSuffix)) {
+		id = id[:len(id)-len(AvailabilityStatusIDSuffix)]
+	}
+	if len(id) > len(parentID) && strings.EqualFold(id[:len(parentID)], parentID) {
+		return strings.TrimPrefix(id[len(parentID):], "/")
+	}
+	return id
+}
+
+// CollectChildAvailability exports the availability of each child of a resource, along with the fraction of healthy children
+func (c *ResourceHealthCollector) CollectChildAvailability(ch chan<- prometheus.Metric, resource *MonitoredResource) {
+	if len(resource.Children) == 0 {
+		return
+	}
+
+	healthy := 0
+	for i := range resource.Children {
+		child := &resource.Children[i]
+
+		// As for the resources, only the `Unavailable` status is considered "down"
+		up := 1.0
+		if availabilityState(child) == string(resourcehealth.Unavailable) {
+			up = 0
+		} else {
+			healthy++
+		}
+
+		labels := copyLabels(resource.Labels)
+		labels["child"] = childName(*resource.Resource.ID, child)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("azure_resource_health_child_availability_up", "Resource health availability of a child of the resource, such as a scale set instance", nil, labels),
+			prometheus.GaugeValue,
+			up,
+		)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("azure_resource_health_healthy_fraction", "Fraction of the children of the resource which are not unavailable", nil, copyLabels(resource.Labels)),
+		prometheus.GaugeValue,
+		float64(healthy)/float64(len(resource.Children)),
+	)
+}
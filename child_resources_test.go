@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+)
+
+const scaleSetID = "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachineScaleSets/my_scale_set"
+
+func TestChildName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{scaleSetID + "/virtualMachines/0" + AvailabilityStatusIDSuffix, "virtualMachines/0"},
+		{strings.ToLower(scaleSetID + "/virtualMachines/1" + AvailabilityStatusIDSuffix), "virtualmachines/1"},
+		{"/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/other", "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/other"},
+	}
+
+	for _, test := range tests {
+		id := test.id
+		if got := childName(scaleSetID, &resourcehealth.AvailabilityStatus{ID: &id}); got != test.want {
+			t.Errorf("Unexpected child name of %s: got %v, want %v", test.id, got, test.want)
+		}
+	}
+}
+
+func mockScaleSet(r *MockedResources, rh *MockedResourceHealth) {
+	resourceID := scaleSetID
+	asID := resourceID + AvailabilityStatusIDSuffix
+	resourceType := "Microsoft.Compute/virtualMachineScaleSets"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}},
+	}, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+}
+
+func TestCollect_ChildResources(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	mockScaleSet(&r, &rh)
+
+	var children []resourcehealth.AvailabilityStatus
+	for i, state := range []resourcehealth.AvailabilityStateValues{resourcehealth.Available, resourcehealth.Unavailable, resourcehealth.Unavailable, resourcehealth.Unknown} {
+		childID := scaleSetID + "/virtualMachines/" + string('0'+rune(i)) + AvailabilityStatusIDSuffix
+		children = append(children, resourcehealth.AvailabilityStatus{
+			ID:         &childID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: state},
+		})
+	}
+	rh.On("ForEachChildAvailabilityStatus", scaleSetID).Return(&children, nil)
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachineScaleSets"
+    child_resources: true
+`)
+
+	for _, want := range []string{
+		`azure_resource_health_availability_up{resource_group="my_rg",resource_name="my_scale_set",resource_type="Microsoft.Compute/virtualMachineScaleSets",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_child_availability_up{child="virtualMachines/0",resource_group="my_rg",resource_name="my_scale_set",resource_type="Microsoft.Compute/virtualMachineScaleSets",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_child_availability_up{child="virtualMachines/1",resource_group="my_rg",resource_name="my_scale_set",resource_type="Microsoft.Compute/virtualMachineScaleSets",subscription_id="my_subscription"} 0`,
+		`azure_resource_health_child_availability_up{child="virtualMachines/3",resource_group="my_rg",resource_name="my_scale_set",resource_type="Microsoft.Compute/virtualMachineScaleSets",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_healthy_fraction{resource_group="my_rg",resource_name="my_scale_set",resource_type="Microsoft.Compute/virtualMachineScaleSets",subscription_id="my_subscription"} 0.5`,
+		`azure_health_exporter_collect_success{resource_type="Microsoft.ResourceHealth/childResources",subscription_id="my_subscription"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+}
+
+func TestCollect_ChildResources_Error(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	mockScaleSet(&r, &rh)
+	rh.On("ForEachChildAvailabilityStatus", scaleSetID).Return(nil, errors.New("Unit test Error"))
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachineScaleSets"
+    child_resources: true
+`)
+
+	for _, want := range []string{
+		`azure_resource_health_availability_up{resource_group="my_rg",resource_name="my_scale_set",resource_type="Microsoft.Compute/virtualMachineScaleSets",subscription_id="my_subscription"} 1`,
+		`azure_health_exporter_collect_success{resource_type="Microsoft.ResourceHealth/childResources",subscription_id="my_subscription"} 0`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+	if strings.Contains(rr.Body.String(), "azure_resource_health_healthy_fraction") {
+		t.Errorf("Unexpected healthy fraction in body %v", rr.Body.String())
+	}
+}
+
+func TestCollect_ChildResources_Disabled(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	mockScaleSet(&r, &rh)
+
+	CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachineScaleSets"
+`)
+
+	rh.AssertNotCalled(t, "ForEachChildAvailabilityStatus", scaleSetID)
+}
+
+// concurrentChildResourceHealth records the highest number of child availability statuses fetched at a time
+type concurrentChildResourceHealth struct {
+	MockedResourceHealth
+	mutex       sync.Mutex
+	inflight    int
+	maxInflight int
+}
+
+func (c *concurrentChildResourceHealth) ForEachChildAvailabilityStatus(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	c.mutex.Lock()
+	c.inflight++
+	if c.inflight > c.maxInflight {
+		c.maxInflight = c.inflight
+	}
+	c.mutex.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	c.mutex.Lock()
+	c.inflight--
+	c.mutex.Unlock()
+	return nil
+}
+
+func TestCollect_ChildResources_Parallel(t *testing.T) {
+	r := MockedResources{}
+	rh := concurrentChildResourceHealth{}
+	collector := newResourceHealthCollector([]subscriptionClients{
+		{resourceHealth: &rh, resources: &r},
+	}).WithWorkers(3)
+
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	resourceType := "Microsoft.Compute/virtualMachineScaleSets"
+	monitoring := "enabled"
+	for i := 0; i < 3; i++ {
+		resourceID := fmt.Sprintf("%s_%d", scaleSetID, i)
+		asID := resourceID + AvailabilityStatusIDSuffix
+		resList = append(resList, resources.GenericResource{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}})
+		asList = append(asList, resourcehealth.AvailabilityStatus{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachineScaleSets"
+    child_resources: true
+`)
+
+	want := `azure_health_exporter_collect_success{resource_type="Microsoft.ResourceHealth/childResources",subscription_id="my_subscription"} 1`
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Missing %v in body %v", want, rr.Body.String())
+	}
+	if rh.maxInflight < 2 {
+		t.Errorf("Children were not fetched in parallel: got %v at a time, want up to %v", rh.maxInflight, 3)
+	}
+}
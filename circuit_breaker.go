@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+// Circuit breaker states, as exposed in the azure_health_exporter_circuit_breaker_state metric
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+// ErrCircuitOpen is returned when a request is rejected by an open circuit breaker
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerOptions configures a circuit breaker
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures opening the circuit, 0 disabling the breaker
+	FailureThreshold int
+	// OpenDuration is the time the circuit stays open before letting a probe request through
+	OpenDuration time.Duration
+}
+
+// CircuitBreaker stops sending requests to Azure after repeated failures
+type CircuitBreaker struct {
+	options  CircuitBreakerOptions
+	mutex    sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+	now      func() time.Time
+}
+
+// NewCircuitBreaker returns a closed circuit breaker
+func NewCircuitBreaker(options CircuitBreakerOptions) *CircuitBreaker {
+	return &CircuitBreaker{
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// State returns the current state of the circuit breaker
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	return cb.state
+}
+
+// Allow returns ErrCircuitOpen if a request must not be sent
+// Once the open duration is over, a single probe request is allowed
+func (cb *CircuitBreaker) Allow() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if cb.now().Sub(cb.openedAt) < cb.options.OpenDuration {
+			return ErrCircuitOpen
+		}
+		cb.state = CircuitHalfOpen
+		cb.probing = true
+	case CircuitHalfOpen:
+		if cb.probing {
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// Record records the outcome of an allowed request
+func (cb *CircuitBreaker) Record(success bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.probing = false
+	if success {
+		cb.state = CircuitClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || (cb.options.FailureThreshold > 0 && cb.failures >= cb.options.FailureThreshold) {
+		cb.state = CircuitOpen
+		cb.openedAt = cb.now()
+	}
+}
+
+// Release releases an allowed request without recording its outcome, letting another probe through if it was one
+func (cb *CircuitBreaker) Release() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.probing = false
+}
+
+// DoCircuitBreaker returns a SendDecorator rejecting requests while the circuit breaker is open
+// Throttling, server errors and network errors are recorded as failures. Requests cancelled by their caller,
+// such as on a scrape timeout, tell nothing about Azure and are not recorded.
+func DoCircuitBreaker(cb *CircuitBreaker) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if err := cb.Allow(); err != nil {
+				return nil, err
+			}
+
+			resp, err := s.Do(r)
+			if r.Context().Err() != nil {
+				cb.Release()
+				return resp, err
+			}
+			cb.Record(err == nil && resp != nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError)
+			return resp, err
+		})
+	}
+}
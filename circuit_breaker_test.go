@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+func TestCircuitBreaker_OpensAfterThreshold(t *testing.T) {
+	now := time.Now()
+	cb := NewCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 2, OpenDuration: time.Minute})
+	cb.now = func() time.Time { return now }
+
+	cb.Record(false)
+	if cb.State() != CircuitClosed {
+		t.Errorf("Unexpected state: got %v, want %v", cb.State(), CircuitClosed)
+	}
+	cb.Record(false)
+	if cb.State() != CircuitOpen {
+		t.Errorf("Unexpected state: got %v, want %v", cb.State(), CircuitOpen)
+	}
+	if err := cb.Allow(); err != ErrCircuitOpen {
+		t.Errorf("Unexpected error: got %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// A single probe is allowed once the open duration is over
+	now = now.Add(time.Minute)
+	if err := cb.Allow(); err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+	if cb.State() != CircuitHalfOpen {
+		t.Errorf("Unexpected state: got %v, want %v", cb.State(), CircuitHalfOpen)
+	}
+	if err := cb.Allow(); err != ErrCircuitOpen {
+		t.Errorf("Unexpected error: got %v, want %v", err, ErrCircuitOpen)
+	}
+
+	cb.Record(true)
+	if cb.State() != CircuitClosed {
+		t.Errorf("Unexpected state: got %v, want %v", cb.State(), CircuitClosed)
+	}
+}
+
+func TestCircuitBreaker_FailedProbeReopens(t *testing.T) {
+	now := time.Now()
+	cb := NewCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 1, OpenDuration: time.Minute})
+	cb.now = func() time.Time { return now }
+
+	cb.Record(false)
+	now = now.Add(time.Minute)
+	cb.Allow()
+	cb.Record(false)
+	if cb.State() != CircuitOpen {
+		t.Errorf("Unexpected state: got %v, want %v", cb.State(), CircuitOpen)
+	}
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	cb := NewCircuitBreaker(CircuitBreakerOptions{})
+	for i := 0; i < 10; i++ {
+		cb.Record(false)
+	}
+	if err := cb.Allow(); err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+}
+
+func TestDoCircuitBreaker(t *testing.T) {
+	s, attempts := responseSender(http.StatusServiceUnavailable)
+	cb := NewCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 2, OpenDuration: time.Hour})
+	sender := autorest.DecorateSender(s, DoCircuitBreaker(cb))
+
+	for i := 0; i < 3; i++ {
+		sender.Do(httptest.NewRequest("GET", "/", nil))
+	}
+	if *attempts != 2 {
+		t.Errorf("Unexpected attempts: got %v, want %v", *attempts, 2)
+	}
+	if _, err := sender.Do(httptest.NewRequest("GET", "/", nil)); err != ErrCircuitOpen {
+		t.Errorf("Unexpected error: got %v, want %v", err, ErrCircuitOpen)
+	}
+}
+
+func TestDoCircuitBreaker_CallerCancelled(t *testing.T) {
+	cancelled := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	})
+	cb := NewCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 2, OpenDuration: time.Hour})
+	sender := autorest.DecorateSender(cancelled, DoCircuitBreaker(cb))
+
+	// Requests cancelled by their caller are not failures of Azure
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		sender.Do(httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		cancel()
+	}
+	if state := cb.State(); state != CircuitClosed {
+		t.Errorf("Unexpected state: got %v, want %v", state, CircuitClosed)
+	}
+
+	// A cancelled probe lets another probe through
+	now := time.Unix(1500000000, 0)
+	cb.now = func() time.Time { return now }
+	cb.Record(false)
+	cb.Record(false)
+	now = now.Add(2 * time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sender.Do(httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if err := cb.Allow(); err != nil {
+		t.Errorf("Unexpected error after a cancelled probe: %v", err)
+	}
+}
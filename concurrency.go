@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var inflightRequests = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "azure_health_exporter_inflight_requests",
+		Help: "Number of Azure API requests in flight",
+	},
+	[]string{"subscription_id"},
+)
+
+// WorkerPool runs tasks with a bounded concurrency
+type WorkerPool struct {
+	size int
+}
+
+// NewWorkerPool returns a pool running up to size tasks at a time
+func NewWorkerPool(size int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	return &WorkerPool{size: size}
+}
+
+// Run runs all the tasks in the pool, and waits for them to complete
+func (p *WorkerPool) Run(tasks []func()) {
+	queue := make(chan func())
+	var wg sync.WaitGroup
+	for i := 0; i < p.size && i < len(tasks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// DoLimitConcurrency returns a SendDecorator sending at most maxConcurrent requests at a time,
+// so that a subscription does not exhaust its rate limit budget in bursts. 0 means no limit.
+// Requests in flight are exposed in the azure_health_exporter_inflight_requests metric.
+func DoLimitConcurrency(subscriptionID string, maxConcurrent int) autorest.SendDecorator {
+	var tokens chan struct{}
+	if maxConcurrent > 0 {
+		tokens = make(chan struct{}, maxConcurrent)
+	}
+	inflight := inflightRequests.WithLabelValues(subscriptionID)
+
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			if tokens != nil {
+				select {
+				case tokens <- struct{}{}:
+					defer func() { <-tokens }()
+				case <-r.Context().Done():
+					return nil, r.Context().Err()
+				}
+			}
+
+			inflight.Inc()
+			defer inflight.Dec()
+			return s.Do(r)
+		})
+	}
+}
+
+// DoLimitRate returns a SendDecorator spacing requests so that at most requestsPerSecond are sent,
+// e.g. to stay within a rate budget during long running commands. 0 means no limit.
+func DoLimitRate(requestsPerSecond float64) autorest.SendDecorator {
+	var mutex sync.Mutex
+	var next time.Time
+
+	return func(s autorest.Sender) autorest.Sender {
+		if requestsPerSecond <= 0 {
+			return s
+		}
+		interval := time.Duration(float64(time.Second) / requestsPerSecond)
+
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			mutex.Lock()
+			now := time.Now()
+			if next.Before(now) {
+				next = now
+			}
+			delay := next.Sub(now)
+			next = next.Add(interval)
+			mutex.Unlock()
+
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return nil, r.Context().Err()
+				}
+			}
+			return s.Do(r)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// concurrencyProbe records the maximum number of concurrent calls
+type concurrencyProbe struct {
+	current int32
+	max     int32
+}
+
+func (p *concurrencyProbe) run() {
+	current := atomic.AddInt32(&p.current, 1)
+	for {
+		max := atomic.LoadInt32(&p.max)
+		if current <= max || atomic.CompareAndSwapInt32(&p.max, max, current) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddInt32(&p.current, -1)
+}
+
+func TestWorkerPool_Run(t *testing.T) {
+	probe := &concurrencyProbe{}
+	done := int32(0)
+	var tasks []func()
+	for i := 0; i < 10; i++ {
+		tasks = append(tasks, func() {
+			probe.run()
+			atomic.AddInt32(&done, 1)
+		})
+	}
+
+	NewWorkerPool(3).Run(tasks)
+
+	if done != 10 {
+		t.Errorf("Unexpected completed tasks: got %v, want %v", done, 10)
+	}
+	if probe.max != 3 {
+		t.Errorf("Unexpected concurrency: got %v, want %v", probe.max, 3)
+	}
+}
+
+func TestDoLimitConcurrency(t *testing.T) {
+	probe := &concurrencyProbe{}
+	s := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		probe.run()
+		return httptest.NewRecorder().Result(), nil
+	})
+	sender := autorest.DecorateSender(s, DoLimitConcurrency("limited_subscription", 2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sender.Do(httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	wg.Wait()
+
+	if probe.max != 2 {
+		t.Errorf("Unexpected concurrency: got %v, want %v", probe.max, 2)
+	}
+	if inflight := testutil.ToFloat64(inflightRequests.WithLabelValues("limited_subscription")); inflight != 0 {
+		t.Errorf("Unexpected inflight requests: got %v, want %v", inflight, 0)
+	}
+}
+
+func TestDoLimitRate(t *testing.T) {
+	s := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		return httptest.NewRecorder().Result(), nil
+	})
+	sender := autorest.DecorateSender(s, DoLimitRate(100))
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		sender.Do(httptest.NewRequest("GET", "/", nil))
+	}
+
+	// The first request is sent right away, the following ones every 10ms
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Requests sent too fast: %v", elapsed)
+	}
+}
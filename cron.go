@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cronSchedule is a standard 5-field cron expression: minute, hour, day of month, month and day of week
+type cronSchedule struct {
+	minutes     uint64
+	hours       uint64
+	daysOfMonth uint64
+	months      uint64
+	daysOfWeek  uint64
+	// A day matches either the day of month or the day of week when both are restricted, as cron does
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+// cronField is the range of values of a cron field
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronSchedule parses a cron expression, whose fields may be *, values, ranges (1-5), steps (*/15, 1-10/2) or lists of them
+func parseCronSchedule(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, errors.Errorf("cron expression %q must have %d fields", expression, len(cronFields))
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseCronField(field, cronFields[i]); err != nil {
+			return nil, errors.Wrapf(err, "invalid cron expression %q", expression)
+		}
+	}
+
+	// Sunday is both 0 and 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSchedule{
+		minutes:       bits[0],
+		hours:         bits[1],
+		daysOfMonth:   bits[2],
+		months:        bits[3],
+		daysOfWeek:    bits[4],
+		anyDayOfMonth: fields[2] == "*",
+		anyDayOfWeek:  fields[4] == "*",
+	}, nil
+}
+
+// parseCronField returns the values of a cron field as a bit set
+func parseCronField(value string, field cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		step := 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step <= 0 {
+				return 0, errors.Errorf("invalid %s step %q", field.name, part[slash+1:])
+			}
+			part = part[:slash]
+		}
+
+		start, end := field.min, field.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.Errorf("invalid %s %q", field.name, part)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.Errorf("invalid %s %q", field.name, part)
+				}
+			}
+		}
+		if start < field.min || end > field.max || start > end {
+			return 0, errors.Errorf("%s %q out of range %d-%d", field.name, part, field.min, field.max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matches returns whether the schedule fires at the minute of t
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minutes&(1<<uint(t.Minute())) == 0 || s.hours&(1<<uint(t.Hour())) == 0 || s.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dayOfMonth := s.daysOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := s.daysOfWeek&(1<<uint(t.Weekday())) != 0
+	if !s.anyDayOfMonth && !s.anyDayOfWeek {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
+
+// lastStart returns the latest time the schedule fired in (t - within, t], false if none
+func (s *cronSchedule) lastStart(t time.Time, within time.Duration) (time.Time, bool) {
+	minute := t.Truncate(time.Minute)
+	for start := minute; t.Sub(start) < within; start = start.Add(-time.Minute) {
+		if s.matches(start) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
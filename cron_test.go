@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule_Errors(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCronSchedule(expression); err == nil {
+			t.Errorf("Should have an error parsing %q", expression)
+		}
+	}
+}
+
+func TestCronSchedule_Matches(t *testing.T) {
+	// Tuesday
+	tuesday := time.Date(2020, 1, 7, 2, 30, 0, 0, time.UTC)
+	tests := []struct {
+		expression string
+		time       time.Time
+		want       bool
+	}{
+		{"* * * * *", tuesday, true},
+		{"30 2 * * *", tuesday, true},
+		{"31 2 * * *", tuesday, false},
+		{"*/15 2 * * *", tuesday, true},
+		{"*/20 2 * * *", tuesday, false},
+		{"0-10,30 1-3 * * *", tuesday, true},
+		{"30 2 * * 2", tuesday, true},
+		{"30 2 * * 1-5/2", tuesday, false},
+		{"30 2 * 2 *", tuesday, false},
+		// Either the day of month or the day of week matches when both are restricted
+		{"30 2 1 * 2", tuesday, true},
+		{"30 2 7 * 0", tuesday, true},
+		{"30 2 1 * 0", tuesday, false},
+		{"30 2 * * 7", tuesday.AddDate(0, 0, 5), true},
+	}
+
+	for _, test := range tests {
+		schedule, err := parseCronSchedule(test.expression)
+		if err != nil {
+			t.Fatalf("Error parsing %q: %v", test.expression, err)
+		}
+		if got := schedule.matches(test.time); got != test.want {
+			t.Errorf("Unexpected match of %q at %v: got %v, want %v", test.expression, test.time, got, test.want)
+		}
+	}
+}
+
+func TestCronSchedule_LastStart(t *testing.T) {
+	schedule, err := parseCronSchedule("0 2 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 1, 7, 3, 59, 30, 0, time.UTC)
+	start, ok := schedule.lastStart(now, 2*time.Hour)
+	if !ok || !start.Equal(time.Date(2020, 1, 7, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected start: got %v %v", start, ok)
+	}
+	if _, ok := schedule.lastStart(now, time.Hour); ok {
+		t.Errorf("Unexpected start within an hour of %v", now)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// ResourcePropertiesResourceType is the resource type reported for resource properties collection
+const ResourcePropertiesResourceType = "Microsoft.ResourceGraph/resources"
+
+// DependenciesConfig tells how the dependencies between resources are known
+type DependenciesConfig struct {
+	// Infer enables inferring dependencies from the managedBy field and the properties of the resources
+	Infer bool `yaml:"infer"`
+	// Declared dependencies add to the inferred ones
+	Declared []DeclaredDependency `yaml:"declared"`
+}
+
+// DeclaredDependency declares resources a resource depends on
+type DeclaredDependency struct {
+	Resource  string   `yaml:"resource"`
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// init validates the declared dependencies
+func (d *DependenciesConfig) init() error {
+	for _, declared := range d.Declared {
+		if declared.Resource == "" {
+			return errors.New("dependency resource is mandatory")
+		}
+		if len(declared.DependsOn) == 0 {
+			return errors.Errorf("dependency of %s has no depends_on", declared.Resource)
+		}
+	}
+	return nil
+}
+
+// fetchProperties queries the properties of the candidate resources from Resource Graph, as resources are listed without them,
+// so that the resource IDs they reference can be inferred as dependencies.
+// Only the managedBy dependencies are inferred when the query fails.
+func (c *ResourceHealthCollector) fetchProperties(ctx context.Context, subscription subscriptionClients, snapshot *SubscriptionSnapshot, resourceTypes []string, candidates []MonitoredResource, index ResourceIndex) {
+	err := subscription.resources.ForEachResourceProperties(ctx, resourceTypes, func(resourceID string, properties interface{}) error {
+		if position, ok := index.Lookup(resourceID); ok {
+			candidates[position].Resource.Properties = properties
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to get the resource properties of subscription %s: %v", snapshot.SubscriptionID, err)
+		c.countAPIError(ResourceGraphAPI, snapshot.SubscriptionID, err)
+	}
+	c.setTypeResult(snapshot, ResourcePropertiesResourceType, err == nil)
+}
+
+// dependencyGraph maps the normalized ID of a resource to the normalized IDs of the resources it depends on
+type dependencyGraph map[string][]string
+
+func (g dependencyGraph) add(resourceID string, dependencyID string) {
+	resourceID = normalizeResourceID(resourceID)
+	dependencyID = normalizeResourceID(dependencyID)
+	if resourceID == dependencyID {
+		return
+	}
+	for _, known := range g[resourceID] {
+		if known == dependencyID {
+			return
+		}
+	}
+	g[resourceID] = append(g[resourceID], dependencyID)
+}
+
+// newDependencyGraph returns the dependencies declared in config, and inferred from the resources of the snapshot if enabled
+func newDependencyGraph(snapshot *Snapshot) dependencyGraph {
+	graph := make(dependencyGraph)
+	for _, declared := range config.Dependencies.Declared {
+		for _, dependencyID := range declared.DependsOn {
+			graph.add(declared.Resource, dependencyID)
+		}
+	}
+	if !config.Dependencies.Infer {
+		return graph
+	}
+
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		for i := range subscriptionSnapshot.Resources {
+			resource := &subscriptionSnapshot.Resources[i].Resource
+			if resource.ID == nil {
+				continue
+			}
+			// A managed resource, such as the disk of a virtual machine, is a dependency of its manager
+			if resource.ManagedBy != nil && *resource.ManagedBy != "" {
+				graph.add(*resource.ManagedBy, *resource.ID)
+			}
+			// Properties reference dependencies by ID, such as the serverFarmId of a site or the network interfaces of a virtual machine
+			var referencedIDs []string
+			findResourceIDs(resource.Properties, "", &referencedIDs)
+			for _, referencedID := range referencedIDs {
+				graph.add(*resource.ID, referencedID)
+			}
+		}
+	}
+	return graph
+}
+
+// findResourceIDs appends the resource IDs found in the id and *Id fields of decoded JSON properties
+func findResourceIDs(value interface{}, key string, ids *[]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for childKey, child := range v {
+			findResourceIDs(child, childKey, ids)
+		}
+	case []interface{}:
+		for _, child := range v {
+			findResourceIDs(child, key, ids)
+		}
+	case string:
+		if (key == "id" || strings.HasSuffix(key, "Id")) && strings.HasPrefix(strings.ToLower(v), "/subscriptions/") {
+			*ids = append(*ids, v)
+		}
+	}
+}
+
+// unavailableDependencies returns the unavailable resources a resource depends on, directly or transitively
+func (g dependencyGraph) unavailableDependencies(resourceID string, monitored map[string]*MonitoredResource) []*MonitoredResource {
+	var unavailable []*MonitoredResource
+	visited := map[string]bool{resourceID: true}
+	pending := append([]string(nil), g[resourceID]...)
+	for len(pending) > 0 {
+		dependencyID := pending[0]
+		pending = pending[1:]
+		if visited[dependencyID] {
+			continue
+		}
+		visited[dependencyID] = true
+
+		if dependency, ok := monitored[dependencyID]; ok && availabilityState(&dependency.AvailabilityStatus) == string(resourcehealth.Unavailable) {
+			unavailable = append(unavailable, dependency)
+		}
+		pending = append(pending, g[dependencyID]...)
+	}
+	return unavailable
+}
+
+// CollectDependencies exports the unavailable dependencies of the monitored resources
+// Only monitored dependencies have a known availability, so dependencies must be selected by a resource configuration as well.
+func (c *ResourceHealthCollector) CollectDependencies(ch chan<- prometheus.Metric, snapshot *Snapshot) {
+	graph := newDependencyGraph(snapshot)
+	if len(graph) == 0 {
+		return
+	}
+
+	monitored := make(map[string]*MonitoredResource)
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		for i := range subscriptionSnapshot.Resources {
+			resource := &subscriptionSnapshot.Resources[i]
+			monitored[normalizeResourceID(*resource.Resource.ID)] = resource
+		}
+	}
+
+	resourceIDs := make([]string, 0, len(monitored))
+	for resourceID := range monitored {
+		resourceIDs = append(resourceIDs, resourceID)
+	}
+	sort.Strings(resourceIDs)
+
+	for _, resourceID := range resourceIDs {
+		resource := monitored[resourceID]
+		for _, dependency := range graph.unavailableDependencies(resourceID, monitored) {
+			labels := prometheus.Labels{}
+			for name, value := range resource.Labels {
+				labels[name] = value
+			}
+			for _, name := range []string{"subscription_id", "resource_group", "resource_name", "resource_type"} {
+				labels["dependency_"+name] = dependency.Labels[name]
+			}
+			// Sibling sub-resources, such as the databases of a server, only differ by their sub-resource name
+			if subResourceName, ok := dependency.Labels["sub_resource_name"]; ok {
+				labels["dependency_sub_resource_name"] = subResourceName
+			}
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc("azure_resource_health_dependency_degraded", "Unavailable dependency of the resource, direct or transitive", nil, labels),
+				prometheus.GaugeValue,
+				1,
+			)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFindResourceIDs(t *testing.T) {
+	properties := map[string]interface{}{
+		"serverFarmId": "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Web/serverfarms/my_plan",
+		"hostNames":    []interface{}{"my_site.azurewebsites.net"},
+		"networkProfile": map[string]interface{}{
+			"networkInterfaces": []interface{}{
+				map[string]interface{}{"id": "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Network/networkInterfaces/my_nic"},
+			},
+		},
+		"vmId": "0e6e0a5c-8d5f-4b4e-9a4b-0c0a8f1f1f1f",
+	}
+
+	var got []string
+	findResourceIDs(properties, "", &got)
+	sort.Strings(got)
+	want := []string{
+		"/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Network/networkInterfaces/my_nic",
+		"/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Web/serverfarms/my_plan",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Unexpected resource IDs: got %v, want %v", got, want)
+	}
+}
+
+func TestLoadConfigContent_Dependencies(t *testing.T) {
+	for _, configFile := range []string{
+		"dependencies:\n  declared:\n    - depends_on: [\"/subscriptions/my_subscription\"]\n",
+		"dependencies:\n  declared:\n    - resource: \"/subscriptions/my_subscription\"\n",
+	} {
+		if _, err := loadConfigContent([]byte(configFile)); err == nil {
+			t.Errorf("Should have an error loading %v", configFile)
+		}
+	}
+}
+
+func TestCollect_Dependencies(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	prefix := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/"
+	vmID := prefix + "Microsoft.Compute/virtualMachines/my_vm"
+	diskID := prefix + "Microsoft.Compute/disks/my_disk"
+	siteID := prefix + "Microsoft.Web/sites/my_site"
+	planID := prefix + "Microsoft.Web/serverfarms/my_plan"
+	frontID := prefix + "Microsoft.Web/sites/my_front"
+	monitoring := "enabled"
+
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	properties := make(map[string]interface{})
+	for _, instance := range []struct {
+		id           string
+		resourceType string
+		managedBy    string
+		properties   interface{}
+		state        resourcehealth.AvailabilityStateValues
+	}{
+		{vmID, "Microsoft.Compute/virtualMachines", "", nil, resourcehealth.Available},
+		{diskID, "Microsoft.Compute/disks", vmID, nil, resourcehealth.Unavailable},
+		{siteID, "Microsoft.Web/sites", "", map[string]interface{}{"serverFarmId": planID}, resourcehealth.Available},
+		{planID, "Microsoft.Web/serverfarms", "", nil, resourcehealth.Unavailable},
+		{frontID, "Microsoft.Web/sites", "", nil, resourcehealth.Available},
+	} {
+		id := instance.id
+		resourceType := instance.resourceType
+		managedBy := instance.managedBy
+		asID := id + AvailabilityStatusIDSuffix
+		resList = append(resList, resources.GenericResource{
+			ID:        &id,
+			Type:      &resourceType,
+			ManagedBy: &managedBy,
+			Tags:      map[string]*string{"Monitoring": &monitoring},
+		})
+		if instance.properties != nil {
+			// Listed resources have no properties, which are queried from Resource Graph
+			properties[strings.ToUpper(id)] = instance.properties
+		}
+		asList = append(asList, resourcehealth.AvailabilityStatus{
+			ID:         &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: instance.state},
+		})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	r.On("ForEachResourceProperties", mock.Anything).Return(properties, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+      - "Microsoft.Compute/disks"
+      - "Microsoft.Web/sites"
+      - "Microsoft.Web/serverfarms"
+dependencies:
+  infer: true
+  declared:
+    - resource: "`+frontID+`"
+      depends_on:
+        - "`+siteID+`"
+`)
+
+	for _, want := range []string{
+		`azure_resource_health_dependency_degraded{dependency_resource_group="my_rg",dependency_resource_name="my_disk",dependency_resource_type="Microsoft.Compute/disks",dependency_subscription_id="my_subscription",resource_group="my_rg",resource_name="my_vm",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_dependency_degraded{dependency_resource_group="my_rg",dependency_resource_name="my_plan",dependency_resource_type="Microsoft.Web/serverfarms",dependency_subscription_id="my_subscription",resource_group="my_rg",resource_name="my_site",resource_type="Microsoft.Web/sites",subscription_id="my_subscription"} 1`,
+		// The plan is a transitive dependency of the front site
+		`azure_resource_health_dependency_degraded{dependency_resource_group="my_rg",dependency_resource_name="my_plan",dependency_resource_type="Microsoft.Web/serverfarms",dependency_subscription_id="my_subscription",resource_group="my_rg",resource_name="my_front",resource_type="Microsoft.Web/sites",subscription_id="my_subscription"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+	if strings.Contains(rr.Body.String(), `dependency_resource_name="my_site"`) {
+		t.Errorf("Available dependency reported as degraded in body %v", rr.Body.String())
+	}
+	want := `azure_health_exporter_collect_success{resource_type="Microsoft.ResourceGraph/resources",subscription_id="my_subscription"} 1`
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Missing %v in body %v", want, rr.Body.String())
+	}
+}
+
+func TestCollect_DependenciesPropertiesFailure(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	prefix := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/"
+	vmID := prefix + "Microsoft.Compute/virtualMachines/my_vm"
+	diskID := prefix + "Microsoft.Compute/disks/my_disk"
+	vmType := "Microsoft.Compute/virtualMachines"
+	diskType := "Microsoft.Compute/disks"
+	vmASID := vmID + AvailabilityStatusIDSuffix
+	diskASID := diskID + AvailabilityStatusIDSuffix
+	monitoring := "enabled"
+	tags := map[string]*string{"Monitoring": &monitoring}
+
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &vmID, Type: &vmType, Tags: tags},
+		{ID: &diskID, Type: &diskType, ManagedBy: &vmID, Tags: tags},
+	}, nil)
+	r.On("ForEachResourceProperties", mock.Anything).Return(nil, errors.New("Forbidden"))
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &vmASID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}},
+		{ID: &diskASID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable}},
+	}, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+      - "Microsoft.Compute/disks"
+dependencies:
+  infer: true
+`)
+
+	// The managedBy dependencies are still inferred, and the availability still exported
+	for _, want := range []string{
+		`azure_health_exporter_collect_success{resource_type="Microsoft.ResourceGraph/resources",subscription_id="my_subscription"} 0`,
+		`azure_health_exporter_collect_success{resource_type="Microsoft.ResourceHealth/availabilityStatuses",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_dependency_degraded{dependency_resource_group="my_rg",dependency_resource_name="my_disk",dependency_resource_type="Microsoft.Compute/disks",dependency_subscription_id="my_subscription",resource_group="my_rg",resource_name="my_vm",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+}
+
+func TestCollect_DependenciesSubResources(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	prefix := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/"
+	siteID := prefix + "Microsoft.Web/sites/my_site"
+	monitoring := "enabled"
+
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	for _, instance := range []struct {
+		id           string
+		resourceType string
+		state        resourcehealth.AvailabilityStateValues
+	}{
+		{siteID, "Microsoft.Web/sites", resourcehealth.Available},
+		{prefix + "Microsoft.Sql/servers/my_server/databases/db1", "Microsoft.Sql/servers/databases", resourcehealth.Unavailable},
+		{prefix + "Microsoft.Sql/servers/my_server/databases/db2", "Microsoft.Sql/servers/databases", resourcehealth.Unavailable},
+	} {
+		id := instance.id
+		resourceType := instance.resourceType
+		asID := id + AvailabilityStatusIDSuffix
+		resList = append(resList, resources.GenericResource{ID: &id, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}})
+		asList = append(asList, resourcehealth.AvailabilityStatus{
+			ID:         &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: instance.state},
+		})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Web/sites"
+      - "Microsoft.Sql/servers/databases"
+dependencies:
+  declared:
+    - resource: "`+siteID+`"
+      depends_on:
+        - "`+prefix+`Microsoft.Sql/servers/my_server/databases/db1"
+        - "`+prefix+`Microsoft.Sql/servers/my_server/databases/db2"
+`)
+
+	if rr.Code != 200 {
+		t.Fatalf("Wrong status code: got %v, want %v: %v", rr.Code, 200, rr.Body.String())
+	}
+	for _, database := range []string{"db1", "db2"} {
+		want := `azure_resource_health_dependency_degraded{dependency_resource_group="my_rg",dependency_resource_name="my_server",dependency_resource_type="Microsoft.Sql/servers/databases",dependency_sub_resource_name="` + database + `",dependency_subscription_id="my_subscription",resource_group="my_rg",resource_name="my_site",resource_type="Microsoft.Web/sites",subscription_id="my_subscription"} 1`
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+}
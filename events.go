@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// EventsPath is the path of the event stream
+const EventsPath = "/api/v1/events"
+
+// Types of the CloudEvents emitted by the exporter
+const (
+	EventTypeAvailabilityChanged  = "com.fxinnovation.azure-health-exporter.availability.changed"
+	EventTypeServiceHealthUpdated = "com.fxinnovation.azure-health-exporter.service-health.updated"
+)
+
+// Formats of the event stream
+const (
+	EventFormatSSE    = "sse"
+	EventFormatNDJSON = "ndjson"
+)
+
+const (
+	// eventStreamHistory is the number of recent events replayed to clients resuming from a Last-Event-ID
+	eventStreamHistory = 1000
+	// eventSubscriberBuffer is the number of events buffered for a subscriber, newer ones being dropped once full
+	eventSubscriberBuffer = 100
+	// eventStreamKeepAlive is the interval at which an idle stream is written to, so that proxies keep it open
+	eventStreamKeepAlive = 15 * time.Second
+)
+
+// CloudEvent is an event in the CloudEvents 1.0 JSON format
+type CloudEvent struct {
+	SpecVersion     string      `json:"specversion"`
+	ID              string      `json:"id"`
+	Source          string      `json:"source"`
+	Type            string      `json:"type"`
+	Subject         string      `json:"subject,omitempty"`
+	Time            time.Time   `json:"time"`
+	DataContentType string      `json:"datacontenttype"`
+	Data            interface{} `json:"data"`
+}
+
+// EventStream publishes the availability transitions and service health event updates as CloudEvents to its subscribers
+// Subscribers are never waited for: the events they are too slow to receive are dropped.
+type EventStream struct {
+	mutex       sync.Mutex
+	source      string
+	prefix      string
+	sequence    uint64
+	recent      []*CloudEvent
+	subscribers map[chan *CloudEvent]bool
+	now         func() time.Time
+	dropped     prometheus.Counter
+}
+
+// NewEventStream returns a stream of the events of source, without any subscriber
+func NewEventStream(source string) *EventStream {
+	prefix := make([]byte, 4)
+	if _, err := rand.Read(prefix); err != nil {
+		log.Errorf("Error generating event ID prefix: %v", err)
+	}
+	return &EventStream{
+		source:      source,
+		prefix:      hex.EncodeToString(prefix),
+		subscribers: make(map[chan *CloudEvent]bool),
+		now:         time.Now,
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "azure_health_exporter_events_dropped_total",
+			Help: "Total number of events dropped because a subscriber of the event stream was too slow",
+		}),
+	}
+}
+
+// Notify publishes the availability transitions
+func (s *EventStream) Notify(transitions []StateTransition) {
+	detectedAt := s.now()
+	for i := range transitions {
+		s.publish(EventTypeAvailabilityChanged, transitions[i].ResourceID, newWebhookEvent(&transitions[i], detectedAt))
+	}
+}
+
+// NotifyServiceHealthEvents publishes the service health event updates
+func (s *EventStream) NotifyServiceHealthEvents(updates []ServiceHealthEventUpdate) {
+	for i := range updates {
+		update := updates[i]
+		s.publish(EventTypeServiceHealthUpdated, update.ResourceID, &update)
+	}
+}
+
+// publish sends an event to the subscribers, and keeps it for the ones resuming later
+func (s *EventStream) publish(eventType string, subject string, data interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sequence++
+	event := &CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              s.prefix + "-" + strconv.FormatUint(s.sequence, 10),
+		Source:          s.source,
+		Type:            eventType,
+		Subject:         subject,
+		Time:            s.now(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	s.recent = append(s.recent, event)
+	if len(s.recent) > eventStreamHistory {
+		s.recent = s.recent[len(s.recent)-eventStreamHistory:]
+	}
+
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			s.dropped.Inc()
+		}
+	}
+}
+
+// Subscribe returns the channel of the next events, along with the recent ones following lastEventID if any,
+// and the function to call once done
+func (s *EventStream) Subscribe(lastEventID string) (<-chan *CloudEvent, []*CloudEvent, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var replay []*CloudEvent
+	if lastEventID != "" {
+		for i, event := range s.recent {
+			if event.ID == lastEventID {
+				replay = append(replay, s.recent[i+1:]...)
+				break
+			}
+		}
+	}
+
+	subscriber := make(chan *CloudEvent, eventSubscriberBuffer)
+	s.subscribers[subscriber] = true
+	return subscriber, replay, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.subscribers, subscriber)
+	}
+}
+
+// subscriberCount returns the number of current subscribers
+func (s *EventStream) subscriberCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.subscribers)
+}
+
+// Describe to satisfy the collector interface.
+func (s *EventStream) Describe(ch chan<- *prometheus.Desc) {
+	s.dropped.Describe(ch)
+}
+
+// Collect exports the number of dropped events
+func (s *EventStream) Collect(ch chan<- prometheus.Metric) {
+	s.dropped.Collect(ch)
+}
+
+// WriteEvents writes the events of the stream to w as NDJSON, one CloudEvent per line, until ctx is done
+func WriteEvents(ctx context.Context, stream *EventStream, w io.Writer) {
+	events, _, cancel := stream.Subscribe("")
+	defer cancel()
+
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if err := encoder.Encode(event); err != nil {
+				log.Errorf("Error writing event %s: %v", event.ID, err)
+			}
+		}
+	}
+}
+
+// EventStreamHandler streams the events as server-sent events, or as NDJSON
+type EventStreamHandler struct {
+	stream *EventStream
+}
+
+// NewEventStreamHandler returns the handler of the event stream
+func NewEventStreamHandler(stream *EventStream) *EventStreamHandler {
+	return &EventStreamHandler{stream: stream}
+}
+
+// ServeHTTP streams the events until the client disconnects
+// Server-sent events are used when the client accepts them or asks for them with ?format=sse, NDJSON otherwise.
+// Clients resuming with a Last-Event-ID header, or a last_event_id query parameter, first receive the recent events they missed.
+func (h *EventStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = EventFormatNDJSON
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			format = EventFormatSSE
+		}
+	}
+	if format != EventFormatSSE && format != EventFormatNDJSON {
+		http.Error(w, "Unknown format "+format, http.StatusBadRequest)
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	events, replay, cancel := h.stream.Subscribe(lastEventID)
+	defer cancel()
+
+	if format == EventFormatSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(event *CloudEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if format == EventFormatSSE {
+			_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		}
+		return err
+	}
+
+	for _, event := range replay {
+		if err := write(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if err := write(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			// SSE comments are ignored by clients, as are empty lines by NDJSON parsers
+			keepAliveLine := "\n"
+			if format == EventFormatSSE {
+				keepAliveLine = ": keep-alive\n\n"
+			}
+			if _, err := io.WriteString(w, keepAliveLine); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
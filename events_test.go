@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// serveEvents calls the handler until the events have been published, and returns its response
+func serveEvents(t *testing.T, stream *EventStream, req *http.Request, publish func()) *httptest.ResponseRecorder {
+	ctx, cancel := context.WithCancel(req.Context())
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		NewEventStreamHandler(stream).ServeHTTP(rr, req.WithContext(ctx))
+		close(done)
+	}()
+
+	for deadline := time.Now().Add(time.Second); stream.subscriberCount() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("The handler did not subscribe to the stream")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	publish()
+	// The subscriber buffer is drained by the handler before it is cancelled
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	return rr
+}
+
+func TestEventStreamHandler_NDJSON(t *testing.T) {
+	stream := NewEventStream("/azure-health-exporter")
+	stream.now = func() time.Time { return time.Unix(1500000060, 0).UTC() }
+
+	rr := serveEvents(t, stream, httptest.NewRequest("GET", EventsPath, nil), func() {
+		stream.Notify([]StateTransition{webhookTransition("web1", "dev")})
+		stream.NotifyServiceHealthEvents([]ServiceHealthEventUpdate{{ResourceID: "my_id", EventID: "ABC-123", Status: "Active"}})
+	})
+
+	if rr.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("Unexpected content type: %v", rr.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Unexpected events: %v", rr.Body.String())
+	}
+
+	var event struct {
+		CloudEvent
+		Data WebhookEvent `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatalf("Error decoding %v: %v", lines[0], err)
+	}
+	if event.SpecVersion != "1.0" || event.ID == "" || event.Source != "/azure-health-exporter" || event.Type != EventTypeAvailabilityChanged ||
+		event.Subject != event.Data.ResourceID || event.DataContentType != "application/json" || !event.Time.Equal(time.Unix(1500000060, 0)) {
+		t.Errorf("Unexpected event: %+v", event.CloudEvent)
+	}
+	if event.Data.ResourceName != "web1" || event.Data.PreviousState != "Available" || event.Data.State != "Unavailable" {
+		t.Errorf("Unexpected event data: %+v", event.Data)
+	}
+	if !strings.Contains(lines[1], `"type":"`+EventTypeServiceHealthUpdated+`"`) || !strings.Contains(lines[1], `"event_id":"ABC-123"`) {
+		t.Errorf("Unexpected service health event: %v", lines[1])
+	}
+}
+
+func TestEventStreamHandler_SSE(t *testing.T) {
+	stream := NewEventStream("/azure-health-exporter")
+	stream.Notify([]StateTransition{webhookTransition("web1", "dev")})
+	events, _, cancel := stream.Subscribe("")
+	cancel()
+	stream.Notify([]StateTransition{webhookTransition("web2", "dev")})
+
+	// A resuming client first receives the events it missed
+	req := httptest.NewRequest("GET", EventsPath, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", stream.recent[0].ID)
+	rr := serveEvents(t, stream, req, func() {
+		stream.Notify([]StateTransition{webhookTransition("web3", "dev")})
+	})
+
+	if rr.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected content type: %v", rr.Header().Get("Content-Type"))
+	}
+	messages := strings.Split(strings.TrimSpace(rr.Body.String()), "\n\n")
+	if len(messages) != 2 || !strings.Contains(messages[0], `"resource_name":"web2"`) || !strings.Contains(messages[1], `"resource_name":"web3"`) {
+		t.Fatalf("Unexpected events: %v", rr.Body.String())
+	}
+	if !strings.HasPrefix(messages[0], "id: "+stream.recent[1].ID+"\nevent: "+EventTypeAvailabilityChanged+"\ndata: {") {
+		t.Errorf("Unexpected server-sent event: %v", messages[0])
+	}
+	if len(events) != 0 {
+		t.Errorf("Unexpected events received after unsubscribing: %v", len(events))
+	}
+
+	rr = httptest.NewRecorder()
+	NewEventStreamHandler(stream).ServeHTTP(rr, httptest.NewRequest("GET", EventsPath+"?format=xml", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Wrong status code with an unknown format: got %v, want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestEventStream_Dropped(t *testing.T) {
+	stream := NewEventStream("/azure-health-exporter")
+	_, _, cancel := stream.Subscribe("")
+	defer cancel()
+
+	for i := 0; i < eventSubscriberBuffer+5; i++ {
+		stream.Notify([]StateTransition{webhookTransition("web1", "dev")})
+	}
+	if got := testutil.ToFloat64(stream.dropped); got != 5 {
+		t.Errorf("Unexpected number of dropped events: %v", got)
+	}
+	if len(stream.recent) != eventSubscriberBuffer+5 {
+		t.Errorf("Unexpected number of recent events: %v", len(stream.recent))
+	}
+}
+
+func TestWriteEvents(t *testing.T) {
+	stream := NewEventStream("/azure-health-exporter")
+	var output bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		WriteEvents(ctx, stream, &output)
+		close(done)
+	}()
+
+	for stream.subscriberCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	stream.Notify([]StateTransition{webhookTransition("web1", "dev"), webhookTransition("web2", "dev")})
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"specversion":"1.0"`) || !strings.Contains(lines[1], `"resource_name":"web2"`) {
+		t.Errorf("Unexpected output: %v", output.String())
+	}
+}
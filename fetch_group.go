@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Sources of a snapshot returned by fetchGroup.Do
+const (
+	FetchSourceNew      = "new"
+	FetchSourceInflight = "inflight"
+	FetchSourceCache    = "cache"
+	// FetchSourceRestored is the source of a snapshot restored from disk, served until the first fetch completes
+	FetchSourceRestored = "restored"
+)
+
+// fetchGroup collapses concurrent fetches into a single one, and caches its result for a while
+// Fetches run on a context of their own, so that they are neither cancelled with the caller which started them,
+// nor bound by its deadline.
+type fetchGroup struct {
+	ttl      time.Duration
+	timeout  time.Duration
+	mutex    sync.Mutex
+	call     *fetchCall
+	cached   *Snapshot
+	cachedAt time.Time
+	now      func() time.Time
+}
+
+type fetchCall struct {
+	done     chan struct{}
+	snapshot *Snapshot
+}
+
+func newFetchGroup(ttl time.Duration) *fetchGroup {
+	return &fetchGroup{
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+// Do returns the cached snapshot if still fresh, waits for the in-flight fetch if any,
+// or else starts a fetch and waits for it. The returned source tells which one happened.
+// It returns a nil snapshot once ctx is done, the fetch going on for the following callers.
+// Snapshots of fetches which timed out are not cached.
+func (g *fetchGroup) Do(ctx context.Context, fetch func(context.Context) *Snapshot) (*Snapshot, string) {
+	g.mutex.Lock()
+	if g.cached != nil && g.now().Sub(g.cachedAt) < g.ttl {
+		snapshot := g.cached
+		g.mutex.Unlock()
+		return snapshot, FetchSourceCache
+	}
+	source := FetchSourceInflight
+	call := g.call
+	if call == nil {
+		source = FetchSourceNew
+		call = &fetchCall{done: make(chan struct{})}
+		g.call = call
+		go g.run(call, fetch)
+	}
+	g.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.snapshot, source
+	case <-ctx.Done():
+		return nil, source
+	}
+}
+
+// run fetches on a context bound by the fetch timeout only, and caches the snapshot unless the fetch ran out of time
+func (g *fetchGroup) run(call *fetchCall, fetch func(context.Context) *Snapshot) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if g.timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), g.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	call.snapshot = fetch(ctx)
+
+	g.mutex.Lock()
+	if !call.snapshot.TimedOut && ctx.Err() == nil {
+		g.cached = call.snapshot
+		g.cachedAt = g.now()
+	}
+	g.call = nil
+	g.mutex.Unlock()
+	close(call.done)
+}
+
+// replace replaces the cached snapshot, if any, with an update of it which is served until the cache expires
+func (g *fetchGroup) replace(snapshot *Snapshot) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.cached != nil {
+		g.cached = snapshot
+	}
+}
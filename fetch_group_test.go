@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchGroup_ConcurrentCallsShareFetch(t *testing.T) {
+	g := newFetchGroup(0)
+	release := make(chan struct{})
+	fetches := 0
+	fetch := func(ctx context.Context) *Snapshot {
+		fetches++
+		<-release
+		return &Snapshot{}
+	}
+
+	var wg sync.WaitGroup
+	sources := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, source := g.Do(context.Background(), fetch)
+			sources <- source
+		}()
+	}
+
+	// Let the callers join the in-flight fetch before releasing it
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(sources)
+
+	if fetches != 1 {
+		t.Errorf("Unexpected fetch count: got %v, want %v", fetches, 1)
+	}
+	count := make(map[string]int)
+	for source := range sources {
+		count[source]++
+	}
+	if count[FetchSourceNew] != 1 || count[FetchSourceInflight] != 2 {
+		t.Errorf("Unexpected sources: got %v", count)
+	}
+}
+
+func TestFetchGroup_Cache(t *testing.T) {
+	now := time.Now()
+	g := newFetchGroup(time.Minute)
+	g.now = func() time.Time { return now }
+	fetches := 0
+	fetch := func(ctx context.Context) *Snapshot {
+		fetches++
+		return &Snapshot{}
+	}
+
+	g.Do(context.Background(), fetch)
+	if _, source := g.Do(context.Background(), fetch); source != FetchSourceCache {
+		t.Errorf("Unexpected source: got %v, want %v", source, FetchSourceCache)
+	}
+
+	now = now.Add(time.Minute)
+	if _, source := g.Do(context.Background(), fetch); source != FetchSourceNew {
+		t.Errorf("Unexpected source: got %v, want %v", source, FetchSourceNew)
+	}
+	if fetches != 2 {
+		t.Errorf("Unexpected fetch count: got %v, want %v", fetches, 2)
+	}
+}
+
+func TestFetchGroup_TimedOutNotCached(t *testing.T) {
+	g := newFetchGroup(time.Minute)
+	fetch := func(ctx context.Context) *Snapshot {
+		return &Snapshot{TimedOut: true}
+	}
+
+	g.Do(context.Background(), fetch)
+	if _, source := g.Do(context.Background(), fetch); source != FetchSourceNew {
+		t.Errorf("Unexpected source: got %v, want %v", source, FetchSourceNew)
+	}
+}
+
+func TestFetchGroup_CallersHonourTheirContext(t *testing.T) {
+	g := newFetchGroup(time.Minute)
+	release := make(chan struct{})
+	var fetchErr error
+	fetch := func(ctx context.Context) *Snapshot {
+		<-release
+		fetchErr = ctx.Err()
+		return &Snapshot{}
+	}
+
+	// The caller starting the fetch gives up without cancelling it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if snapshot, source := g.Do(ctx, fetch); snapshot != nil || source != FetchSourceNew {
+		t.Errorf("Unexpected result once the context is done: %v %v", snapshot, source)
+	}
+
+	close(release)
+	if snapshot, source := g.Do(context.Background(), fetch); snapshot == nil || source != FetchSourceInflight {
+		t.Errorf("Unexpected result of the in-flight fetch: %v %v", snapshot, source)
+	}
+	if fetchErr != nil {
+		t.Errorf("The fetch was cancelled with its caller: %v", fetchErr)
+	}
+	if _, source := g.Do(context.Background(), fetch); source != FetchSourceCache {
+		t.Errorf("Unexpected source: got %v, want %v", source, FetchSourceCache)
+	}
+}
+
+func TestFetchGroup_Timeout(t *testing.T) {
+	g := newFetchGroup(time.Minute)
+	g.timeout = 10 * time.Millisecond
+	fetch := func(ctx context.Context) *Snapshot {
+		<-ctx.Done()
+		return &Snapshot{}
+	}
+
+	// Snapshots are not cached once the fetch context is done, whether or not they are flagged as timed out
+	g.Do(context.Background(), fetch)
+	if _, source := g.Do(context.Background(), fetch); source != FetchSourceNew {
+		t.Errorf("Unexpected source: got %v, want %v", source, FetchSourceNew)
+	}
+}
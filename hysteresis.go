@@ -0,0 +1,141 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultFlappingWindow is the window over which transitions are counted when not configured
+const DefaultFlappingWindow = time.Hour
+
+// HysteresisConfig delays the changes of the exported availability of the selected resources,
+// and marks the resources changing state too often as flapping
+type HysteresisConfig struct {
+	// MinPolls is the number of consecutive fetches a new state must be seen in before being exported
+	MinPolls int `yaml:"min_polls"`
+	// MinDuration is the time a new state must last before being exported
+	MinDuration time.Duration `yaml:"min_duration"`
+	// FlappingTransitions is the number of state transitions within FlappingWindow above which a resource is flapping, 0 to disable
+	FlappingTransitions int           `yaml:"flapping_transitions"`
+	FlappingWindow      time.Duration `yaml:"flapping_window"`
+}
+
+// init validates the hysteresis, and sets its defaults
+func (h *HysteresisConfig) init(index int) error {
+	if h.MinPolls < 0 || h.MinDuration < 0 || h.FlappingTransitions < 0 || h.FlappingWindow < 0 {
+		return errors.Errorf("hysteresis of resource configuration %d must not be negative", index)
+	}
+	if h.FlappingWindow == 0 {
+		h.FlappingWindow = DefaultFlappingWindow
+	}
+	return nil
+}
+
+// settled returns whether a new state seen for polls fetches during elapsed may be exported
+// Either condition is enough when both are configured.
+func (h *HysteresisConfig) settled(polls int, elapsed time.Duration) bool {
+	if h.MinPolls == 0 && h.MinDuration == 0 {
+		return true
+	}
+	return (h.MinPolls > 0 && polls >= h.MinPolls) || (h.MinDuration > 0 && elapsed >= h.MinDuration)
+}
+
+// resourceHysteresis returns the hysteresis of the first configuration of a resource defining one
+func resourceHysteresis(resource *MonitoredResource) *HysteresisConfig {
+	for i := range config.ResourceConfigurations {
+		resourceConfiguration := &config.ResourceConfigurations[i]
+		if resourceConfiguration.Hysteresis != nil && resourceConfiguration.Matches(&resource.Resource) {
+			return resourceConfiguration.Hysteresis
+		}
+	}
+	return nil
+}
+
+// debounce updates the exported state of a resource from its current state, and returns whether it changed
+// Without hysteresis, the exported state follows the current state.
+func (s *ResourceState) debounce(h *HysteresisConfig, now time.Time) bool {
+	if s.Exported == "" {
+		s.Exported = s.State
+		return false
+	}
+	if s.State == s.Exported {
+		s.Candidate = ""
+		s.CandidatePolls = 0
+		return false
+	}
+
+	if s.Candidate != s.State {
+		s.Candidate = s.State
+		s.CandidatePolls = 0
+	}
+	s.CandidatePolls++
+	if h != nil && !h.settled(s.CandidatePolls, now.Sub(s.Since)) {
+		return false
+	}
+
+	s.Exported = s.State
+	s.Candidate = ""
+	s.CandidatePolls = 0
+	return true
+}
+
+// transitionsSince returns the number of state transitions of the resource after start
+func (s *ResourceState) transitionsSince(start time.Time) int {
+	count := 0
+	for i := 1; i < len(s.History); i++ {
+		if s.History[i].Start.After(start) {
+			count++
+		}
+	}
+	return count
+}
+
+// ExportedState returns the availability state of a resource once settled according to its hysteresis,
+// along with whether it is flapping. It returns false if the resource is not tracked.
+func (t *StateTracker) ExportedState(resource *MonitoredResource) (string, bool, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	state, ok := t.states[normalizeResourceID(*resource.Resource.ID)]
+	if !ok || state.Exported == "" {
+		return "", false, false
+	}
+	flapping := false
+	if h := resourceHysteresis(resource); h != nil && h.FlappingTransitions > 0 {
+		flapping = state.transitionsSince(t.now().Add(-h.FlappingWindow)) > h.FlappingTransitions
+	}
+	return state.Exported, flapping, true
+}
+
+// SettledState returns the availability state of a resource, as exported: once settled for resources with hysteresis
+func (t *StateTracker) SettledState(resource *MonitoredResource) string {
+	if resourceHysteresis(resource) != nil {
+		if exported, _, ok := t.ExportedState(resource); ok {
+			return exported
+		}
+	}
+	return availabilityState(&resource.AvailabilityStatus)
+}
+
+// collectHysteresis exports the raw availability of a resource with hysteresis, along with whether it is flapping
+func collectHysteresis(ch chan<- prometheus.Metric, resource *MonitoredResource, h *HysteresisConfig, rawUp float64, flapping bool) {
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("azure_resource_health_raw_availability_up", "Resource health availability as last fetched, before hysteresis", nil, copyLabels(resource.Labels)),
+		prometheus.GaugeValue,
+		rawUp,
+	)
+
+	if h.FlappingTransitions > 0 {
+		value := 0.0
+		if flapping {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("azure_resource_health_flapping", "Whether the resource changed availability state more often than allowed over the flapping window", nil, copyLabels(resource.Labels)),
+			prometheus.GaugeValue,
+			value,
+		)
+	}
+}
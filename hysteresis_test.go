@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/stretchr/testify/mock"
+)
+
+const hysteresisConfig = `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+    hysteresis:
+      min_polls: 2
+      min_duration: 10m
+      flapping_transitions: 1
+`
+
+func hysteresisSnapshot(state resourcehealth.AvailabilityStateValues) *Snapshot {
+	snapshot := trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: state})
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	snapshot.Subscriptions[0].Resources[0].Resource.Type = &resourceType
+	snapshot.Subscriptions[0].Resources[0].Resource.Tags = map[string]*string{"Monitoring": &monitoring}
+	return snapshot
+}
+
+func TestHysteresisConfig_Settled(t *testing.T) {
+	tests := []struct {
+		hysteresis HysteresisConfig
+		polls      int
+		elapsed    time.Duration
+		want       bool
+	}{
+		{HysteresisConfig{}, 1, 0, true},
+		{HysteresisConfig{MinPolls: 3}, 2, time.Hour, false},
+		{HysteresisConfig{MinPolls: 3}, 3, 0, true},
+		{HysteresisConfig{MinDuration: 5 * time.Minute}, 10, 4 * time.Minute, false},
+		{HysteresisConfig{MinDuration: 5 * time.Minute}, 1, 5 * time.Minute, true},
+		{HysteresisConfig{MinPolls: 3, MinDuration: 5 * time.Minute}, 1, 5 * time.Minute, true},
+	}
+
+	for _, test := range tests {
+		if got := test.hysteresis.settled(test.polls, test.elapsed); got != test.want {
+			t.Errorf("Unexpected settled %+v after %d polls and %v: got %v, want %v", test.hysteresis, test.polls, test.elapsed, got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigContent_Hysteresis(t *testing.T) {
+	got, err := loadConfigContent([]byte(hysteresisConfig))
+	if err != nil {
+		t.Fatalf("Error on loading config %v", err)
+	}
+	if got.ResourceConfigurations[0].Hysteresis.FlappingWindow != DefaultFlappingWindow {
+		t.Errorf("Unexpected default flapping window: %v", got.ResourceConfigurations[0].Hysteresis.FlappingWindow)
+	}
+	if got.HistoryRetention() != DefaultFlappingWindow {
+		t.Errorf("Unexpected history retention: %v", got.HistoryRetention())
+	}
+
+	if _, err := loadConfigContent([]byte("resource_configurations:\n  - hysteresis:\n      min_polls: -1\n")); err == nil {
+		t.Errorf("Should have an error loading a negative hysteresis")
+	}
+}
+
+func TestStateTracker_Update_Hysteresis(t *testing.T) {
+	loadConfigContent([]byte(hysteresisConfig))
+	now := time.Unix(1500000000, 0)
+	tracker := NewStateTracker()
+	tracker.now = func() time.Time { return now }
+
+	tests := []struct {
+		state    resourcehealth.AvailabilityStateValues
+		exported string
+		changed  bool
+	}{
+		{resourcehealth.Available, "Available", false},
+		// A single poll in another state is ignored
+		{resourcehealth.Unknown, "Available", false},
+		{resourcehealth.Available, "Available", false},
+		{resourcehealth.Unavailable, "Available", false},
+		{resourcehealth.Unavailable, "Unavailable", true},
+	}
+
+	for i, test := range tests {
+		transitions := tracker.Update(hysteresisSnapshot(test.state))
+		state := tracker.states[normalizeResourceID(trackedResourceID)]
+		if state.Exported != test.exported || (len(transitions) == 1) != test.changed {
+			t.Errorf("Unexpected update %d: exported %v and transitions %v", i, state.Exported, transitions)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	// The raw transitions are still tracked
+	state := tracker.states[normalizeResourceID(trackedResourceID)]
+	if state.Transitions["Available"]["Unknown"] != 1 || state.Transitions["Available"]["Unavailable"] != 1 {
+		t.Errorf("Unexpected transitions count: %v", state.Transitions)
+	}
+}
+
+func TestStateTracker_Update_HysteresisDuration(t *testing.T) {
+	loadConfigContent([]byte(strings.Replace(hysteresisConfig, "min_polls: 2", "min_polls: 5", 1)))
+	now := time.Unix(1500000000, 0)
+	tracker := NewStateTracker()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Update(hysteresisSnapshot(resourcehealth.Available))
+	now = now.Add(time.Minute)
+	unavailableAt := now
+	if transitions := tracker.Update(hysteresisSnapshot(resourcehealth.Unavailable)); len(transitions) != 0 {
+		t.Errorf("Unexpected transitions: %v", transitions)
+	}
+
+	// The state lasted longer than min_duration, although it was seen by 2 polls only
+	now = now.Add(11 * time.Minute)
+	transitions := tracker.Update(hysteresisSnapshot(resourcehealth.Unavailable))
+	if len(transitions) != 1 || transitions[0].To != "Unavailable" || !transitions[0].Time.Equal(unavailableAt) {
+		t.Errorf("Unexpected transitions: %v", transitions)
+	}
+}
+
+func TestCollect_Hysteresis(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	resourceID := trackedResourceID
+	asID := resourceID + AvailabilityStatusIDSuffix
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	for _, state := range []resourcehealth.AvailabilityStateValues{resourcehealth.Available, resourcehealth.Unavailable, resourcehealth.Available} {
+		rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+			{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: state}},
+		}, nil).Once()
+	}
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	labels := `{resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"}`
+	for i, want := range [][]string{
+		{"azure_resource_health_availability_up" + labels + " 1", "azure_resource_health_raw_availability_up" + labels + " 1", "azure_resource_health_flapping" + labels + " 0"},
+		{"azure_resource_health_availability_up" + labels + " 1", "azure_resource_health_raw_availability_up" + labels + " 0", "azure_resource_health_flapping" + labels + " 0"},
+		{"azure_resource_health_availability_up" + labels + " 1", "azure_resource_health_raw_availability_up" + labels + " 1", "azure_resource_health_flapping" + labels + " 1"},
+	} {
+		rr := CallExporterWithConfig(collector, hysteresisConfig)
+		for _, line := range want {
+			if !strings.Contains(rr.Body.String(), line) {
+				t.Errorf("Missing %v in body %d %v", line, i, rr.Body.String())
+			}
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -15,33 +20,169 @@ import (
 )
 
 var (
-	configFile     = kingpin.Flag("config.file", "Exporter configuration file.").Default("config/config.yml").String()
-	listenAddress  = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9613").String()
-	metricsPath    = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-	config         Config
-	azureErrorDesc = prometheus.NewDesc("azure_error", "Error collecting metrics", nil, nil)
+	configFile    = kingpin.Flag("config.file", "Exporter configuration file.").Default("config/config.yml").String()
+	listenAddress = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9613").String()
+	metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+	timeoutOffset = kingpin.Flag("web.scrape-timeout-offset", "Offset to subtract from the Prometheus scrape timeout to get how long a scrape waits for the Azure fetch.").Default("500ms").Duration()
+	config        Config
+
+	serveCommand    = kingpin.Command("serve", "Serve the metrics of the Azure resources health.").Default()
+	backfillCommand = kingpin.Command("backfill", "Write the availability history of the configured resources in the OpenMetrics format, to be imported with promtool tsdb create-blocks-from openmetrics.")
+	backfillOutput  = backfillCommand.Flag("output", "File to write the history to, - for the standard output.").Default("-").String()
+	backfillRange   = backfillCommand.Flag("range", "Time range of the history, Resource Health keeping about 30 days of it.").Default("720h").Duration()
+	backfillStep    = backfillCommand.Flag("step", "Interval between two samples of a resource.").Default("1m").Duration()
+	backfillRate    = backfillCommand.Flag("max-requests-per-second", "Maximum number of Azure API requests sent per second for a subscription, 0 for no limit.").Default("1").Float64()
+	reportCommand   = kingpin.Command("report", "Write the availability report of the configured resources over a date range, from their Resource Health history.")
+	reportFrom      = reportCommand.Flag("from", "First day of the report (YYYY-MM-DD), the first day of the previous month by default.").String()
+	reportTo        = reportCommand.Flag("to", "Day following the last day of the report (YYYY-MM-DD), the first day of the current month by default.").String()
+	reportTags      = reportCommand.Flag("tag", "Tag value the reported resources must have (NAME=VALUE), can be repeated.").StringMap()
+	reportFormat    = reportCommand.Flag("format", "Format of the report.").Default(ReportFormatHTML).Enum(ReportFormatCSV, ReportFormatJSON, ReportFormatHTML)
+	reportOutput    = reportCommand.Flag("output", "File to write the report to, - for the standard output.").Default("-").String()
+	reportRate      = reportCommand.Flag("max-requests-per-second", "Maximum number of Azure API requests sent per second for a subscription, 0 for no limit.").Default("1").Float64()
+
+	retryMaxAttempts        = kingpin.Flag("azure.retry.max-attempts", "Maximum number of attempts of an Azure API request.").Default("3").Int()
+	retryMinBackoff         = kingpin.Flag("azure.retry.min-backoff", "Delay before retrying a failed Azure API request, doubled on each retry.").Default("1s").Duration()
+	retryMaxBackoff         = kingpin.Flag("azure.retry.max-backoff", "Maximum delay between two attempts of an Azure API request.").Default("30s").Duration()
+	requestTimeout          = kingpin.Flag("azure.request-timeout", "Timeout of a single Azure API request attempt.").Default("30s").Duration()
+	breakerThreshold        = kingpin.Flag("azure.circuit-breaker.failure-threshold", "Number of consecutive failed Azure API requests opening the circuit breaker of a subscription, 0 to disable.").Default("5").Int()
+	breakerOpenTimeout      = kingpin.Flag("azure.circuit-breaker.open-duration", "Time the circuit breaker stays open before letting a probe request through.").Default("1m").Duration()
+	fetchWorkers            = kingpin.Flag("azure.workers", "Number of subscriptions fetched from Azure in parallel.").Default("4").Int()
+	maxSubscriptionRequests = kingpin.Flag("azure.max-concurrent-requests-per-subscription", "Maximum number of Azure API requests sent at a time for a subscription, 0 for no limit.").Default("2").Int()
+	storagePath             = kingpin.Flag("storage.path", "Directory in which the exporter state is saved after each fetch and restored from on startup, empty to disable.").Default("").String()
+	azureMonitorTokenFile   = kingpin.Flag("web.azure-monitor-webhook.token-file", "File holding the token of the Azure Monitor action groups webhook, empty to disable the webhook.").Default("").String()
+	maintenanceTokenFile    = kingpin.Flag("web.maintenance-api.token-file", "File holding the bearer token of the maintenance windows API, empty to disable the API.").Default("").String()
+	eventsSource            = kingpin.Flag("events.source", "Source of the CloudEvents emitted by the exporter.").Default("/azure-health-exporter").String()
+	eventsOutput            = kingpin.Flag("events.output", "File the CloudEvents are appended to as NDJSON, - for the standard output, empty to disable.").Default("").String()
+	fetchCacheTTL           = kingpin.Flag("azure.fetch-cache-ttl", "Duration during which the result of an Azure fetch is reused by following scrapes, 0 to disable.").Default("5s").Duration()
+	fetchTimeout            = kingpin.Flag("azure.fetch-timeout", "Timeout of an Azure fetch, which goes on in the background once the scrapes waiting for it time out, 0 for no timeout.").Default("2m").Duration()
 )
 
 // Config of the exporter
 type Config struct {
-	ResourceConfigurations []ResourceConfiguration `yaml:"resource_configurations"`
-	ExposeAzureTagInfo     bool                    `yaml:"expose_azure_tag_info"`
+	ResourceConfigurations   []ResourceConfiguration `yaml:"resource_configurations"`
+	ExposeAzureTagInfo       bool                    `yaml:"expose_azure_tag_info"`
+	ExposeRecommendedActions bool                    `yaml:"expose_recommended_actions"`
+	ListAllResources         bool                    `yaml:"list_all_resources"`
+	Services                 []ServiceConfig         `yaml:"services"`
+	RollupTags               []string                `yaml:"rollup_tags"`
+	Dependencies             DependenciesConfig      `yaml:"dependencies"`
+	Maintenance              MaintenanceConfig       `yaml:"maintenance"`
+	Webhooks                 []WebhookConfig         `yaml:"webhooks"`
+	Alertmanager             *AlertmanagerConfig     `yaml:"alertmanager"`
 }
 
 // ResourceConfiguration specify resources to monitor (by types and tags)
 type ResourceConfiguration struct {
 	ResourceTags  map[string]string `yaml:"resource_tags"`
 	ResourceTypes []string          `yaml:"resource_types"`
+	Labels        map[string]string `yaml:"labels"`
+	SLO           *SLOConfig        `yaml:"slo"`
+	Hysteresis    *HysteresisConfig `yaml:"hysteresis"`
+	// ChildResources enables fetching the availability of the children of the selected resources, one request per resource
+	ChildResources bool `yaml:"child_resources"`
+}
+
+// builtinResourceLabels are the labels set by the exporter on the metrics and alerts of a resource,
+// along with its tag_* and dependency_* labels
+var builtinResourceLabels = map[string]bool{
+	"subscription_id":   true,
+	"resource_group":    true,
+	"resource_name":     true,
+	"sub_resource_name": true,
+	"resource_type":     true,
+	// State tracking
+	"state": true,
+	"from":  true,
+	"to":    true,
+	// Maintenance, child resources, SLOs and recommended actions
+	"in_maintenance": true,
+	"child":          true,
+	"slo":            true,
+	"action":         true,
+	"action_id":      true,
+	// Alertmanager alerts
+	"alertname":     true,
+	"event_id":      true,
+	"service":       true,
+	"region":        true,
+	"incident_type": true,
+}
+
+// init validates the configuration labels, which must be valid label names once sanitized,
+// and must not be reserved or collide with the labels set by the exporter
+func (rc *ResourceConfiguration) init(index int) error {
+	for name := range rc.Labels {
+		labelName := invalidLabelChars.ReplaceAllString(name, "_")
+		if !model.LabelName(labelName).IsValid() || strings.HasPrefix(labelName, model.ReservedLabelPrefix) {
+			return errors.Errorf("label %s of resource configuration %d is not a valid label name", name, index)
+		}
+		if builtinResourceLabels[labelName] || strings.HasPrefix(labelName, "tag_") || strings.HasPrefix(labelName, "dependency_") {
+			return errors.Errorf("label %s of resource configuration %d collides with a label of the exporter", name, index)
+		}
+	}
+	return nil
+}
+
+// ResourceTypes returns the resource types of all configurations, without duplicates
+func (c *Config) ResourceTypes() []string {
+	var types []string
+	seen := make(map[string]bool)
+	for _, resourceConfiguration := range c.ResourceConfigurations {
+		for _, resourceType := range resourceConfiguration.ResourceTypes {
+			if !seen[strings.ToLower(resourceType)] {
+				seen[strings.ToLower(resourceType)] = true
+				types = append(types, resourceType)
+			}
+		}
+	}
+	return types
+}
+
+// ListedResourceTypes returns the resource types to list from Azure, nil to list all resources
+func (c *Config) ListedResourceTypes() []string {
+	if c.ListAllResources {
+		return nil
+	}
+	return c.ResourceTypes()
+}
+
+// MaxSLOWindow returns the longest window of the configured SLOs, 0 if none
+func (c *Config) MaxSLOWindow() time.Duration {
+	var window time.Duration
+	for _, resourceConfiguration := range c.ResourceConfigurations {
+		if slo := resourceConfiguration.SLO; slo != nil {
+			if slo.Window > window {
+				window = slo.Window
+			}
+			if slo.BurnRateWindow > window {
+				window = slo.BurnRateWindow
+			}
+		}
+	}
+	return window
+}
+
+// HistoryRetention returns the time the state history of resources is kept for,
+// the longest window of the configured SLOs and flapping detections
+func (c *Config) HistoryRetention() time.Duration {
+	retention := c.MaxSLOWindow()
+	for _, resourceConfiguration := range c.ResourceConfigurations {
+		if hysteresis := resourceConfiguration.Hysteresis; hysteresis != nil && hysteresis.FlappingTransitions > 0 && hysteresis.FlappingWindow > retention {
+			retention = hysteresis.FlappingWindow
+		}
+	}
+	return retention
 }
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("azure_health_exporter"))
+	prometheus.MustRegister(inflightRequests)
 }
 
 func main() {
 	kingpin.Version(version.Print("azure-health-exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	log.Info("Starting exporter", version.Info())
 	log.Info("Build context", version.BuildContext())
@@ -51,21 +192,122 @@ func main() {
 		log.Fatalf("Error loading config file: %v", err)
 	}
 
-	session, err := NewAzureSession(os.Getenv("AZURE_SUBSCRIPTION_ID"))
-	if err != nil {
-		log.Fatalf("Error creating Azure session: %v", err)
+	options := SessionOptions{
+		Retry: RetryOptions{
+			MaxAttempts:    *retryMaxAttempts,
+			MinBackoff:     *retryMinBackoff,
+			MaxBackoff:     *retryMaxBackoff,
+			RequestTimeout: *requestTimeout,
+		},
+		CircuitBreaker: CircuitBreakerOptions{
+			FailureThreshold: *breakerThreshold,
+			OpenDuration:     *breakerOpenTimeout,
+		},
+		MaxConcurrentRequests: *maxSubscriptionRequests,
 	}
 
-	resourceHealthCollector := NewResourceHealthCollector(session)
-	prometheus.MustRegister(resourceHealthCollector)
+	switch command {
+	case backfillCommand.FullCommand():
+		options.MaxRequestsPerSecond = *backfillRate
+		runBackfill(createSessions(options))
+	case reportCommand.FullCommand():
+		options.MaxRequestsPerSecond = *reportRate
+		runReport(createSessions(options))
+	default:
+		serve(createSessions(options))
+	}
+}
 
-	http.Handle(*metricsPath, promhttp.Handler())
+// createSessions returns a session per subscription of the AZURE_SUBSCRIPTION_ID environment variable
+func createSessions(options SessionOptions) []*AzureSession {
+	var sessions []*AzureSession
+	for _, subscriptionID := range parseSubscriptionIDs(os.Getenv("AZURE_SUBSCRIPTION_ID")) {
+		session, err := NewAzureSession(subscriptionID)
+		if err != nil {
+			log.Fatalf("Error creating Azure session: %v", err)
+		}
+		sessions = append(sessions, session.WithOptions(options))
+	}
+	if len(sessions) == 0 {
+		log.Fatal("Error creating Azure session: no subscription ID provided")
+	}
+	return sessions
+}
+
+// serve exposes the metrics of the subscriptions
+func serve(sessions []*AzureSession) {
+	resourceHealthCollector := NewResourceHealthCollector(sessions...).
+		WithCacheTTL(*fetchCacheTTL).
+		WithFetchTimeout(*fetchTimeout).
+		WithWorkers(*fetchWorkers)
+	if len(config.Webhooks) > 0 {
+		webhookNotifier := NewWebhookNotifier(config.Webhooks)
+		prometheus.MustRegister(webhookNotifier)
+		resourceHealthCollector.WithNotifier(webhookNotifier)
+	}
+	eventStream := NewEventStream(*eventsSource)
+	prometheus.MustRegister(eventStream)
+	resourceHealthCollector.WithNotifier(eventStream)
+	if *eventsOutput != "" {
+		output := os.Stdout
+		if *eventsOutput != "-" {
+			file, err := os.OpenFile(*eventsOutput, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				log.Fatalf("Error opening events output: %v", err)
+			}
+			defer file.Close()
+			output = file
+		}
+		go WriteEvents(context.Background(), eventStream, output)
+	}
+	if config.Alertmanager != nil {
+		alertmanagerNotifier := NewAlertmanagerNotifier(resourceHealthCollector, config.Alertmanager)
+		prometheus.MustRegister(alertmanagerNotifier)
+		resourceHealthCollector.WithNotifier(alertmanagerNotifier)
+		go alertmanagerNotifier.Run(context.Background())
+	}
+	if *storagePath != "" {
+		resourceHealthCollector.WithStore(NewStore(*storagePath))
+		restored, err := resourceHealthCollector.Restore()
+		if err != nil {
+			log.Errorf("Error restoring state, waiting for the first fetch: %v", err)
+		}
+		if restored {
+			log.Info("State restored, serving it to the scrapes running out of time until a fetch completes")
+			go resourceHealthCollector.Refresh(context.Background())
+		}
+	}
+
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		NewMetricsHandler(resourceHealthCollector, prometheus.DefaultGatherer, *timeoutOffset),
+	))
+	http.Handle(RecommendedActionsPath, NewRecommendedActionsHandler(resourceHealthCollector))
+	http.Handle(EventsPath, NewEventStreamHandler(eventStream))
+	if *maintenanceTokenFile != "" {
+		token, err := readTokenFile(*maintenanceTokenFile)
+		if err != nil {
+			log.Fatalf("Error reading maintenance API token file: %v", err)
+		}
+		maintenanceHandler := NewMaintenanceHandler(resourceHealthCollector.Maintenance(), token)
+		http.Handle(MaintenanceWindowsPath, maintenanceHandler)
+		http.Handle(MaintenanceWindowsPath+"/", maintenanceHandler)
+	}
+	if *azureMonitorTokenFile != "" {
+		token, err := readTokenFile(*azureMonitorTokenFile)
+		if err != nil {
+			log.Fatalf("Error reading Azure Monitor webhook token file: %v", err)
+		}
+		http.Handle(AzureMonitorWebhookPath, NewAzureMonitorHandler(resourceHealthCollector, token))
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>azure-health-exporter</title></head>
 			<body>
 			<h1>azure-health-exporter</h1>
 			<p><a href="` + *metricsPath + `">Metrics</a></p>
+			<p><a href="` + RecommendedActionsPath + `">Recommended actions</a></p>
+			<p><a href="` + EventsPath + `">Events</a></p>
 			</body>
 			</html>`))
 	})
@@ -74,6 +316,99 @@ func main() {
 	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
 
+// runBackfill writes the availability history of the subscriptions to the backfill output
+func runBackfill(sessions []*AzureSession) {
+	var subscriptions []subscriptionClients
+	for _, session := range sessions {
+		subscriptions = append(subscriptions, newSubscriptionClients(session))
+	}
+
+	output := os.Stdout
+	if *backfillOutput != "-" {
+		file, err := os.Create(*backfillOutput)
+		if err != nil {
+			log.Fatalf("Error creating backfill output: %v", err)
+		}
+		defer file.Close()
+		output = file
+	}
+
+	end := time.Now()
+	err := Backfill(context.Background(), output, subscriptions, BackfillOptions{
+		Start: end.Add(-*backfillRange),
+		End:   end,
+		Step:  *backfillStep,
+	})
+	if err != nil {
+		log.Errorf("Error backfilling availability history: %v", err)
+		output.Close()
+		os.Exit(1)
+	}
+	log.Info("Availability history written")
+}
+
+// runReport writes the availability report of the subscriptions to the report output
+func runReport(sessions []*AzureSession) {
+	from, to, err := parseReportRange(*reportFrom, *reportTo, time.Now())
+	if err != nil {
+		log.Fatalf("Error parsing report date range: %v", err)
+	}
+
+	var subscriptions []subscriptionClients
+	for _, session := range sessions {
+		subscriptions = append(subscriptions, newSubscriptionClients(session))
+	}
+
+	report, reportErr := NewReport(context.Background(), subscriptions, ReportOptions{
+		From: from,
+		To:   to,
+		Tags: *reportTags,
+	})
+
+	output := os.Stdout
+	if *reportOutput != "-" {
+		file, err := os.Create(*reportOutput)
+		if err != nil {
+			log.Fatalf("Error creating report output: %v", err)
+		}
+		defer file.Close()
+		output = file
+	}
+	if err := report.Write(output, *reportFormat); err != nil {
+		log.Fatalf("Error writing report: %v", err)
+	}
+	if reportErr != nil {
+		log.Errorf("Error building report, some resources are missing: %v", reportErr)
+		output.Close()
+		os.Exit(1)
+	}
+	log.Info("Availability report written")
+}
+
+// parseReportRange returns the report date range, the previous month of now by default
+func parseReportRange(from string, to string, now time.Time) (time.Time, time.Time, error) {
+	now = now.UTC()
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	start := currentMonth.AddDate(0, -1, 0)
+	end := currentMonth
+
+	var err error
+	if from != "" {
+		if start, err = time.Parse("2006-01-02", from); err != nil {
+			return start, end, err
+		}
+	}
+	if to != "" {
+		if end, err = time.Parse("2006-01-02", to); err != nil {
+			return start, end, err
+		}
+	}
+	if !end.After(start) {
+		return start, end, errors.Errorf("report end %s must be after its start %s", end.Format("2006-01-02"), start.Format("2006-01-02"))
+	}
+	return start, end, nil
+}
+
 func loadConfig(configFile string) (Config, error) {
 	if fileExists(configFile) {
 		log.Infof("Loading config file %v", configFile)
@@ -101,10 +436,78 @@ func loadConfigContent(configData []byte) (Config, error) {
 		return config, err
 	}
 
+	for i, resourceConfiguration := range config.ResourceConfigurations {
+		if err := config.ResourceConfigurations[i].init(i); err != nil {
+			return config, err
+		}
+		if resourceConfiguration.SLO != nil {
+			if err := resourceConfiguration.SLO.init(i); err != nil {
+				return config, err
+			}
+		}
+		if resourceConfiguration.Hysteresis != nil {
+			if err := resourceConfiguration.Hysteresis.init(i); err != nil {
+				return config, err
+			}
+		}
+	}
+	if err := checkSLONames(config.ResourceConfigurations); err != nil {
+		return config, err
+	}
+	for i := range config.Services {
+		if err := config.Services[i].init(); err != nil {
+			return config, err
+		}
+	}
+	if err := checkServiceNames(config.Services); err != nil {
+		return config, err
+	}
+	if err := config.Dependencies.init(); err != nil {
+		return config, err
+	}
+	if err := config.Maintenance.init(); err != nil {
+		return config, err
+	}
+	for i := range config.Webhooks {
+		if err := config.Webhooks[i].init(); err != nil {
+			return config, err
+		}
+	}
+	if config.Alertmanager != nil {
+		if err := config.Alertmanager.init(); err != nil {
+			return config, err
+		}
+	}
+
 	log.Info("Config loaded")
 	return config, nil
 }
 
+// readTokenFile returns the token held in a file
+func readTokenFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", errors.New("empty token")
+	}
+	return token, nil
+}
+
+// parseSubscriptionIDs splits a comma separated list of subscription IDs
+func parseSubscriptionIDs(subscriptionIDs string) []string {
+	var ids []string
+	for _, id := range strings.Split(subscriptionIDs, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	if os.IsNotExist(err) {
@@ -3,6 +3,7 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig_No_Config(t *testing.T) {
@@ -65,3 +66,99 @@ resource_configurations:
 		t.Errorf("Error in getting config Got:%v, Expected config:%v", got, want)
 	}
 }
+
+func TestLoadConfigContent_Labels(t *testing.T) {
+	cases := []struct {
+		label string
+		valid bool
+	}{
+		{"team", true},
+		{"cost-center", true},
+		{"2team", false},
+		{"__name__", false},
+		{"__team", false},
+		{"resource_name", false},
+		{"subscription_id", false},
+		{"tag_env", false},
+		{"state", false},
+		{"from", false},
+		{"to", false},
+		{"in_maintenance", false},
+		{"child", false},
+		{"slo", false},
+		{"action", false},
+		{"action_id", false},
+		{"alertname", false},
+		{"service", false},
+		{"dependency_resource_name", false},
+		{"dependency_team", false},
+	}
+
+	for _, c := range cases {
+		configFile := `
+resource_configurations:
+  - resource_tags:
+      Client: "Alice"
+    resource_types:
+      - "Microsoft.Web/sites"
+    labels:
+      ` + c.label + `: "value"
+`
+		_, err := loadConfigContent([]byte(configFile))
+		if c.valid && err != nil {
+			t.Errorf("Error on loading config with label %s: %v", c.label, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("Should have an error with label %s", c.label)
+		}
+	}
+}
+
+func TestParseSubscriptionIDs(t *testing.T) {
+	want := []string{"subscription1", "subscription2"}
+	got := parseSubscriptionIDs(" subscription1,subscription2,")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected subscription IDs: got %v, want %v", got, want)
+	}
+}
+
+func TestConfig_ResourceTypes(t *testing.T) {
+	c := Config{
+		ResourceConfigurations: []ResourceConfiguration{
+			ResourceConfiguration{ResourceTypes: []string{"Microsoft.Web/sites", "Microsoft.Web/serverfarms"}},
+			ResourceConfiguration{ResourceTypes: []string{"microsoft.web/sites", "Microsoft.Compute/virtualMachines"}},
+		},
+	}
+
+	want := []string{"Microsoft.Web/sites", "Microsoft.Web/serverfarms", "Microsoft.Compute/virtualMachines"}
+	if got := c.ResourceTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected resource types: got %v, want %v", got, want)
+	}
+}
+
+func TestParseReportRange(t *testing.T) {
+	now := time.Date(2020, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	from, to, err := parseReportRange("", "", now)
+	if err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+	if !from.Equal(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected default range: %v - %v", from, to)
+	}
+
+	from, to, err = parseReportRange("2020-01-10", "2020-01-20", now)
+	if err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+	if !from.Equal(time.Date(2020, 1, 10, 0, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2020, 1, 20, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected range: %v - %v", from, to)
+	}
+
+	if _, _, err := parseReportRange("2020-01-20", "2020-01-10", now); err == nil {
+		t.Errorf("Should have an error with an end before the start")
+	}
+	if _, _, err := parseReportRange("January", "", now); err == nil {
+		t.Errorf("Should have an error with an invalid date")
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/log"
+)
+
+// Sources of maintenance windows
+const (
+	MaintenanceSourceConfig       = "config"
+	MaintenanceSourceAPI          = "api"
+	MaintenanceSourcePlannedEvent = "planned_event"
+)
+
+// MaintenanceWindowsPath is the path of the maintenance windows HTTP API
+const MaintenanceWindowsPath = "/api/v1/maintenance-windows"
+
+// MaintenanceConfig holds the maintenance windows of the configuration
+type MaintenanceConfig struct {
+	Windows []MaintenanceWindowConfig `yaml:"windows"`
+	// TreatAsAvailable exports the resources in maintenance as available
+	TreatAsAvailable bool `yaml:"treat_as_available"`
+	// PlannedEvents puts in maintenance the resources whose availability status reports a planned event
+	PlannedEvents bool `yaml:"planned_events"`
+}
+
+// ResourceSelector selects resources by IDs, and/or by types and tags
+// A resource of any type is selected by tags when no type is given.
+type ResourceSelector struct {
+	ResourceIDs   []string          `yaml:"resource_ids" json:"resource_ids,omitempty"`
+	ResourceTypes []string          `yaml:"resource_types" json:"resource_types,omitempty"`
+	ResourceTags  map[string]string `yaml:"resource_tags" json:"resource_tags,omitempty"`
+}
+
+// MaintenanceWindowConfig is a recurring maintenance window, starting on a cron schedule
+type MaintenanceWindowConfig struct {
+	Name     string        `yaml:"name"`
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	// Timezone of the schedule, UTC by default
+	Timezone         string `yaml:"timezone"`
+	ResourceSelector `yaml:",inline"`
+
+	schedule *cronSchedule
+	location *time.Location
+}
+
+// MaintenanceWindow is a maintenance window created through the API
+type MaintenanceWindow struct {
+	ID     string    `json:"id,omitempty"`
+	Name   string    `json:"name"`
+	Source string    `json:"source"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	ResourceSelector
+}
+
+// init validates the maintenance windows
+func (m *MaintenanceConfig) init() error {
+	for i := range m.Windows {
+		window := &m.Windows[i]
+		if window.Name == "" {
+			return errors.New("maintenance window name is mandatory")
+		}
+		if window.Duration <= 0 {
+			return errors.Errorf("maintenance window %s duration must be positive", window.Name)
+		}
+		if window.ResourceSelector.empty() {
+			return errors.Errorf("maintenance window %s must select resources", window.Name)
+		}
+		var err error
+		if window.schedule, err = parseCronSchedule(window.Schedule); err != nil {
+			return errors.Wrapf(err, "maintenance window %s", window.Name)
+		}
+		if window.location, err = time.LoadLocation(window.Timezone); err != nil {
+			return errors.Wrapf(err, "maintenance window %s", window.Name)
+		}
+	}
+	return nil
+}
+
+func (s *ResourceSelector) empty() bool {
+	return len(s.ResourceIDs) == 0 && len(s.ResourceTypes) == 0 && len(s.ResourceTags) == 0
+}
+
+// Selects returns whether a resource is selected
+func (s *ResourceSelector) Selects(resource *MonitoredResource) bool {
+	resourceType := ""
+	if resource.Resource.Type != nil {
+		resourceType = *resource.Resource.Type
+	}
+	return s.selects(*resource.Resource.ID, resourceType, resource.Resource.Tags)
+}
+
+// selects returns whether a resource is selected by its ID, type and tags
+func (s *ResourceSelector) selects(id string, resourceType string, tags map[string]*string) bool {
+	for _, resourceID := range s.ResourceIDs {
+		if strings.EqualFold(resourceID, id) {
+			return true
+		}
+	}
+	if len(s.ResourceTypes) == 0 && len(s.ResourceTags) == 0 {
+		return false
+	}
+
+	if len(s.ResourceTypes) > 0 {
+		typeMatch := false
+		for _, selectedType := range s.ResourceTypes {
+			if strings.EqualFold(selectedType, resourceType) {
+				typeMatch = true
+				break
+			}
+		}
+		if !typeMatch {
+			return false
+		}
+	}
+	for name, value := range s.ResourceTags {
+		if tagValue, ok := tags[name]; !ok || tagValue == nil || *tagValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Maintenance knows the maintenance windows, from the configuration, the API and the planned events
+type Maintenance struct {
+	mutex      sync.Mutex
+	windows    map[string]*MaintenanceWindow
+	apiEnabled bool
+	now        func() time.Time
+}
+
+// NewMaintenance returns the maintenance windows, without any created through the API
+func NewMaintenance() *Maintenance {
+	return &Maintenance{
+		windows: make(map[string]*MaintenanceWindow),
+		now:     time.Now,
+	}
+}
+
+// Enabled returns whether resources may be in maintenance, in which case their availability is flagged
+func (m *Maintenance) Enabled() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.apiEnabled || len(config.Maintenance.Windows) > 0 || config.Maintenance.PlannedEvents
+}
+
+// Add adds a window created through the API
+func (m *Maintenance) Add(window *MaintenanceWindow) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.windows[window.ID] = window
+}
+
+// Delete removes a window created through the API, and returns whether it existed
+func (m *Maintenance) Delete(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.windows[id]
+	delete(m.windows, id)
+	return ok
+}
+
+// Windows returns the windows created through the API which are not expired yet, by start
+func (m *Maintenance) Windows() []*MaintenanceWindow {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire()
+	windows := make([]*MaintenanceWindow, 0, len(m.windows))
+	for _, window := range m.windows {
+		copied := *window
+		windows = append(windows, &copied)
+	}
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start.Before(windows[j].Start) || (windows[i].Start.Equal(windows[j].Start) && windows[i].ID < windows[j].ID)
+	})
+	return windows
+}
+
+// Restore replaces the windows created through the API, e.g. with the ones saved before a restart
+func (m *Maintenance) Restore(windows []*MaintenanceWindow) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.windows = make(map[string]*MaintenanceWindow, len(windows))
+	for _, window := range windows {
+		m.windows[window.ID] = window
+	}
+	m.expire()
+}
+
+// expire forgets the windows which ended
+func (m *Maintenance) expire() {
+	now := m.now()
+	for id, window := range m.windows {
+		if !window.End.After(now) {
+			delete(m.windows, id)
+		}
+	}
+}
+
+// ActiveWindows returns the windows in progress, including the occurrences of the configured ones
+// Planned events are not included, as they are specific to a resource.
+func (m *Maintenance) ActiveWindows() []*MaintenanceWindow {
+	now := m.now()
+	var active []*MaintenanceWindow
+	for _, window := range m.Windows() {
+		if !window.Start.After(now) {
+			active = append(active, window)
+		}
+	}
+	for i := range config.Maintenance.Windows {
+		windowConfig := &config.Maintenance.Windows[i]
+		if windowConfig.schedule == nil {
+			continue
+		}
+		if start, ok := windowConfig.schedule.lastStart(now.In(windowConfig.location), windowConfig.Duration); ok {
+			active = append(active, &MaintenanceWindow{
+				Name:             windowConfig.Name,
+				Source:           MaintenanceSourceConfig,
+				Start:            start,
+				End:              start.Add(windowConfig.Duration),
+				ResourceSelector: windowConfig.ResourceSelector,
+			})
+		}
+	}
+	return active
+}
+
+// InMaintenance returns the active window a resource is in, nil if none
+func InMaintenance(resource *MonitoredResource, active []*MaintenanceWindow) *MaintenanceWindow {
+	for _, window := range active {
+		if window.Selects(resource) {
+			return window
+		}
+	}
+	if config.Maintenance.PlannedEvents && isPlannedEvent(&resource.AvailabilityStatus) {
+		return &MaintenanceWindow{Name: MaintenanceSourcePlannedEvent, Source: MaintenanceSourcePlannedEvent}
+	}
+	return nil
+}
+
+// isPlannedEvent returns whether an availability status is caused by a planned maintenance
+func isPlannedEvent(as *resourcehealth.AvailabilityStatus) bool {
+	properties := as.Properties
+	if properties == nil || properties.AvailabilityState == resourcehealth.Available {
+		return false
+	}
+	if properties.HealthEventCategory != nil && strings.EqualFold(*properties.HealthEventCategory, "Planned") {
+		return true
+	}
+	return properties.ReasonType != nil && strings.Contains(strings.ToLower(*properties.ReasonType), "planned") &&
+		!strings.Contains(strings.ToLower(*properties.ReasonType), "unplanned")
+}
+
+// MaintenanceHandler serves the maintenance windows API, authenticated by a bearer token
+// GET lists the windows, POST creates one and DELETE on /<id> removes one.
+type MaintenanceHandler struct {
+	maintenance *Maintenance
+	token       string
+}
+
+// NewMaintenanceHandler returns the maintenance windows API, enabling windows created through it
+func NewMaintenanceHandler(maintenance *Maintenance, token string) *MaintenanceHandler {
+	maintenance.mutex.Lock()
+	maintenance.apiEnabled = true
+	maintenance.mutex.Unlock()
+
+	return &MaintenanceHandler{maintenance: maintenance, token: token}
+}
+
+// maintenanceWindowRequest is the body of a window creation, which ends at End or after Duration
+type maintenanceWindowRequest struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration string    `json:"duration"`
+	ResourceSelector
+}
+
+func (h *MaintenanceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, MaintenanceWindowsPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.maintenance.ActiveAndScheduledWindows())
+	case id == "" && r.Method == http.MethodPost:
+		h.create(w, r)
+	case id != "" && r.Method == http.MethodDelete:
+		if !h.maintenance.Delete(id) {
+			http.Error(w, "Maintenance window not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *MaintenanceHandler) create(w http.ResponseWriter, r *http.Request) {
+	var request maintenanceWindowRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestBodySize)).Decode(&request); err != nil {
+		http.Error(w, "Invalid maintenance window: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	window, err := request.window(h.maintenance.now())
+	if err != nil {
+		http.Error(w, "Invalid maintenance window: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.maintenance.Add(window)
+	log.Infof("Maintenance window %s (%s) created until %s", window.Name, window.ID, window.End.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, window)
+}
+
+// window validates the request, and returns the window to create
+func (request *maintenanceWindowRequest) window(now time.Time) (*MaintenanceWindow, error) {
+	if request.Name == "" {
+		return nil, errors.New("name is mandatory")
+	}
+	if request.ResourceSelector.empty() {
+		return nil, errors.New("resource_ids, resource_types or resource_tags are mandatory")
+	}
+
+	window := &MaintenanceWindow{
+		Name:             request.Name,
+		Source:           MaintenanceSourceAPI,
+		Start:            request.Start,
+		End:              request.End,
+		ResourceSelector: request.ResourceSelector,
+	}
+	if window.Start.IsZero() {
+		window.Start = now
+	}
+	if request.Duration != "" {
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			return nil, err
+		}
+		window.End = window.Start.Add(duration)
+	}
+	if window.End.IsZero() {
+		return nil, errors.New("end or duration is mandatory")
+	}
+	if !window.End.After(window.Start) || !window.End.After(now) {
+		return nil, errors.New("end must be after start and in the future")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	window.ID = hex.EncodeToString(id)
+	return window, nil
+}
+
+// ActiveAndScheduledWindows returns the windows created through the API, along with the configured ones in progress
+func (m *Maintenance) ActiveAndScheduledWindows() []*MaintenanceWindow {
+	windows := m.Windows()
+	for _, window := range m.ActiveWindows() {
+		if window.Source == MaintenanceSourceConfig {
+			windows = append(windows, window)
+		}
+	}
+	return windows
+}
+
+// MaxRequestBodySize bounds the bodies read by the HTTP APIs, which are small JSON objects
+const MaxRequestBodySize = 1 << 20
+
+// writeJSON writes value as the JSON response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("Error writing response: %v", err)
+	}
+}
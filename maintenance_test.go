@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLoadConfigContent_Maintenance(t *testing.T) {
+	for _, configFile := range []string{
+		"maintenance:\n  windows:\n    - schedule: \"0 2 * * *\"\n      duration: 1h\n      resource_ids: [\"my_id\"]\n",
+		"maintenance:\n  windows:\n    - name: nightly\n      schedule: \"0 2 * * *\"\n      resource_ids: [\"my_id\"]\n",
+		"maintenance:\n  windows:\n    - name: nightly\n      schedule: \"0 2 * * *\"\n      duration: 1h\n",
+		"maintenance:\n  windows:\n    - name: nightly\n      schedule: \"0 25 * * *\"\n      duration: 1h\n      resource_ids: [\"my_id\"]\n",
+		"maintenance:\n  windows:\n    - name: nightly\n      schedule: \"0 2 * * *\"\n      duration: 1h\n      timezone: Nowhere/Special\n      resource_ids: [\"my_id\"]\n",
+	} {
+		if _, err := loadConfigContent([]byte(configFile)); err == nil {
+			t.Errorf("Should have an error loading %v", configFile)
+		}
+	}
+}
+
+func TestResourceSelector_Selects(t *testing.T) {
+	resourceType := "Microsoft.Compute/virtualMachines"
+	env := "dev"
+	resourceID := trackedResourceID
+	resource := &MonitoredResource{Resource: resources.GenericResource{
+		ID:   &resourceID,
+		Type: &resourceType,
+		Tags: map[string]*string{"Env": &env},
+	}}
+
+	tests := []struct {
+		selector ResourceSelector
+		want     bool
+	}{
+		{ResourceSelector{ResourceIDs: []string{strings.ToLower(trackedResourceID)}}, true},
+		{ResourceSelector{ResourceTags: map[string]string{"Env": "dev"}}, true},
+		{ResourceSelector{ResourceTags: map[string]string{"Env": "prod"}}, false},
+		{ResourceSelector{ResourceTypes: []string{"microsoft.compute/virtualmachines"}}, true},
+		{ResourceSelector{ResourceTypes: []string{"Microsoft.Web/sites"}, ResourceTags: map[string]string{"Env": "dev"}}, false},
+		{ResourceSelector{}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.selector.Selects(resource); got != test.want {
+			t.Errorf("Unexpected selection by %+v: got %v, want %v", test.selector, got, test.want)
+		}
+	}
+}
+
+func TestMaintenance_ActiveWindows(t *testing.T) {
+	loadConfigContent([]byte(`
+maintenance:
+  windows:
+    - name: nightly
+      schedule: "0 2 * * *"
+      duration: 2h
+      timezone: America/Montreal
+      resource_tags:
+        Env: "dev"
+`))
+	now := time.Date(2020, 1, 7, 8, 30, 0, 0, time.UTC)
+	maintenance := NewMaintenance()
+	maintenance.now = func() time.Time { return now }
+	maintenance.Add(&MaintenanceWindow{ID: "expired", Name: "expired", Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)})
+	maintenance.Add(&MaintenanceWindow{ID: "future", Name: "future", Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)})
+	maintenance.Add(&MaintenanceWindow{ID: "current", Name: "current", Start: now.Add(-time.Hour), End: now.Add(time.Hour)})
+
+	// 8:30 UTC is 3:30 in Montreal
+	var names []string
+	for _, window := range maintenance.ActiveWindows() {
+		names = append(names, window.Name)
+	}
+	if strings.Join(names, ",") != "current,nightly" {
+		t.Errorf("Unexpected active windows: %v", names)
+	}
+	if windows := maintenance.Windows(); len(windows) != 2 {
+		t.Errorf("Unexpected windows: %v", windows)
+	}
+}
+
+func TestIsPlannedEvent(t *testing.T) {
+	planned := "Planned"
+	unplanned := "Unplanned"
+	tests := []struct {
+		properties *resourcehealth.AvailabilityStatusProperties
+		want       bool
+	}{
+		{&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable, ReasonType: &planned}, true},
+		{&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable, ReasonType: &unplanned}, false},
+		{&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unknown, HealthEventCategory: &planned}, true},
+		{&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available, ReasonType: &planned}, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := isPlannedEvent(&resourcehealth.AvailabilityStatus{Properties: test.properties}); got != test.want {
+			t.Errorf("Unexpected planned event %+v: got %v, want %v", test.properties, got, test.want)
+		}
+	}
+}
+
+func TestMaintenanceHandler(t *testing.T) {
+	now := time.Unix(1500000000, 0).UTC()
+	maintenance := NewMaintenance()
+	maintenance.now = func() time.Time { return now }
+	handler := NewMaintenanceHandler(maintenance, "secret")
+
+	call := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := call("GET", MaintenanceWindowsPath, "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status code without token: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := call("GET", MaintenanceWindowsPath, "wrong", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong status code with a wrong token: got %v, want %v", rr.Code, http.StatusUnauthorized)
+	}
+
+	for _, body := range []string{
+		`{"resource_ids": ["my_id"], "duration": "1h"}`,
+		`{"name": "upgrade", "duration": "1h"}`,
+		`{"name": "upgrade", "resource_ids": ["my_id"]}`,
+		`{"name": "upgrade", "resource_ids": ["my_id"], "end": "2017-07-14T00:00:00Z"}`,
+		`{"name": "upgrade", "resource_ids": ["my_id"], "duration": "soon"}`,
+		`{"name": "` + strings.Repeat("a", MaxRequestBodySize) + `", "resource_ids": ["my_id"], "duration": "1h"}`,
+	} {
+		if rr := call("POST", MaintenanceWindowsPath, "secret", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Wrong status code creating %.100v: got %v, want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	rr := call("POST", MaintenanceWindowsPath, "secret", `{"name": "upgrade", "resource_tags": {"Env": "dev"}, "duration": "2h"}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Wrong status code: got %v, want %v: %v", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	var created MaintenanceWindow
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Error decoding %v: %v", rr.Body.String(), err)
+	}
+	if created.ID == "" || created.Source != MaintenanceSourceAPI || !created.Start.Equal(now) || !created.End.Equal(now.Add(2*time.Hour)) || created.ResourceTags["Env"] != "dev" {
+		t.Errorf("Unexpected window: %+v", created)
+	}
+
+	rr = call("GET", MaintenanceWindowsPath, "secret", "")
+	var windows []MaintenanceWindow
+	if err := json.Unmarshal(rr.Body.Bytes(), &windows); err != nil || len(windows) != 1 || windows[0].ID != created.ID {
+		t.Errorf("Unexpected windows %v: %v", rr.Body.String(), err)
+	}
+
+	if rr := call("DELETE", MaintenanceWindowsPath+"/"+created.ID, "secret", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Wrong status code deleting: got %v, want %v", rr.Code, http.StatusNoContent)
+	}
+	if rr := call("DELETE", MaintenanceWindowsPath+"/"+created.ID, "secret", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Wrong status code deleting again: got %v, want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestCollect_Maintenance(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	NewMaintenanceHandler(collector.Maintenance(), "secret")
+
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	planned := "Planned"
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	for _, instance := range []struct {
+		name       string
+		reasonType *string
+	}{
+		{"web1", nil},
+		{"web2", nil},
+		{"web3", &planned},
+	} {
+		resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/" + instance.name
+		asID := resourceID + AvailabilityStatusIDSuffix
+		resList = append(resList, resources.GenericResource{
+			ID:   &resourceID,
+			Type: &resourceType,
+			Tags: map[string]*string{"Monitoring": &monitoring},
+		})
+		asList = append(asList, resourcehealth.AvailabilityStatus{
+			ID:         &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable, ReasonType: instance.reasonType},
+		})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	collector.Maintenance().Add(&MaintenanceWindow{
+		ID:               "upgrade",
+		Name:             "upgrade",
+		Start:            time.Now().Add(-time.Minute),
+		End:              time.Now().Add(time.Hour),
+		ResourceSelector: ResourceSelector{ResourceIDs: []string{"/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/web1"}},
+	})
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+maintenance:
+  treat_as_available: true
+  planned_events: true
+`)
+
+	for _, want := range []string{
+		`azure_resource_health_availability_up{in_maintenance="true",resource_group="my_rg",resource_name="web1",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_availability_up{in_maintenance="false",resource_group="my_rg",resource_name="web2",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 0`,
+		`azure_resource_health_availability_up{in_maintenance="true",resource_group="my_rg",resource_name="web3",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+}
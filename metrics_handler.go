@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+)
+
+// ScrapeTimeoutHeader is the header in which Prometheus sends the scrape timeout
+const ScrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// MetricsHandler serves the metrics, bounding the wait for the Azure fetch by the Prometheus scrape timeout
+type MetricsHandler struct {
+	collector     *ResourceHealthCollector
+	gatherer      prometheus.Gatherer
+	timeoutOffset time.Duration
+}
+
+// NewMetricsHandler returns a handler serving the collector metrics along with the gatherer ones
+// The scrape timeout minus timeoutOffset bounds the wait for the Azure fetch
+func NewMetricsHandler(collector *ResourceHealthCollector, gatherer prometheus.Gatherer, timeoutOffset time.Duration) *MetricsHandler {
+	return &MetricsHandler{
+		collector:     collector,
+		gatherer:      gatherer,
+		timeoutOffset: timeoutOffset,
+	}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := h.scrapeContext(r)
+	defer cancel()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&scrapeCollector{ctx: ctx, collector: h.collector})
+
+	promhttp.HandlerFor(prometheus.Gatherers{h.gatherer, registry}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// scrapeContext returns the request context, with a deadline if Prometheus sent its scrape timeout
+func (h *MetricsHandler) scrapeContext(r *http.Request) (context.Context, context.CancelFunc) {
+	header := r.Header.Get(ScrapeTimeoutHeader)
+	if header == "" {
+		return context.WithCancel(r.Context())
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		log.Errorf("Failed to parse %s header %q: %v", ScrapeTimeoutHeader, header, err)
+		return context.WithCancel(r.Context())
+	}
+
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > h.timeoutOffset {
+		timeout -= h.timeoutOffset
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// scrapeCollector binds the collector to the context of a scrape
+type scrapeCollector struct {
+	ctx       context.Context
+	collector *ResourceHealthCollector
+}
+
+func (sc *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	sc.collector.Describe(ch)
+}
+
+func (sc *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.collector.CollectWithContext(sc.ctx, ch)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMetricsHandler_ScrapeContext(t *testing.T) {
+	handler := NewMetricsHandler(nil, prometheus.NewRegistry(), time.Second)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	ctx, cancel := handler.scrapeContext(req)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Errorf("Unexpected deadline without %s header", ScrapeTimeoutHeader)
+	}
+
+	req.Header.Set(ScrapeTimeoutHeader, "10")
+	ctx, cancel = handler.scrapeContext(req)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		t.Errorf("Want a deadline, got none")
+	}
+	if timeout := time.Until(deadline); timeout > 9*time.Second || timeout < 8*time.Second {
+		t.Errorf("Unexpected timeout: got %v, want %v", timeout, 9*time.Second)
+	}
+}
+
+// blockingResourceHealth blocks on listing availability statuses until its context is done
+type blockingResourceHealth struct {
+	syntheticResourceHealth
+}
+
+func (b *blockingResourceHealth) ForEachAvailabilityStatus(ctx context.Context, expand string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(5 * time.Second):
+		return nil
+	}
+}
+
+func TestMetricsHandler_TimedOut(t *testing.T) {
+	loadConfig("config/config_example.yml")
+	r := MockedResources{}
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{}, nil)
+	collector := newResourceHealthCollector([]subscriptionClients{
+		{resourceHealth: &blockingResourceHealth{}, resources: &r},
+	}).WithFetchTimeout(100 * time.Millisecond)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set(ScrapeTimeoutHeader, "0.01")
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	NewMetricsHandler(collector, prometheus.NewRegistry(), 0).ServeHTTP(rr, req)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("The scrape did not stop waiting for the fetch on its timeout: took %v", elapsed)
+	}
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
+	}
+	want := "azure_health_exporter_scrape_timed_out 1"
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Missing metric: want %v in %v", want, rr.Body.String())
+	}
+
+	// The fetch goes on until its own timeout, and its partial results are not kept
+	collector.Refresh(context.Background())
+	if collector.LatestSnapshot() != nil {
+		t.Errorf("The partial snapshot of a fetch which timed out was kept")
+	}
+}
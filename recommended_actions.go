@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// RecommendedActionsPath is the path of the recommended actions JSON endpoint
+const RecommendedActionsPath = "/api/v1/recommended-actions"
+
+// maxActionLabelLength bounds the length of the action label, the full text being served by the JSON endpoint
+const maxActionLabelLength = 100
+
+// RecommendedActions lists the recommended actions of the resources, as served by the JSON endpoint
+type RecommendedActions struct {
+	FetchedAt time.Time                    `json:"fetched_at"`
+	Resources []ResourceRecommendedActions `json:"resources"`
+}
+
+// ResourceRecommendedActions are the actions Azure recommends for a resource in its current availability state
+type ResourceRecommendedActions struct {
+	ResourceID        string              `json:"resource_id"`
+	SubscriptionID    string              `json:"subscription_id"`
+	ResourceGroup     string              `json:"resource_group"`
+	ResourceName      string              `json:"resource_name"`
+	ResourceType      string              `json:"resource_type"`
+	AvailabilityState string              `json:"availability_state"`
+	Summary           string              `json:"summary,omitempty"`
+	Actions           []RecommendedAction `json:"recommended_actions"`
+}
+
+// RecommendedAction is an action recommended by Azure, identified by the hash of its text
+type RecommendedAction struct {
+	ID            string `json:"id"`
+	Action        string `json:"action"`
+	ActionURL     string `json:"action_url,omitempty"`
+	ActionURLText string `json:"action_url_text,omitempty"`
+}
+
+// recommendedActions returns the recommended actions of a resource, without duplicates
+func recommendedActions(resource *MonitoredResource) []RecommendedAction {
+	properties := resource.AvailabilityStatus.Properties
+	if properties == nil || properties.RecommendedActions == nil {
+		return nil
+	}
+
+	var actions []RecommendedAction
+	seen := make(map[string]bool)
+	for _, recommended := range *properties.RecommendedActions {
+		if recommended.Action == nil || *recommended.Action == "" {
+			continue
+		}
+		action := RecommendedAction{ID: actionID(*recommended.Action), Action: *recommended.Action}
+		if seen[action.ID] {
+			continue
+		}
+		seen[action.ID] = true
+		if recommended.ActionURL != nil {
+			action.ActionURL = *recommended.ActionURL
+		}
+		if recommended.ActionURLText != nil {
+			action.ActionURLText = *recommended.ActionURLText
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// actionID returns a short hash of an action text
+func actionID(action string) string {
+	sum := sha256.Sum256([]byte(action))
+	return hex.EncodeToString(sum[:8])
+}
+
+// truncateAction returns the action text cut to maxActionLabelLength characters
+func truncateAction(action string) string {
+	runes := []rune(action)
+	if len(runes) <= maxActionLabelLength {
+		return action
+	}
+	return string(runes[:maxActionLabelLength-1]) + "…"
+}
+
+// CollectRecommendedActions exports the actions Azure recommends for a resource as info series
+func (c *ResourceHealthCollector) CollectRecommendedActions(ch chan<- prometheus.Metric, resource *MonitoredResource) {
+	for _, action := range recommendedActions(resource) {
+		labels := copyLabels(resource.Labels)
+		labels["action_id"] = action.ID
+		labels["action"] = truncateAction(action.Action)
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("azure_resource_health_recommended_action_info", "Action recommended by Azure for the resource in its current availability state", nil, labels),
+			prometheus.GaugeValue,
+			1,
+		)
+	}
+}
+
+// RecommendedActionsHandler serves the recommended actions of the latest fetch as JSON
+// Resources may be filtered with the resource_id query parameter.
+type RecommendedActionsHandler struct {
+	collector *ResourceHealthCollector
+}
+
+// NewRecommendedActionsHandler returns a handler serving the recommended actions known to the collector
+func NewRecommendedActionsHandler(collector *ResourceHealthCollector) *RecommendedActionsHandler {
+	return &RecommendedActionsHandler{collector: collector}
+}
+
+func (h *RecommendedActionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snapshot := h.collector.LatestSnapshot()
+	if snapshot == nil {
+		http.Error(w, "No availability statuses fetched yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	resourceID := r.URL.Query().Get("resource_id")
+	response := RecommendedActions{FetchedAt: snapshot.FetchedAt, Resources: []ResourceRecommendedActions{}}
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		for i := range subscriptionSnapshot.Resources {
+			resource := &subscriptionSnapshot.Resources[i]
+			if resourceID != "" && !strings.EqualFold(resourceID, *resource.Resource.ID) {
+				continue
+			}
+			actions := recommendedActions(resource)
+			if len(actions) == 0 {
+				continue
+			}
+			resourceActions := ResourceRecommendedActions{
+				ResourceID:        *resource.Resource.ID,
+				SubscriptionID:    resource.Labels["subscription_id"],
+				ResourceGroup:     resource.Labels["resource_group"],
+				ResourceName:      resource.Labels["resource_name"],
+				ResourceType:      resource.Labels["resource_type"],
+				AvailabilityState: availabilityState(&resource.AvailabilityStatus),
+				Actions:           actions,
+			}
+			if resource.AvailabilityStatus.Properties.Summary != nil {
+				resourceActions.Summary = *resource.AvailabilityStatus.Properties.Summary
+			}
+			response.Resources = append(response.Resources, resourceActions)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorf("Error writing recommended actions: %v", err)
+	}
+}
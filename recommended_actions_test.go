@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestTruncateAction(t *testing.T) {
+	short := "Restart the virtual machine"
+	if got := truncateAction(short); got != short {
+		t.Errorf("Unexpected truncation: got %v, want %v", got, short)
+	}
+
+	long := strings.Repeat("é", 150)
+	got := truncateAction(long)
+	if len([]rune(got)) != maxActionLabelLength || !strings.HasSuffix(got, "…") {
+		t.Errorf("Unexpected truncation: got %v", got)
+	}
+}
+
+func mockRecommendedActions(r *MockedResources, rh *MockedResourceHealth) {
+	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
+	asID := resourceID + AvailabilityStatusIDSuffix
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	summary := "The virtual machine is stopping"
+	restart := "Restart the virtual machine"
+	url := "https://portal.azure.com/#resource" + resourceID + "/overview"
+	urlText := "Restart"
+	support := "Contact support"
+
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{
+			AvailabilityState: resourcehealth.Unavailable,
+			Summary:           &summary,
+			RecommendedActions: &[]resourcehealth.RecommendedAction{
+				{Action: &restart, ActionURL: &url, ActionURLText: &urlText},
+				{Action: &support},
+				{Action: &support},
+			},
+		}},
+	}, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+}
+
+func TestCollect_RecommendedActions(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	mockRecommendedActions(&r, &rh)
+
+	rr := CallExporterWithConfig(collector, `
+expose_recommended_actions: true
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+`)
+
+	for _, want := range []string{
+		`azure_resource_health_recommended_action_info{action="Restart the virtual machine",action_id="` + actionID("Restart the virtual machine") + `",resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_recommended_action_info{action="Contact support",action_id="` + actionID("Contact support") + `",resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+	rh.AssertCalled(t, "ForEachAvailabilityStatus", ExpandRecommendedActions)
+}
+
+func TestCollect_RecommendedActions_Disabled(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	mockRecommendedActions(&r, &rh)
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+`)
+
+	if strings.Contains(rr.Body.String(), "azure_resource_health_recommended_action_info") {
+		t.Errorf("Unexpected recommended actions in body %v", rr.Body.String())
+	}
+	// Recommended actions are not expanded, to keep the responses small
+	rh.AssertCalled(t, "ForEachAvailabilityStatus", "")
+	rh.AssertNotCalled(t, "ForEachAvailabilityStatus", ExpandRecommendedActions)
+}
+
+func TestRecommendedActionsHandler(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	mockRecommendedActions(&r, &rh)
+	handler := NewRecommendedActionsHandler(collector)
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", RecommendedActionsPath, nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Wrong status code before any fetch: got %v, want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	CallExporterWithConfig(collector, `
+expose_recommended_actions: true
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+`)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", RecommendedActionsPath+"?resource_id=/subscriptions/my_subscription/resourcegroups/my_rg/providers/microsoft.compute/virtualmachines/my_instance", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Wrong status code: got %v, want %v", rr.Code, http.StatusOK)
+	}
+	var got RecommendedActions
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding %v: %v", rr.Body.String(), err)
+	}
+	if len(got.Resources) != 1 {
+		t.Fatalf("Unexpected resources: %+v", got.Resources)
+	}
+	resource := got.Resources[0]
+	if resource.ResourceName != "my_instance" || resource.AvailabilityState != "Unavailable" || resource.Summary != "The virtual machine is stopping" {
+		t.Errorf("Unexpected resource: %+v", resource)
+	}
+	if len(resource.Actions) != 2 || resource.Actions[0].ActionURLText != "Restart" || !strings.HasPrefix(resource.Actions[0].ActionURL, "https://portal.azure.com/") {
+		t.Errorf("Unexpected actions: %+v", resource.Actions)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", RecommendedActionsPath+"?resource_id=other", nil))
+	if strings.TrimSpace(rr.Body.String()) == "" || strings.Contains(rr.Body.String(), "my_instance") {
+		t.Errorf("Unexpected filtered response: %v", rr.Body.String())
+	}
+}
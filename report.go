@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/pkg/errors"
+)
+
+// Report output formats
+const (
+	ReportFormatCSV  = "csv"
+	ReportFormatJSON = "json"
+	ReportFormatHTML = "html"
+)
+
+// ReportOptions selects the time range and resources of a report
+type ReportOptions struct {
+	From time.Time
+	To   time.Time
+	// Tags select the configured resources having all of these tag values
+	Tags map[string]string
+}
+
+// Report is the availability of resources over a time range
+type Report struct {
+	From      time.Time         `json:"from"`
+	To        time.Time         `json:"to"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Resources []ResourceReport  `json:"resources"`
+	Totals    ReportTotals      `json:"totals"`
+}
+
+// ResourceReport is the availability of a resource over the report time range
+type ResourceReport struct {
+	ResourceID     string `json:"resource_id"`
+	SubscriptionID string `json:"subscription_id"`
+	ResourceGroup  string `json:"resource_group"`
+	ResourceName   string `json:"resource_name"`
+	ResourceType   string `json:"resource_type"`
+	// ObservedSeconds is the part of the time range covered by the Resource Health history
+	ObservedSeconds float64 `json:"observed_seconds"`
+	DowntimeSeconds float64 `json:"downtime_seconds"`
+	// UptimeRatio is nil if the history does not cover the time range
+	UptimeRatio *float64 `json:"uptime_ratio"`
+	Outages     []Outage `json:"outages"`
+}
+
+// Outage is a period during which a resource was unavailable
+type Outage struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ReasonType      string    `json:"reason_type"`
+	Summary         string    `json:"summary"`
+}
+
+// ReportTotals sums up the availability of all the resources of a report
+type ReportTotals struct {
+	Resources       int      `json:"resources"`
+	Outages         int      `json:"outages"`
+	ObservedSeconds float64  `json:"observed_seconds"`
+	DowntimeSeconds float64  `json:"downtime_seconds"`
+	UptimeRatio     *float64 `json:"uptime_ratio"`
+}
+
+// NewReport builds the availability report of the configured resources from their Resource Health history
+// A failed subscription or resource is left out of the report, the failures being returned as an error.
+func NewReport(ctx context.Context, subscriptions []subscriptionClients, options ReportOptions) (*Report, error) {
+	report := &Report{
+		From:      options.From,
+		To:        options.To,
+		Tags:      options.Tags,
+		Resources: []ResourceReport{},
+	}
+
+	selector := func(resource *resources.GenericResource) bool {
+		for name, value := range options.Tags {
+			if resVal, ok := resource.Tags[name]; !ok || resVal == nil || *resVal != value {
+				return false
+			}
+		}
+		return true
+	}
+
+	failures := 0
+	for _, subscription := range subscriptions {
+		failures += forEachResourceHistory(ctx, subscription, selector, func(history *ResourceHistory) {
+			report.Resources = append(report.Resources, newResourceReport(history, options.From, options.To))
+		})
+	}
+
+	sort.Slice(report.Resources, func(i, j int) bool {
+		a, b := report.Resources[i], report.Resources[j]
+		if a.SubscriptionID != b.SubscriptionID {
+			return a.SubscriptionID < b.SubscriptionID
+		}
+		if a.ResourceGroup != b.ResourceGroup {
+			return a.ResourceGroup < b.ResourceGroup
+		}
+		return a.ResourceName < b.ResourceName
+	})
+
+	for _, resource := range report.Resources {
+		report.Totals.Resources++
+		report.Totals.Outages += len(resource.Outages)
+		report.Totals.ObservedSeconds += resource.ObservedSeconds
+		report.Totals.DowntimeSeconds += resource.DowntimeSeconds
+	}
+	report.Totals.UptimeRatio = uptimeRatio(report.Totals.ObservedSeconds, report.Totals.DowntimeSeconds)
+
+	if failures > 0 {
+		return report, errors.Errorf("failed to report %d subscriptions or resources", failures)
+	}
+	return report, nil
+}
+
+// newResourceReport computes the uptime and outages of a resource between from and to
+// Consecutive unavailable states make a single outage, described by the state which started it.
+// Time after now is not observed yet, e.g. in a report of the current month.
+func newResourceReport(history *ResourceHistory, from time.Time, to time.Time) ResourceReport {
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+	report := ResourceReport{
+		ResourceID:     history.ResourceID,
+		SubscriptionID: history.Labels["subscription_id"],
+		ResourceGroup:  history.Labels["resource_group"],
+		ResourceName:   history.Labels["resource_name"],
+		ResourceType:   history.Labels["resource_type"],
+		Outages:        []Outage{},
+	}
+
+	for i, state := range history.States {
+		end := to
+		if i+1 < len(history.States) {
+			end = history.States[i+1].Occurred
+		}
+		start := clampTime(state.Occurred, from, to)
+		end = clampTime(end, from, to)
+		if !end.After(start) {
+			continue
+		}
+		report.ObservedSeconds += end.Sub(start).Seconds()
+
+		if state.State != string(resourcehealth.Unavailable) {
+			continue
+		}
+		report.DowntimeSeconds += end.Sub(start).Seconds()
+		if last := len(report.Outages) - 1; last >= 0 && report.Outages[last].End.Equal(start) {
+			report.Outages[last].End = end
+			report.Outages[last].DurationSeconds = end.Sub(report.Outages[last].Start).Seconds()
+			continue
+		}
+		report.Outages = append(report.Outages, Outage{
+			Start:           start,
+			End:             end,
+			DurationSeconds: end.Sub(start).Seconds(),
+			ReasonType:      state.ReasonType,
+			Summary:         state.Summary,
+		})
+	}
+
+	report.UptimeRatio = uptimeRatio(report.ObservedSeconds, report.DowntimeSeconds)
+	return report
+}
+
+func uptimeRatio(observedSeconds float64, downtimeSeconds float64) *float64 {
+	if observedSeconds <= 0 {
+		return nil
+	}
+	ratio := 1 - downtimeSeconds/observedSeconds
+	return &ratio
+}
+
+// Write writes the report to w in format
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case ReportFormatCSV:
+		return r.WriteCSV(w)
+	case ReportFormatJSON:
+		return r.WriteJSON(w)
+	case ReportFormatHTML:
+		return r.WriteHTML(w)
+	}
+	return errors.Errorf("unknown report format %s", format)
+}
+
+// WriteJSON writes the report as a JSON document
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteCSV writes the report as a CSV table, with a row per resource, followed by its outages, and a final row of totals
+func (r *Report) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"record", "subscription_id", "resource_group", "resource_name", "resource_type", "start", "end", "downtime_seconds", "uptime_ratio", "reason_type", "summary"})
+	for _, resource := range r.Resources {
+		writer.Write([]string{"resource", resource.SubscriptionID, resource.ResourceGroup, resource.ResourceName, resource.ResourceType,
+			formatReportTime(r.From), formatReportTime(r.To), formatReportFloat(resource.DowntimeSeconds), formatReportRatio(resource.UptimeRatio), "", ""})
+		for _, outage := range resource.Outages {
+			writer.Write([]string{"outage", resource.SubscriptionID, resource.ResourceGroup, resource.ResourceName, resource.ResourceType,
+				formatReportTime(outage.Start), formatReportTime(outage.End), formatReportFloat(outage.DurationSeconds), "", outage.ReasonType, outage.Summary})
+		}
+	}
+	writer.Write([]string{"total", "", "", "", "",
+		formatReportTime(r.From), formatReportTime(r.To), formatReportFloat(r.Totals.DowntimeSeconds), formatReportRatio(r.Totals.UptimeRatio), "", ""})
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteHTML writes the report as a standalone HTML page, ready to be printed
+func (r *Report) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
+
+func formatReportTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatReportFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatReportRatio(ratio *float64) string {
+	if ratio == nil {
+		return ""
+	}
+	return formatReportFloat(*ratio)
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time": formatReportTime,
+	"percent": func(ratio *float64) string {
+		if ratio == nil {
+			return "n/a"
+		}
+		return fmt.Sprintf("%.3f%%", *ratio*100)
+	},
+	"duration": func(seconds float64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Availability report</title>
+<style>
+body { font-family: sans-serif; font-size: 12px; margin: 2em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #f0f0f0; }
+tr { page-break-inside: avoid; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>Availability report</h1>
+<p>From {{ time .From }} to {{ time .To }}{{ range $name, $value := .Tags }}, {{ $name }}={{ $value }}{{ end }}</p>
+<h2>Totals</h2>
+<table>
+<tr><th>Resources</th><th>Outages</th><th>Downtime</th><th>Uptime</th></tr>
+<tr><td>{{ .Totals.Resources }}</td><td>{{ .Totals.Outages }}</td><td>{{ duration .Totals.DowntimeSeconds }}</td><td>{{ percent .Totals.UptimeRatio }}</td></tr>
+</table>
+<h2>Resources</h2>
+<table>
+<tr><th>Subscription</th><th>Resource group</th><th>Resource</th><th>Type</th><th>Downtime</th><th>Uptime</th></tr>
+{{- range .Resources }}
+<tr><td>{{ .SubscriptionID }}</td><td>{{ .ResourceGroup }}</td><td>{{ .ResourceName }}</td><td>{{ .ResourceType }}</td><td>{{ duration .DowntimeSeconds }}</td><td>{{ percent .UptimeRatio }}</td></tr>
+{{- end }}
+</table>
+<h2>Outages</h2>
+<table>
+<tr><th>Resource</th><th>Start</th><th>End</th><th>Duration</th><th>Reason</th><th>Summary</th></tr>
+{{- range $resource := .Resources }}{{ range .Outages }}
+<tr><td>{{ $resource.ResourceGroup }}/{{ $resource.ResourceName }}</td><td>{{ time .Start }}</td><td>{{ time .End }}</td><td>{{ duration .DurationSeconds }}</td><td>{{ .ReasonType }}</td><td>{{ .Summary }}</td></tr>
+{{- end }}{{ end }}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/stretchr/testify/mock"
+)
+
+func reportStatus(state resourcehealth.AvailabilityStateValues, occurred time.Time, reasonType string, summary string) resourcehealth.AvailabilityStatus {
+	return resourcehealth.AvailabilityStatus{Properties: &resourcehealth.AvailabilityStatusProperties{
+		AvailabilityState: state,
+		OccuredTime:       &date.Time{Time: occurred},
+		ReasonType:        &reasonType,
+		Summary:           &summary,
+	}}
+}
+
+func newTestReport(t *testing.T) *Report {
+	loadConfig("config/config_example.yml")
+	rh := MockedResourceHealth{}
+	r := MockedResources{}
+
+	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
+	otherID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/other_instance"
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	alice := "Alice"
+	bob := "Bob"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring, "Client": &alice}},
+		{ID: &otherID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring, "Client": &bob}},
+	}, nil)
+
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("ForEachAvailabilityStatusHistory", resourceID).Return(&[]resourcehealth.AvailabilityStatus{
+		reportStatus(resourcehealth.Available, from.Add(2*time.Hour), "", ""),
+		reportStatus(resourcehealth.Unavailable, from.Add(90*time.Minute), "Unplanned", "Still down"),
+		reportStatus(resourcehealth.Unavailable, from.Add(time.Hour), "Unplanned", "Host failure"),
+		reportStatus(resourcehealth.Available, from.Add(-time.Hour), "", ""),
+	}, nil)
+
+	report, err := NewReport(context.Background(), []subscriptionClients{{resourceHealth: &rh, resources: &r}}, ReportOptions{
+		From: from,
+		To:   from.Add(4 * time.Hour),
+		Tags: map[string]string{"Client": "Alice"},
+	})
+	if err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+	rh.AssertNotCalled(t, "ForEachAvailabilityStatusHistory", otherID)
+	return report
+}
+
+func TestNewReport_OK(t *testing.T) {
+	report := newTestReport(t)
+
+	if len(report.Resources) != 1 {
+		t.Fatalf("Unexpected resources: %v", report.Resources)
+	}
+	resource := report.Resources[0]
+	if resource.ResourceName != "my_instance" || resource.ObservedSeconds != 4*3600 || resource.DowntimeSeconds != 3600 {
+		t.Errorf("Unexpected resource report: %+v", resource)
+	}
+	if *resource.UptimeRatio != 0.75 {
+		t.Errorf("Unexpected uptime: got %v, want %v", *resource.UptimeRatio, 0.75)
+	}
+
+	// Consecutive unavailable states make a single outage
+	if len(resource.Outages) != 1 {
+		t.Fatalf("Unexpected outages: %v", resource.Outages)
+	}
+	outage := resource.Outages[0]
+	if outage.DurationSeconds != 3600 || outage.ReasonType != "Unplanned" || outage.Summary != "Host failure" {
+		t.Errorf("Unexpected outage: %+v", outage)
+	}
+
+	if report.Totals.Resources != 1 || report.Totals.Outages != 1 || *report.Totals.UptimeRatio != 0.75 {
+		t.Errorf("Unexpected totals: %+v", report.Totals)
+	}
+}
+
+func TestNewResourceReport_Future(t *testing.T) {
+	now := time.Now()
+	history := &ResourceHistory{States: []HistoricalState{
+		{Occurred: now.Add(-2 * time.Hour), State: string(resourcehealth.Available)},
+		{Occurred: now.Add(-time.Hour), State: string(resourcehealth.Unavailable)},
+	}}
+
+	// The current state does not extend past now
+	report := newResourceReport(history, now.Add(-2*time.Hour), now.Add(24*time.Hour))
+	if report.ObservedSeconds > 2*time.Hour.Seconds()+1 || report.DowntimeSeconds > time.Hour.Seconds()+1 {
+		t.Errorf("Unexpected observed time: %v, downtime: %v", report.ObservedSeconds, report.DowntimeSeconds)
+	}
+	if len(report.Outages) != 1 || report.Outages[0].End.After(time.Now()) {
+		t.Errorf("Unexpected outages: %+v", report.Outages)
+	}
+}
+
+func TestReport_WriteCSV(t *testing.T) {
+	report := newTestReport(t)
+
+	var output bytes.Buffer
+	if err := report.Write(&output, ReportFormatCSV); err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+
+	want := `record,subscription_id,resource_group,resource_name,resource_type,start,end,downtime_seconds,uptime_ratio,reason_type,summary
+resource,my_subscription,my_rg,my_instance,Microsoft.Compute/virtualMachines,2020-01-01T00:00:00Z,2020-01-01T04:00:00Z,3600,0.75,,
+outage,my_subscription,my_rg,my_instance,Microsoft.Compute/virtualMachines,2020-01-01T01:00:00Z,2020-01-01T02:00:00Z,3600,,Unplanned,Host failure
+total,,,,,2020-01-01T00:00:00Z,2020-01-01T04:00:00Z,3600,0.75,,
+`
+	if output.String() != want {
+		t.Errorf("Unexpected output: got %v, want %v", output.String(), want)
+	}
+}
+
+func TestReport_WriteJSON(t *testing.T) {
+	report := newTestReport(t)
+
+	var output bytes.Buffer
+	if err := report.Write(&output, ReportFormatJSON); err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+
+	var decoded Report
+	if err := json.Unmarshal(output.Bytes(), &decoded); err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+	if len(decoded.Resources) != 1 || len(decoded.Resources[0].Outages) != 1 || decoded.Totals.Outages != 1 {
+		t.Errorf("Unexpected report: %+v", decoded)
+	}
+}
+
+func TestReport_WriteHTML(t *testing.T) {
+	report := newTestReport(t)
+
+	var output bytes.Buffer
+	if err := report.Write(&output, ReportFormatHTML); err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+
+	for _, want := range []string{
+		"<td>my_instance</td>",
+		"<td>75.000%</td>",
+		"<td>Host failure</td>",
+		"Client=Alice",
+	} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("Missing %v in output %v", want, output.String())
+		}
+	}
+}
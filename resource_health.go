@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/go-autorest/autorest"
 )
 
+// ExpandRecommendedActions expands the recommended actions of the availability statuses
+const ExpandRecommendedActions = "recommendedactions"
+
 // AvailabilityStatusIDSuffix is the common suffix of all the AvailabilityStatus IDs
 const AvailabilityStatusIDSuffix = "/providers/Microsoft.ResourceHealth/availabilityStatuses/current"
 
@@ -13,13 +18,17 @@ const AvailabilityStatusIDSuffix = "/providers/Microsoft.ResourceHealth/availabi
 type ResourceHealthClient struct {
 	Session                *AzureSession
 	Client                 *resourcehealth.AvailabilityStatusesClient
+	ChildResourcesClient   *resourcehealth.ChildResourcesClient
 	LastRatelimitRemaining string
+	ratelimitMutex         sync.Mutex
 }
 
 // ResourceHealth client interface
 type ResourceHealth interface {
-	GetAvailabilityStatus(resourceURI string) (*resourcehealth.AvailabilityStatus, error)
-	GetAllAvailabilityStatuses() (*[]resourcehealth.AvailabilityStatus, error)
+	GetAvailabilityStatus(ctx context.Context, resourceURI string) (*resourcehealth.AvailabilityStatus, error)
+	ForEachAvailabilityStatus(ctx context.Context, expand string, fn func(*resourcehealth.AvailabilityStatus) error) error
+	ForEachAvailabilityStatusHistory(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error
+	ForEachChildAvailabilityStatus(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error
 	GetSubscriptionID() string
 	GetLastRatelimitRemaining() string
 }
@@ -29,10 +38,17 @@ func NewResourceHealth(session *AzureSession) ResourceHealth {
 
 	client := resourcehealth.NewAvailabilityStatusesClient(session.SubscriptionID)
 	client.Authorizer = session.Authorizer
+	childResourcesClient := resourcehealth.NewChildResourcesClient(session.SubscriptionID)
+	childResourcesClient.Authorizer = session.Authorizer
+	if session.Sender != nil {
+		client.Sender = session.Sender
+		childResourcesClient.Sender = session.Sender
+	}
 
 	return &ResourceHealthClient{
-		Session: session,
-		Client:  &client,
+		Session:              session,
+		Client:               &client,
+		ChildResourcesClient: &childResourcesClient,
 	}
 }
 
@@ -43,30 +59,68 @@ func (rc *ResourceHealthClient) GetSubscriptionID() string {
 
 // GetLastRatelimitRemaining return last ratelimit remaining value
 func (rc *ResourceHealthClient) GetLastRatelimitRemaining() string {
+	rc.ratelimitMutex.Lock()
+	defer rc.ratelimitMutex.Unlock()
 	return rc.LastRatelimitRemaining
 }
 
-// GetAllAvailabilityStatuses fetch all Resources Health availability statuses of the subscription
-func (rc *ResourceHealthClient) GetAllAvailabilityStatuses() (*[]resourcehealth.AvailabilityStatus, error) {
-	var asList []resourcehealth.AvailabilityStatus
+// setLastRatelimitRemaining records the ratelimit remaining of a response, as children are fetched in parallel
+func (rc *ResourceHealthClient) setLastRatelimitRemaining(response autorest.Response) {
+	rc.ratelimitMutex.Lock()
+	defer rc.ratelimitMutex.Unlock()
+	rc.LastRatelimitRemaining = response.Header.Get("X-Ms-Ratelimit-Remaining-Subscription-Resource-Requests")
+}
+
+// ForEachAvailabilityStatus streams all Resources Health availability statuses of the subscription to fn,
+// holding a single page in memory. Streaming stops on the first error returned by fn.
+// expand may be ExpandRecommendedActions, or empty.
+func (rc *ResourceHealthClient) ForEachAvailabilityStatus(ctx context.Context, expand string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	it, err := rc.Client.ListBySubscriptionIDComplete(ctx, "", expand)
+	for ; err == nil && it.NotDone(); err = it.NextWithContext(ctx) {
+		as := it.Value()
+		if err := fn(&as); err != nil {
+			return err
+		}
+		rc.setLastRatelimitRemaining(it.Response().Response)
+	}
+	return err
+}
+
+// ForEachAvailabilityStatusHistory streams the availability status history of a resource to fn,
+// as kept by Resource Health (about 30 days), holding a single page in memory.
+func (rc *ResourceHealthClient) ForEachAvailabilityStatusHistory(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	it, err := rc.Client.ListComplete(ctx, resourceURI, "", "")
+	for ; err == nil && it.NotDone(); err = it.NextWithContext(ctx) {
+		as := it.Value()
+		if err := fn(&as); err != nil {
+			return err
+		}
+		rc.setLastRatelimitRemaining(it.Response().Response)
+	}
+	return err
+}
 
-	for it, err := rc.Client.ListBySubscriptionIDComplete(context.Background(), "", ""); it.NotDone(); err = it.Next() {
-		if err != nil {
-			return nil, err
+// ForEachChildAvailabilityStatus streams the current availability statuses of the children of a resource to fn,
+// such as the instances of a scale set, holding a single page in memory.
+func (rc *ResourceHealthClient) ForEachChildAvailabilityStatus(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	it, err := rc.ChildResourcesClient.ListComplete(ctx, resourceURI, "", "")
+	for ; err == nil && it.NotDone(); err = it.NextWithContext(ctx) {
+		as := it.Value()
+		if err := fn(&as); err != nil {
+			return err
 		}
-		asList = append(asList, it.Value())
-		rc.LastRatelimitRemaining = it.Response().Header.Get("X-Ms-Ratelimit-Remaining-Subscription-Resource-Requests")
+		rc.setLastRatelimitRemaining(it.Response().Response)
 	}
-	return &asList, nil
+	return err
 }
 
 // GetAvailabilityStatus fetch all Resources Health availability statuses of the subscription
-func (rc *ResourceHealthClient) GetAvailabilityStatus(resourceURI string) (*resourcehealth.AvailabilityStatus, error) {
-	as, err := rc.Client.GetByResource(context.Background(), resourceURI, "", "")
+func (rc *ResourceHealthClient) GetAvailabilityStatus(ctx context.Context, resourceURI string) (*resourcehealth.AvailabilityStatus, error) {
+	as, err := rc.Client.GetByResource(ctx, resourceURI, "", "")
 	if err != nil {
 		return nil, err
 	}
-	rc.LastRatelimitRemaining = as.Response.Header.Get("X-Ms-Ratelimit-Remaining-Subscription-Resource-Requests")
+	rc.setLastRatelimitRemaining(as.Response)
 
 	return &as, nil
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
@@ -10,21 +13,178 @@ import (
 	"github.com/prometheus/common/log"
 )
 
+// AvailabilityStatusesResourceType is the resource type reported for availability statuses collection
+const AvailabilityStatusesResourceType = "Microsoft.ResourceHealth/availabilityStatuses"
+
+var (
+	collectSuccessDesc = prometheus.NewDesc(
+		"azure_health_exporter_collect_success",
+		"Whether the last collection of a resource type succeeded in a subscription",
+		[]string{"subscription_id", "resource_type"}, nil,
+	)
+	scrapeTimedOutDesc = prometheus.NewDesc(
+		"azure_health_exporter_scrape_timed_out",
+		"Whether the last scrape ran out of time, exporting partial results",
+		nil, nil,
+	)
+	dataAgeDesc = prometheus.NewDesc(
+		"azure_health_exporter_data_age_seconds",
+		"Age of the exported data, which is restored from disk until the first Azure fetch completes",
+		nil, nil,
+	)
+	circuitBreakerStateDesc = prometheus.NewDesc(
+		"azure_health_exporter_circuit_breaker_state",
+		"State of the Azure API circuit breaker of a subscription (0: closed, 1: open, 2: half-open)",
+		[]string{"subscription_id"}, nil,
+	)
+)
+
+// Notifier is notified of the availability state transitions of each new snapshot
+// Notify must not block, so that fetches are not delayed by slow notification sinks.
+type Notifier interface {
+	Notify(transitions []StateTransition)
+}
+
 // ResourceHealthCollector collect ResourceHealth metrics
 type ResourceHealthCollector struct {
+	subscriptions []subscriptionClients
+	fetches       *fetchGroup
+	workers       *WorkerPool
+	states        *StateTracker
+	maintenance   *Maintenance
+	notifiers     []Notifier
+	serviceHealth *serviceHealthTracker
+	store         *Store
+	trackMutex    sync.Mutex
+	restoreMutex  sync.Mutex
+	restored      *Snapshot
+	latest        *Snapshot
+	now           func() time.Time
+	collectErrors *prometheus.CounterVec
+	apiErrors     *prometheus.CounterVec
+	sharedScrapes *prometheus.CounterVec
+}
+
+// subscriptionClients holds the API clients of a single subscription
+type subscriptionClients struct {
 	resourceHealth ResourceHealth
 	resources      Resources
+	circuitBreaker *CircuitBreaker
 }
 
 // NewResourceHealthCollector returns the collector
-func NewResourceHealthCollector(session *AzureSession) *ResourceHealthCollector {
-	resourceHealth := NewResourceHealth(session)
-	resources := NewResources(session)
+func NewResourceHealthCollector(sessions ...*AzureSession) *ResourceHealthCollector {
+	var subscriptions []subscriptionClients
+	for _, session := range sessions {
+		subscriptions = append(subscriptions, newSubscriptionClients(session))
+	}
+
+	return newResourceHealthCollector(subscriptions)
+}
+
+// newSubscriptionClients returns the API clients of a session
+func newSubscriptionClients(session *AzureSession) subscriptionClients {
+	return subscriptionClients{
+		resourceHealth: NewResourceHealth(session),
+		resources:      NewResources(session),
+		circuitBreaker: session.CircuitBreaker,
+	}
+}
 
+func newResourceHealthCollector(subscriptions []subscriptionClients) *ResourceHealthCollector {
 	return &ResourceHealthCollector{
-		resourceHealth: resourceHealth,
-		resources:      resources,
+		subscriptions: subscriptions,
+		fetches:       newFetchGroup(0),
+		workers:       NewWorkerPool(1),
+		states:        NewStateTracker(),
+		maintenance:   NewMaintenance(),
+		serviceHealth: newServiceHealthTracker(),
+		now:           time.Now,
+		collectErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "azure_health_exporter_collect_errors_total",
+				Help: "Total number of errors while collecting a resource type in a subscription",
+			},
+			[]string{"subscription_id", "resource_type"},
+		),
+		apiErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "azure_health_exporter_api_errors_total",
+				Help: "Total number of Azure API errors by API and error class",
+			},
+			[]string{"api", "subscription_id", "class"},
+		),
+		sharedScrapes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "azure_health_exporter_shared_fetch_scrapes_total",
+				Help: "Total number of scrapes served from an in-flight, cached or restored Azure fetch instead of a new one",
+			},
+			[]string{"source"},
+		),
+	}
+}
+
+// WithCacheTTL makes the collector reuse the result of an Azure fetch during ttl
+func (c *ResourceHealthCollector) WithCacheTTL(ttl time.Duration) *ResourceHealthCollector {
+	c.fetches.ttl = ttl
+	return c
+}
+
+// WithFetchTimeout bounds the duration of an Azure fetch, which is not bound by the scrapes waiting for it
+func (c *ResourceHealthCollector) WithFetchTimeout(timeout time.Duration) *ResourceHealthCollector {
+	c.fetches.timeout = timeout
+	return c
+}
+
+// WithWorkers makes the collector run up to size Azure API calls in parallel, across subscriptions
+func (c *ResourceHealthCollector) WithWorkers(size int) *ResourceHealthCollector {
+	c.workers = NewWorkerPool(size)
+	return c
+}
+
+// WithStore makes the collector save its state to store after each fetch
+func (c *ResourceHealthCollector) WithStore(store *Store) *ResourceHealthCollector {
+	c.store = store
+	return c
+}
+
+// WithNotifier makes the collector notify notifier of the availability state transitions
+func (c *ResourceHealthCollector) WithNotifier(notifier Notifier) *ResourceHealthCollector {
+	c.notifiers = append(c.notifiers, notifier)
+	return c
+}
+
+// Maintenance returns the maintenance windows of the collector
+func (c *ResourceHealthCollector) Maintenance() *Maintenance {
+	return c.maintenance
+}
+
+// Restore loads the state saved in the store, which is then served to the scrapes running out of time
+// until a fetch completes. It returns whether a state was restored.
+func (c *ResourceHealthCollector) Restore() (bool, error) {
+	if c.store == nil {
+		return false, nil
+	}
+	state, err := c.store.Load()
+	if err != nil || state == nil {
+		return false, err
+	}
+
+	c.states.Restore(state.States)
+	if state.Snapshot != nil {
+		// The service health events of the restored snapshot are not notified again
+		c.serviceHealth.Update(state.Snapshot)
 	}
+	c.maintenance.Restore(state.MaintenanceWindows)
+	c.restoreMutex.Lock()
+	c.restored = state.Snapshot
+	c.restoreMutex.Unlock()
+	return true, nil
+}
+
+// Refresh fetches from Azure, unless a fetch is already in flight or its result still cached
+func (c *ResourceHealthCollector) Refresh(ctx context.Context) {
+	c.fetch(ctx)
 }
 
 // Describe to satisfy the collector interface.
@@ -34,76 +194,428 @@ func (c *ResourceHealthCollector) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect metrics from Resource Health API
 func (c *ResourceHealthCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectWithContext(context.Background(), ch)
+}
+
+// CollectWithContext collects metrics from Resource Health API, cancelling Azure API calls once ctx is done
+// Concurrent scrapes share a single fetch from Azure
+func (c *ResourceHealthCollector) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	snapshot, source := c.fetch(ctx)
+	if source != FetchSourceNew {
+		c.sharedScrapes.WithLabelValues(source).Inc()
+	}
+
+	var maintenanceWindows []*MaintenanceWindow
+	if c.maintenance.Enabled() {
+		maintenanceWindows = c.maintenance.ActiveWindows()
+	}
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		c.collectSubscription(ch, subscriptionSnapshot, maintenanceWindows)
+	}
+	for _, subscription := range c.subscriptions {
+		c.CollectCircuitBreakerState(ch, subscription)
+	}
+	c.states.Collect(ch)
+	c.CollectSLOs(ch, snapshot)
+	c.CollectServices(ch, snapshot)
+	c.CollectRollups(ch, snapshot)
+	c.CollectDependencies(ch, snapshot)
+
+	c.collectErrors.Collect(ch)
+	c.apiErrors.Collect(ch)
+	c.sharedScrapes.Collect(ch)
+
+	timedOut := 0.0
+	if snapshot.TimedOut {
+		timedOut = 1
+	}
+	ch <- prometheus.MustNewConstMetric(scrapeTimedOutDesc, prometheus.GaugeValue, timedOut)
+	ch <- prometheus.MustNewConstMetric(dataAgeDesc, prometheus.GaugeValue, c.now().Sub(snapshot.FetchedAt).Seconds())
+}
+
+// restoredSnapshot returns the snapshot restored from disk, nil once a fetch completed
+func (c *ResourceHealthCollector) restoredSnapshot() (*Snapshot, string) {
+	c.restoreMutex.Lock()
+	defer c.restoreMutex.Unlock()
+
+	return c.restored, FetchSourceRestored
+}
+
+// LatestSnapshot returns the snapshot of the latest fetch, or the restored one until a fetch completes,
+// without fetching from Azure. It returns nil before any.
+func (c *ResourceHealthCollector) LatestSnapshot() *Snapshot {
+	c.restoreMutex.Lock()
+	defer c.restoreMutex.Unlock()
+
+	if c.restored != nil {
+		return c.restored
+	}
+	return c.latest
+}
+
+// fetch returns a snapshot shared with the concurrent scrapes
+// Once ctx is done, the latest snapshot is returned as timed out, while the fetch goes on in the background.
+// Until a fetch completes, the restored snapshot is returned as timed out instead of the partial results of a fetch.
+func (c *ResourceHealthCollector) fetch(ctx context.Context) (*Snapshot, string) {
+	snapshot, source := c.fetches.Do(ctx, c.fetchAndTrack)
+	if snapshot != nil && !snapshot.TimedOut {
+		return snapshot, source
+	}
+	if restored, restoredSource := c.restoredSnapshot(); restored != nil {
+		log.Warn("Fetch not completed in time, exporting the restored results")
+		return &Snapshot{Subscriptions: restored.Subscriptions, FetchedAt: restored.FetchedAt, TimedOut: true}, restoredSource
+	}
+	if snapshot == nil {
+		log.Warn("Scrape timed out before the fetch completed, exporting the latest results")
+		snapshot = &Snapshot{TimedOut: true, FetchedAt: c.now()}
+		if latest := c.LatestSnapshot(); latest != nil {
+			snapshot.Subscriptions = latest.Subscriptions
+			snapshot.FetchedAt = latest.FetchedAt
+		}
+	}
+	return snapshot, source
+}
+
+// fetchAndTrack fetches from Azure. A complete snapshot becomes the latest one, and updates the tracked states
+// and service health events, whose changes are notified, and is saved to the store if any.
+// Partial snapshots of fetches which ran out of time are never tracked.
+func (c *ResourceHealthCollector) fetchAndTrack(ctx context.Context) *Snapshot {
+	snapshot := c.Fetch(ctx)
+	if snapshot.TimedOut {
+		return snapshot
+	}
+
+	c.trackMutex.Lock()
+	defer c.trackMutex.Unlock()
+	c.restoreMutex.Lock()
+	c.restored = nil
+	c.latest = snapshot
+	c.restoreMutex.Unlock()
+	c.track(snapshot)
+	return snapshot
+}
+
+// UpdateResources applies update to a copy of the resources of the latest snapshot, without fetching from Azure
+// update returns whether it changed a resource. The updated snapshot replaces the latest one, until the next fetch
+// reconciles it with Azure, and is tracked as a new snapshot. It returns the number of updated resources.
+func (c *ResourceHealthCollector) UpdateResources(update func(resource *MonitoredResource) bool) int {
+	c.trackMutex.Lock()
+	defer c.trackMutex.Unlock()
+
+	c.restoreMutex.Lock()
+	current, restored := c.restored, c.restored != nil
+	if !restored {
+		current = c.latest
+	}
+	c.restoreMutex.Unlock()
+	if current == nil {
+		return 0
+	}
+
+	updated := 0
+	snapshot := &Snapshot{TimedOut: current.TimedOut, FetchedAt: current.FetchedAt}
+	for _, subscriptionSnapshot := range current.Subscriptions {
+		// Snapshots are shared between scrapes, so the updated resources are copies
+		copied := *subscriptionSnapshot
+		copied.Resources = append([]MonitoredResource(nil), subscriptionSnapshot.Resources...)
+		subscriptionUpdated := false
+		for i := range copied.Resources {
+			if update(&copied.Resources[i]) {
+				subscriptionUpdated = true
+				updated++
+			}
+		}
+		if subscriptionUpdated {
+			subscriptionSnapshot = &copied
+		}
+		snapshot.Subscriptions = append(snapshot.Subscriptions, subscriptionSnapshot)
+	}
+	if updated == 0 {
+		return 0
+	}
+
+	c.restoreMutex.Lock()
+	if restored {
+		c.restored = snapshot
+	} else {
+		c.latest = snapshot
+	}
+	c.restoreMutex.Unlock()
+	c.fetches.replace(snapshot)
+	c.track(snapshot)
+	return updated
+}
+
+// track updates the tracked states and service health events with a new snapshot, notifies their changes,
+// and saves the snapshot to the store if any
+func (c *ResourceHealthCollector) track(snapshot *Snapshot) {
+	transitions := c.states.Update(snapshot)
+	updates := c.serviceHealth.Update(snapshot)
+	for _, notifier := range c.notifiers {
+		if len(transitions) > 0 {
+			notifier.Notify(transitions)
+		}
+		if serviceHealthNotifier, ok := notifier.(ServiceHealthNotifier); ok && len(updates) > 0 {
+			serviceHealthNotifier.NotifyServiceHealthEvents(updates)
+		}
+	}
+
+	if c.store != nil && !snapshot.TimedOut {
+		err := c.store.Save(&PersistedState{Snapshot: snapshot, States: c.states.States(), MaintenanceWindows: c.maintenance.Windows()})
+		if err != nil {
+			log.Errorf("Error saving state: %v", err)
+		}
+	}
+}
+
+// Fetch fetches the monitored resources of all subscriptions from Azure
+// Subscriptions are fetched in parallel in the worker pool.
+// Errors are isolated per subscription and per resource type, so that a failure
+// does not prevent the other resources from being exported. They are not isolated per configuration,
+// since the resources of all configurations are listed at once.
+func (c *ResourceHealthCollector) Fetch(ctx context.Context) *Snapshot {
+	snapshot := &Snapshot{
+		Subscriptions: make([]*SubscriptionSnapshot, len(c.subscriptions)),
+		FetchedAt:     c.now(),
+	}
+
+	var tasks []func()
+	for i, subscription := range c.subscriptions {
+		i, subscription := i, subscription
+		tasks = append(tasks, func() {
+			snapshot.Subscriptions[i] = c.fetchSubscription(ctx, subscription)
+		})
+	}
+	c.workers.Run(tasks)
+
+	if ctx.Err() != nil {
+		log.Warn("Fetch timed out, exporting partial results")
+		snapshot.TimedOut = true
+	}
+	return snapshot
+}
+
+// fetchSubscription streams the configured resources of a subscription, and then joins them
+// with the availability statuses as they are streamed, so that memory does not grow with the subscription size
+func (c *ResourceHealthCollector) fetchSubscription(ctx context.Context, subscription subscriptionClients) *SubscriptionSnapshot {
+	subscriptionID := subscription.resourceHealth.GetSubscriptionID()
+	snapshot := NewSubscriptionSnapshot(subscriptionID)
+
+	// All configured types are listed at once, and filtered by configuration locally
+	resourceTypes := config.ResourceTypes()
+	listedTypes := config.ListedResourceTypes()
+
+	typeSuccess := make(map[string]bool)
+	for _, resourceType := range resourceTypes {
+		typeSuccess[strings.ToLower(resourceType)] = true
+	}
+
+	var candidates []MonitoredResource
+	index := make(ResourceIndex)
+	err := subscription.resources.ForEachResource(ctx, listedTypes, func(resource *resources.GenericResource) error {
+		labels, ok, err := monitoredResourceLabels(subscriptionID, resource)
+		if !ok {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("Failed to parse resource ID: %v", err)
+			typeSuccess[strings.ToLower(*resource.Type)] = false
+			return nil
+		}
+
+		index.Add(*resource.ID, len(candidates))
+		candidates = append(candidates, MonitoredResource{
+			Resource: *resource,
+			Labels:   labels,
+		})
+		return nil
+	})
+	if err != nil {
+		// Availability statuses are not fetched, to spare the very low resource health API rate limit
+		log.Errorf("Failed to get resource list in subscription %s: %v", subscriptionID, err)
+		c.countAPIError(ResourcesAPI, subscriptionID, err)
+		for _, resourceType := range resourceTypes {
+			c.setTypeResult(snapshot, resourceType, false)
+		}
+		return snapshot
+	}
+
+	if config.Dependencies.Infer && len(candidates) > 0 {
+		c.fetchProperties(ctx, subscription, snapshot, resourceTypes, candidates, index)
+	}
 
 	// In order to avoid the very low resource health API rate limit,
-	// all availability statuses are fetched in 1 query and then parsed to lookup configured resources
-	asList, err := c.resourceHealth.GetAllAvailabilityStatuses()
+	// all availability statuses are fetched in 1 query and then joined with configured resources
+	expand := ""
+	if config.ExposeRecommendedActions {
+		expand = ExpandRecommendedActions
+	}
+	err = subscription.resourceHealth.ForEachAvailabilityStatus(ctx, expand, func(as *resourcehealth.AvailabilityStatus) error {
+		if position, ok := index.LookupAvailabilityStatus(as); ok && candidates[position].AvailabilityStatus.ID == nil {
+			candidates[position].AvailabilityStatus = *as
+		}
+		return nil
+	})
 	if err != nil {
-		log.Errorf("Failed to get all availability status: %v", err)
-		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-		return
+		log.Errorf("Failed to get all availability status of subscription %s: %v", subscriptionID, err)
+		c.countAPIError(ResourceHealthAPI, subscriptionID, err)
+		c.setTypeResult(snapshot, AvailabilityStatusesResourceType, false)
+		return snapshot
 	}
+	c.setTypeResult(snapshot, AvailabilityStatusesResourceType, true)
+	snapshot.RateLimitRemaining = subscription.resourceHealth.GetLastRatelimitRemaining()
 
-	for _, resourceConfiguration := range config.ResourceConfigurations {
-		for _, resourceType := range resourceConfiguration.ResourceTypes {
-			resourceList, err := c.resources.GetResources(resourceType, resourceConfiguration.ResourceTags)
-			if err != nil {
-				log.Errorf("Failed to get resource list: %v", err)
-				ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-				return
-			}
+	// Resources without availability status are not supported by Resource Health
+	for _, candidate := range candidates {
+		if candidate.AvailabilityStatus.ID != nil {
+			snapshot.Resources = append(snapshot.Resources, candidate)
+		}
+	}
+
+	for _, resourceType := range resourceTypes {
+		c.setTypeResult(snapshot, resourceType, typeSuccess[strings.ToLower(resourceType)])
+	}
+
+	c.fetchChildren(ctx, subscription, snapshot)
+	snapshot.RateLimitRemaining = subscription.resourceHealth.GetLastRatelimitRemaining()
+
+	return snapshot
+}
+
+// monitoredResourceLabels returns the labels identifying a configured resource in metrics,
+// false if the resource is not part of any configuration
+func monitoredResourceLabels(subscriptionID string, resource *resources.GenericResource) (map[string]string, bool, error) {
+	configurationLabels, ok := matchResourceConfigurations(resource)
+	if !ok {
+		return nil, false, nil
+	}
+
+	labels, err := ParseResourceID(*resource.ID)
+	if err != nil {
+		return nil, true, err
+	}
+	labels["subscription_id"] = subscriptionID
+	labels["resource_type"] = *resource.Type
+	for name, value := range configurationLabels {
+		if _, ok := labels[name]; !ok {
+			labels[name] = value
+		}
+	}
+	return labels, true, nil
+}
 
-			for _, resource := range *resourceList {
-				for _, as := range *asList {
-					if strings.ToLower(*as.ID) == strings.ToLower(*resource.ID+AvailabilityStatusIDSuffix) {
-						c.CollectAvailabilityUp(ch, &as, &resource)
-					}
-				}
+// matchResourceConfigurations returns whether a resource is selected by any configuration,
+// along with the union of the labels of the matching configurations, the first configuration winning on conflicts
+func matchResourceConfigurations(resource *resources.GenericResource) (map[string]string, bool) {
+	var labels map[string]string
+	matched := false
+	for i := range config.ResourceConfigurations {
+		if !config.ResourceConfigurations[i].Matches(resource) {
+			continue
+		}
+		if !matched {
+			labels = make(map[string]string)
+			matched = true
+		}
+		for name, value := range config.ResourceConfigurations[i].Labels {
+			name = invalidLabelChars.ReplaceAllString(name, "_")
+			if _, ok := labels[name]; !ok {
+				labels[name] = value
 			}
 		}
 	}
+	return labels, matched
+}
+
+// setTypeResult records the collect result of a resource type and counts the failures
+func (c *ResourceHealthCollector) setTypeResult(snapshot *SubscriptionSnapshot, resourceType string, success bool) {
+	if !success {
+		c.collectErrors.WithLabelValues(snapshot.SubscriptionID, resourceType).Inc()
+	}
+	snapshot.SetTypeResult(resourceType, success)
+}
+
+// countAPIError counts an Azure API error by its class
+func (c *ResourceHealthCollector) countAPIError(api string, subscriptionID string, err error) {
+	c.apiErrors.WithLabelValues(api, subscriptionID, ClassifyAzureError(err)).Inc()
+}
+
+func (c *ResourceHealthCollector) collectSubscription(ch chan<- prometheus.Metric, snapshot *SubscriptionSnapshot, maintenanceWindows []*MaintenanceWindow) {
+	for _, resourceType := range snapshot.ResourceTypes {
+		success := 0.0
+		if snapshot.TypeSuccess[resourceType] {
+			success = 1
+		}
+		ch <- prometheus.MustNewConstMetric(collectSuccessDesc, prometheus.GaugeValue, success, snapshot.SubscriptionID, resourceType)
+	}
+
+	for i := range snapshot.Resources {
+		c.CollectAvailabilityUp(ch, &snapshot.Resources[i], maintenanceWindows)
+		c.CollectChildAvailability(ch, &snapshot.Resources[i])
+		if config.ExposeRecommendedActions {
+			c.CollectRecommendedActions(ch, &snapshot.Resources[i])
+		}
+	}
 
-	c.CollectRateLimitRemaining(ch)
+	c.CollectRateLimitRemaining(ch, snapshot)
 }
 
 // CollectAvailabilityUp converts Resource Health Availability status as an UP metric
-func (c *ResourceHealthCollector) CollectAvailabilityUp(ch chan<- prometheus.Metric, as *resourcehealth.AvailabilityStatus,
-	resource *resources.GenericResource) {
+// When maintenance is enabled, the metric is flagged by an in_maintenance label.
+func (c *ResourceHealthCollector) CollectAvailabilityUp(ch chan<- prometheus.Metric, resource *MonitoredResource, maintenanceWindows []*MaintenanceWindow) {
 
 	// Only the `Unavailable` status can be used with confidence to consider availability "down"
 	up := 1.0
-	if as.Properties.AvailabilityState == resourcehealth.Unavailable {
+	if resource.AvailabilityStatus.Properties.AvailabilityState == resourcehealth.Unavailable {
 		up = 0
 	}
 
-	labels, err := ParseResourceID(*resource.ID)
-	if err != nil {
-		log.Errorf("Failed to parse resource ID: %v", err)
-		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-		return
+	// With hysteresis, the exported availability only changes once the new state has settled
+	if hysteresis := resourceHysteresis(resource); hysteresis != nil {
+		if exported, flapping, ok := c.states.ExportedState(resource); ok {
+			collectHysteresis(ch, resource, hysteresis, up, flapping)
+			up = 1
+			if exported == string(resourcehealth.Unavailable) {
+				up = 0
+			}
+		}
 	}
 
-	labels["subscription_id"] = c.resourceHealth.GetSubscriptionID()
-	labels["resource_type"] = *resource.Type
+	// Snapshots are shared between scrapes, so their labels must not be modified
+	labels := copyLabels(resource.Labels)
+	availabilityLabels := labels
+	if c.maintenance.Enabled() {
+		availabilityLabels = copyLabels(labels)
+		availabilityLabels["in_maintenance"] = "false"
+		if InMaintenance(resource, maintenanceWindows) != nil {
+			availabilityLabels["in_maintenance"] = "true"
+			if config.Maintenance.TreatAsAvailable {
+				up = 1
+			}
+		}
+	}
 
 	ch <- prometheus.MustNewConstMetric(
-		prometheus.NewDesc("azure_resource_health_availability_up", "Resource health availability that relies on signals from different Azure services to assess whether a resource is healthy", nil, labels),
+		prometheus.NewDesc("azure_resource_health_availability_up", "Resource health availability that relies on signals from different Azure services to assess whether a resource is healthy", nil, availabilityLabels),
 		prometheus.GaugeValue,
 		up,
 	)
 
 	if config.ExposeAzureTagInfo {
-		ExportAzureTagInfo(ch, resource.Tags, resource.Type, labels)
+		ExportAzureTagInfo(ch, resource.Resource.Tags, resource.Resource.Type, labels)
 	}
 }
 
 // CollectRateLimitRemaining converts X-Ms-Ratelimit-Remaining-Subscription-Resource-Requests header as metric
-func (c *ResourceHealthCollector) CollectRateLimitRemaining(ch chan<- prometheus.Metric) {
+func (c *ResourceHealthCollector) CollectRateLimitRemaining(ch chan<- prometheus.Metric, snapshot *SubscriptionSnapshot) {
+	if snapshot.RateLimitRemaining == "" {
+		return
+	}
 
 	labels := make(map[string]string)
-	labels["subscription_id"] = c.resourceHealth.GetSubscriptionID()
+	labels["subscription_id"] = snapshot.SubscriptionID
 
-	ratelimitRemaining, err := strconv.ParseFloat(c.resourceHealth.GetLastRatelimitRemaining(), 64)
+	ratelimitRemaining, err := strconv.ParseFloat(snapshot.RateLimitRemaining, 64)
 	if err != nil {
 		log.Errorf("Failed to parse ratelimit remaining: %v", err)
 		return
@@ -116,3 +628,17 @@ func (c *ResourceHealthCollector) CollectRateLimitRemaining(ch chan<- prometheus
 	)
 
 }
+
+// CollectCircuitBreakerState exports the state of the subscription circuit breaker
+func (c *ResourceHealthCollector) CollectCircuitBreakerState(ch chan<- prometheus.Metric, subscription subscriptionClients) {
+	if subscription.circuitBreaker == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		circuitBreakerStateDesc,
+		prometheus.GaugeValue,
+		float64(subscription.circuitBreaker.State()),
+		subscription.resourceHealth.GetSubscriptionID(),
+	)
+}
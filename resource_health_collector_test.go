@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
@@ -21,14 +27,48 @@ type MockedResources struct {
 	mock.Mock
 }
 
-func (mock *MockedResourceHealth) GetAvailabilityStatus(resourceURI string) (*resourcehealth.AvailabilityStatus, error) {
+func (mock *MockedResourceHealth) GetAvailabilityStatus(ctx context.Context, resourceURI string) (*resourcehealth.AvailabilityStatus, error) {
 	args := mock.Called(resourceURI)
 	return args.Get(0).(*resourcehealth.AvailabilityStatus), args.Error(1)
 }
 
-func (mock *MockedResourceHealth) GetAllAvailabilityStatuses() (*[]resourcehealth.AvailabilityStatus, error) {
-	args := mock.Called()
-	return args.Get(0).(*[]resourcehealth.AvailabilityStatus), args.Error(1)
+func (mock *MockedResourceHealth) ForEachAvailabilityStatus(ctx context.Context, expand string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	args := mock.Called(expand)
+	if err := args.Error(1); err != nil {
+		return err
+	}
+	for _, as := range *args.Get(0).(*[]resourcehealth.AvailabilityStatus) {
+		if err := fn(&as); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mock *MockedResourceHealth) ForEachAvailabilityStatusHistory(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	args := mock.Called(resourceURI)
+	if err := args.Error(1); err != nil {
+		return err
+	}
+	for _, as := range *args.Get(0).(*[]resourcehealth.AvailabilityStatus) {
+		if err := fn(&as); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mock *MockedResourceHealth) ForEachChildAvailabilityStatus(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	args := mock.Called(resourceURI)
+	if err := args.Error(1); err != nil {
+		return err
+	}
+	for _, as := range *args.Get(0).(*[]resourcehealth.AvailabilityStatus) {
+		if err := fn(&as); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (mock *MockedResourceHealth) GetSubscriptionID() string {
@@ -41,17 +81,110 @@ func (mock *MockedResourceHealth) GetLastRatelimitRemaining() string {
 	return args.Get(0).(string)
 }
 
-func (mock *MockedResources) GetResources(resourceType string, resourceTags map[string]string) (*[]resources.GenericResource, error) {
-	args := mock.Called(resourceType, resourceTags)
-	return args.Get(0).(*[]resources.GenericResource), args.Error(1)
+func (mock *MockedResources) ForEachResource(ctx context.Context, resourceTypes []string, fn func(*resources.GenericResource) error) error {
+	args := mock.Called(resourceTypes)
+	if err := args.Error(1); err != nil {
+		return err
+	}
+	for _, resource := range *args.Get(0).(*[]resources.GenericResource) {
+		if err := fn(&resource); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func CallExporter(collector ResourceHealthCollector) *httptest.ResponseRecorder {
+func (mock *MockedResources) ForEachResourceProperties(ctx context.Context, resourceTypes []string, fn func(resourceID string, properties interface{}) error) error {
+	args := mock.Called(resourceTypes)
+	if err := args.Error(1); err != nil {
+		return err
+	}
+	for resourceID, properties := range args.Get(0).(map[string]interface{}) {
+		if err := fn(resourceID, properties); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syntheticResourceHealth streams count availability statuses out of a fixed set, without mock overhead
+type syntheticResourceHealth struct {
+	asList []resourcehealth.AvailabilityStatus
+	count  int
+}
+
+func (s *syntheticResourceHealth) GetAvailabilityStatus(ctx context.Context, resourceURI string) (*resourcehealth.AvailabilityStatus, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (s *syntheticResourceHealth) ForEachAvailabilityStatus(ctx context.Context, expand string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	for i := 0; i < s.count; i++ {
+		if err := fn(&s.asList[i%len(s.asList)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syntheticResourceHealth) ForEachAvailabilityStatusHistory(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	return errors.New("Not implemented")
+}
+
+func (s *syntheticResourceHealth) ForEachChildAvailabilityStatus(ctx context.Context, resourceURI string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	return errors.New("Not implemented")
+}
+
+func (s *syntheticResourceHealth) GetSubscriptionID() string {
+	return "my_subscription"
+}
+
+func (s *syntheticResourceHealth) GetLastRatelimitRemaining() string {
+	return "99"
+}
+
+// syntheticResources streams count resources out of a fixed set, without mock overhead
+type syntheticResources struct {
+	resourceList []resources.GenericResource
+	count        int
+}
+
+func (s *syntheticResources) ForEachResource(ctx context.Context, resourceTypes []string, fn func(*resources.GenericResource) error) error {
+	for i := 0; i < s.count; i++ {
+		if err := fn(&s.resourceList[i%len(s.resourceList)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syntheticResources) ForEachResourceProperties(ctx context.Context, resourceTypes []string, fn func(resourceID string, properties interface{}) error) error {
+	return nil
+}
+
+func NewMockedCollector(rh *MockedResourceHealth, r *MockedResources) *ResourceHealthCollector {
+	return newResourceHealthCollector([]subscriptionClients{
+		subscriptionClients{
+			resourceHealth: rh,
+			resources:      r,
+		},
+	})
+}
+
+func CallExporter(collector *ResourceHealthCollector) *httptest.ResponseRecorder {
 	loadConfig("config/config_example.yml")
+	return callCollector(collector)
+}
+
+func CallExporterWithConfig(collector *ResourceHealthCollector, configContent string) *httptest.ResponseRecorder {
+	loadConfigContent([]byte(configContent))
+	return callCollector(collector)
+}
+
+func callCollector(collector *ResourceHealthCollector) *httptest.ResponseRecorder {
 	req := httptest.NewRequest("GET", "/metrics", nil)
 	rr := httptest.NewRecorder()
 	registry := prometheus.NewRegistry()
-	registry.MustRegister(&collector)
+	registry.MustRegister(collector)
 	handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	handler.ServeHTTP(rr, req)
 	return rr
@@ -65,34 +198,116 @@ func TestNewResourceHealthCollector_OK(t *testing.T) {
 	_ = NewResourceHealthCollector(session)
 }
 
-func TestCollect_GetResources_Error(t *testing.T) {
+func TestNewResourceHealthCollector_Subscriptions(t *testing.T) {
+	session1, _ := NewAzureSession("subscription1")
+	session2, _ := NewAzureSession("subscription2")
+	collector := NewResourceHealthCollector(session1, session2)
+
+	if len(collector.subscriptions) != 2 {
+		t.Errorf("Unexpected subscription count: got %v, want %v", len(collector.subscriptions), 2)
+	}
+}
+
+func TestCollect_ForEachResource_Error(t *testing.T) {
 	r := MockedResources{}
 	rh := MockedResourceHealth{}
-	collector := ResourceHealthCollector{
-		resourceHealth: &rh,
-		resources:      &r,
-	}
+	collector := NewMockedCollector(&rh, &r)
 
 	var asList []resourcehealth.AvailabilityStatus
-	rh.On("GetAllAvailabilityStatuses").Return(&asList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
 
 	var resList []resources.GenericResource
-	r.On("GetResources", mock.Anything, mock.Anything).Return(&resList, errors.New("Unit test Error"))
+	r.On("ForEachResource", mock.Anything).Return(&resList, errors.New("Unit test Error"))
 
 	rr := CallExporter(collector)
-	if status := rr.Code; status != http.StatusInternalServerError {
-		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusInternalServerError)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
+	}
+
+	for _, want := range []string{
+		`azure_health_exporter_api_errors_total{api="resources",class="other",subscription_id="my_subscription"} 1`,
+		`azure_health_exporter_collect_errors_total{resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1`,
+		`azure_health_exporter_collect_success{resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 0`,
+		`azure_health_exporter_collect_success{resource_type="Microsoft.Web/serverfarms",subscription_id="my_subscription"} 0`,
+		`azure_health_exporter_collect_success{resource_type="Microsoft.Web/sites",subscription_id="my_subscription"} 0`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing metric: want %v in %v", want, rr.Body.String())
+		}
 	}
+
+	// Availability statuses are not fetched, to spare the Resource Health rate limit
+	rh.AssertNotCalled(t, "ForEachAvailabilityStatus")
 }
 
-func TestCollect_GetAllAvailabilityStatuses_Error(t *testing.T) {
+func TestCollect_ForEachResource_Batched(t *testing.T) {
 	r := MockedResources{}
 	rh := MockedResourceHealth{}
-	collector := ResourceHealthCollector{
-		resourceHealth: &rh,
-		resources:      &r,
+	collector := NewMockedCollector(&rh, &r)
+
+	var asList []resourcehealth.AvailabilityStatus
+	asID := "/subscriptions/my_subscription/resourcegroups/my_rg/providers/microsoft.web/sites/my_site" + AvailabilityStatusIDSuffix
+	asList = append(asList, resourcehealth.AvailabilityStatus{
+		ID: &asID,
+		Properties: &resourcehealth.AvailabilityStatusProperties{
+			AvailabilityState: resourcehealth.Available,
+		},
+	})
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	var resList []resources.GenericResource
+	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Web/sites/my_site"
+	resourceType := "Microsoft.Web/sites"
+	client := "Alice"
+	env := "Prod"
+	resList = append(resList, resources.GenericResource{
+		ID:   &resourceID,
+		Type: &resourceType,
+		Tags: map[string]*string{"Client": &client, "Env": &env},
+	})
+	r.On("ForEachResource", []string{"Microsoft.Web/sites", "Microsoft.Web/serverfarms"}).Return(&resList, nil).Once()
+
+	// Both configurations match the site, which must be exported once with the labels of both
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Client: "Alice"
+    resource_types:
+      - "Microsoft.Web/sites"
+    labels:
+      team: "web"
+  - resource_tags:
+      Env: "Prod"
+    resource_types:
+      - "Microsoft.Web/sites"
+      - "Microsoft.Web/serverfarms"
+    labels:
+      team: "ops"
+      tier: "production"
+`)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
+	r.AssertExpectations(t)
+	want := `azure_resource_health_availability_up{resource_group="my_rg",resource_name="my_site",resource_type="Microsoft.Web/sites",subscription_id="my_subscription",team="web",tier="production"} 1`
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Missing metric: want %v in %v", want, rr.Body.String())
+	}
+	if count := strings.Count(rr.Body.String(), "azure_resource_health_availability_up{"); count != 1 {
+		t.Errorf("Unexpected availability up count: got %v, want %v", count, 1)
+	}
+}
+
+func TestCollect_ForEachAvailabilityStatus_Error(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
 	var resList []resources.GenericResource
 	resourceID := "id"
 	resourceType := "type"
@@ -100,37 +315,39 @@ func TestCollect_GetAllAvailabilityStatuses_Error(t *testing.T) {
 		ID:   &resourceID,
 		Type: &resourceType,
 	})
-	r.On("GetResources", mock.Anything, mock.Anything).Return(&resList, nil)
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
 
 	var asList []resourcehealth.AvailabilityStatus
-	rh.On("GetAllAvailabilityStatuses", mock.Anything).Return(&asList, errors.New("Unit test Error"))
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, errors.New("Unit test Error"))
+	rh.On("GetSubscriptionID").Return("my_subscription")
 
 	rr := CallExporter(collector)
 
-	if status := rr.Code; status != http.StatusInternalServerError {
-		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusInternalServerError)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
+	}
+
+	want := `azure_health_exporter_collect_success{resource_type="Microsoft.ResourceHealth/availabilityStatuses",subscription_id="my_subscription"} 0`
+	if !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Missing metric: want %v in %v", want, rr.Body.String())
 	}
 }
 
 func TestCollect_Collect_Ok(t *testing.T) {
 	r := MockedResources{}
 	rh := MockedResourceHealth{}
-	collector := ResourceHealthCollector{
-		resourceHealth: &rh,
-		resources:      &r,
-	}
+	collector := NewMockedCollector(&rh, &r)
 
 	var resList []resources.GenericResource
 	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
 	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
 	resList = append(resList, resources.GenericResource{
 		ID:   &resourceID,
 		Type: &resourceType,
+		Tags: map[string]*string{"Monitoring": &monitoring},
 	})
-	r.On("GetResources", "Microsoft.Compute/virtualMachines", mock.Anything).Return(&resList, nil)
-	var emptyList []resources.GenericResource
-	r.On("GetResources", "Microsoft.Web/serverfarms", mock.Anything).Return(&emptyList, nil)
-	r.On("GetResources", "Microsoft.Web/sites", mock.Anything).Return(&emptyList, nil)
+	r.On("ForEachResource", []string{"Microsoft.Compute/virtualMachines", "Microsoft.Web/serverfarms", "Microsoft.Web/sites"}).Return(&resList, nil)
 
 	var asList []resourcehealth.AvailabilityStatus
 	asID1 := "/subscriptions/my_subscription/resourcegroups/my_rg/providers/microsoft.compute/virtualmachines/my_instance" + AvailabilityStatusIDSuffix
@@ -147,9 +364,11 @@ func TestCollect_Collect_Ok(t *testing.T) {
 			AvailabilityState: resourcehealth.Unavailable,
 		},
 	})
-	rh.On("GetAllAvailabilityStatuses", mock.Anything).Return(&asList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
 	rh.On("GetSubscriptionID").Return("my_subscription")
 	rh.On("GetLastRatelimitRemaining").Return("99")
+	collector.now = func() time.Time { return time.Unix(1500000000, 0) }
+	collector.states.now = collector.now
 
 	rr := CallExporter(collector)
 
@@ -157,17 +376,202 @@ func TestCollect_Collect_Ok(t *testing.T) {
 		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
 	}
 
-	want := `# HELP azure_resource_health_availability_up Resource health availability that relies on signals from different Azure services to assess whether a resource is healthy
+	want := `# HELP azure_health_exporter_collect_success Whether the last collection of a resource type succeeded in a subscription
+# TYPE azure_health_exporter_collect_success gauge
+azure_health_exporter_collect_success{resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1
+azure_health_exporter_collect_success{resource_type="Microsoft.ResourceHealth/availabilityStatuses",subscription_id="my_subscription"} 1
+azure_health_exporter_collect_success{resource_type="Microsoft.Web/serverfarms",subscription_id="my_subscription"} 1
+azure_health_exporter_collect_success{resource_type="Microsoft.Web/sites",subscription_id="my_subscription"} 1
+# HELP azure_health_exporter_data_age_seconds Age of the exported data, which is restored from disk until the first Azure fetch completes
+# TYPE azure_health_exporter_data_age_seconds gauge
+azure_health_exporter_data_age_seconds 0
+# HELP azure_health_exporter_scrape_timed_out Whether the last scrape ran out of time, exporting partial results
+# TYPE azure_health_exporter_scrape_timed_out gauge
+azure_health_exporter_scrape_timed_out 0
+# HELP azure_resource_health_availability_up Resource health availability that relies on signals from different Azure services to assess whether a resource is healthy
 # TYPE azure_resource_health_availability_up gauge
 azure_resource_health_availability_up{resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 0
+# HELP azure_resource_health_current_state_since_timestamp Timestamp at which the resource entered its current availability state
+# TYPE azure_resource_health_current_state_since_timestamp gauge
+azure_resource_health_current_state_since_timestamp{resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1.5e+09
 # HELP azure_resource_health_ratelimit_remaining_requests Azure subscription scoped Resource Health requests remaining (based on X-Ms-Ratelimit-Remaining-Subscription-Resource-Requests header)
 # TYPE azure_resource_health_ratelimit_remaining_requests gauge
 azure_resource_health_ratelimit_remaining_requests{subscription_id="my_subscription"} 99
+# HELP azure_resource_health_resources_by_location Number of monitored resources in each availability state, per location
+# TYPE azure_resource_health_resources_by_location gauge
+azure_resource_health_resources_by_location{location="",state="Available"} 0
+azure_resource_health_resources_by_location{location="",state="Unavailable"} 1
+azure_resource_health_resources_by_location{location="",state="Unknown"} 0
+# HELP azure_resource_health_resources_by_resource_group Number of monitored resources in each availability state, per resource group
+# TYPE azure_resource_health_resources_by_resource_group gauge
+azure_resource_health_resources_by_resource_group{resource_group="my_rg",state="Available",subscription_id="my_subscription"} 0
+azure_resource_health_resources_by_resource_group{resource_group="my_rg",state="Unavailable",subscription_id="my_subscription"} 1
+azure_resource_health_resources_by_resource_group{resource_group="my_rg",state="Unknown",subscription_id="my_subscription"} 0
+# HELP azure_resource_health_resources_by_resource_type Number of monitored resources in each availability state, per resource type
+# TYPE azure_resource_health_resources_by_resource_type gauge
+azure_resource_health_resources_by_resource_type{resource_type="Microsoft.Compute/virtualMachines",state="Available"} 0
+azure_resource_health_resources_by_resource_type{resource_type="Microsoft.Compute/virtualMachines",state="Unavailable"} 1
+azure_resource_health_resources_by_resource_type{resource_type="Microsoft.Compute/virtualMachines",state="Unknown"} 0
 # HELP azure_tag_info Tags of the Azure resource
 # TYPE azure_tag_info gauge
-azure_tag_info{resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription"} 1
+azure_tag_info{resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",subscription_id="my_subscription",tag_monitoring="enabled"} 1
 `
 	if rr.Body.String() != want {
 		t.Errorf("Unexpected body: got %v, want %v", rr.Body.String(), want)
 	}
 }
+
+// stallingResourceHealth blocks on listing availability statuses until its context is done while stalled
+type stallingResourceHealth struct {
+	syntheticResourceHealth
+	stalled int32
+}
+
+func (s *stallingResourceHealth) ForEachAvailabilityStatus(ctx context.Context, expand string, fn func(*resourcehealth.AvailabilityStatus) error) error {
+	if atomic.LoadInt32(&s.stalled) == 1 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.syntheticResourceHealth.ForEachAvailabilityStatus(ctx, expand, fn)
+}
+
+func TestCollect_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-health-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fetched := benchmarkSyntheticCollector(10).WithStore(NewStore(dir))
+	fetched.Refresh(context.Background())
+
+	resourceList, asList := syntheticSubscription(1)
+	rh := &stallingResourceHealth{syntheticResourceHealth: syntheticResourceHealth{asList: asList, count: 1}, stalled: 1}
+	collector := newResourceHealthCollector([]subscriptionClients{
+		{resourceHealth: rh, resources: &syntheticResources{resourceList: resourceList, count: 1}},
+	}).WithStore(NewStore(dir)).WithFetchTimeout(50 * time.Millisecond)
+	restored, err := collector.Restore()
+	if err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+	if !restored {
+		t.Fatal("State not restored")
+	}
+
+	// The first fetch times out, so that the restored state is served, as timed out
+	collector.Refresh(context.Background())
+	rr := CallExporter(collector)
+	for _, want := range []string{
+		`azure_health_exporter_shared_fetch_scrapes_total{source="restored"} 1`,
+		`azure_health_exporter_scrape_timed_out 1`,
+		`azure_resource_health_availability_up{resource_group="my_rg_9",resource_name="my_instance_9"`,
+		`azure_resource_health_current_state_since_timestamp{resource_group="my_rg_0",resource_name="my_instance_0"`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+
+	// The following scrapes keep fetching, until a fetch completes and replaces the restored state
+	atomic.StoreInt32(&rh.stalled, 0)
+	rr = CallExporter(collector)
+	for _, want := range []string{
+		`azure_health_exporter_scrape_timed_out 0`,
+		`azure_resource_health_availability_up{resource_group="my_rg_0",resource_name="my_instance_0"`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+	if strings.Contains(rr.Body.String(), `resource_name="my_instance_9"`) {
+		t.Errorf("The restored state is still served: %v", rr.Body.String())
+	}
+}
+
+func benchmarkSyntheticCollector(count int) *ResourceHealthCollector {
+	loadConfig("config/config_example.yml")
+	resourceList, asList := syntheticSubscription(count)
+	return newResourceHealthCollector([]subscriptionClients{
+		subscriptionClients{
+			resourceHealth: &syntheticResourceHealth{asList: asList, count: count},
+			resources:      &syntheticResources{resourceList: resourceList, count: count},
+		},
+	})
+}
+
+func BenchmarkFetch_100k(b *testing.B) {
+	collector := benchmarkSyntheticCollector(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		collector.Fetch(context.Background())
+	}
+}
+
+func BenchmarkCollect_100k(b *testing.B) {
+	collector := benchmarkSyntheticCollector(100000)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := registry.Gather(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestFetch_ParallelSubscriptions(t *testing.T) {
+	loadConfig("config/config_example.yml")
+	var subscriptions []subscriptionClients
+	for _, subscriptionID := range []string{"subscription1", "subscription2", "subscription3"} {
+		rh := MockedResourceHealth{}
+		r := MockedResources{}
+		rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{}, nil)
+		rh.On("GetSubscriptionID").Return(subscriptionID)
+		rh.On("GetLastRatelimitRemaining").Return("99")
+		r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{}, nil)
+		subscriptions = append(subscriptions, subscriptionClients{resourceHealth: &rh, resources: &r})
+	}
+	collector := newResourceHealthCollector(subscriptions).WithWorkers(4)
+
+	snapshot := collector.Fetch(context.Background())
+
+	for i, subscriptionID := range []string{"subscription1", "subscription2", "subscription3"} {
+		if snapshot.Subscriptions[i].SubscriptionID != subscriptionID {
+			t.Errorf("Unexpected subscription: got %v, want %v", snapshot.Subscriptions[i].SubscriptionID, subscriptionID)
+		}
+		if !snapshot.Subscriptions[i].TypeSuccess[AvailabilityStatusesResourceType] {
+			t.Errorf("Unexpected failure of subscription %v", subscriptionID)
+		}
+	}
+}
+
+// Fetching must not allocate more while streaming more availability statuses
+func TestFetch_BoundedAllocations(t *testing.T) {
+	loadConfig("config/config_example.yml")
+	resourceList, asList := syntheticSubscription(1000)
+	for i := 10; i < len(resourceList); i++ {
+		resourceList[i].Tags = nil
+	}
+
+	allocs := func(count int) float64 {
+		collector := newResourceHealthCollector([]subscriptionClients{
+			subscriptionClients{
+				resourceHealth: &syntheticResourceHealth{asList: asList, count: count},
+				resources:      &syntheticResources{resourceList: resourceList, count: len(resourceList)},
+			},
+		})
+		return testing.AllocsPerRun(3, func() {
+			snapshot := collector.Fetch(context.Background())
+			if len(snapshot.Subscriptions[0].Resources) != 10 {
+				t.Fatalf("Unexpected resource count: got %v, want %v", len(snapshot.Subscriptions[0].Resources), 10)
+			}
+		})
+	}
+
+	small, large := allocs(10000), allocs(100000)
+	if large > small+10 {
+		t.Errorf("Allocations grow with availability statuses: got %v for 100k, %v for 10k", large, small)
+	}
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/go-autorest/autorest"
 )
 
 func TestNewResourceHealth_OK(t *testing.T) {
@@ -17,3 +24,70 @@ func TestNewResourceHealth_OK(t *testing.T) {
 		t.Errorf("Unexpected SubscriptionID; got: %v, want: %v", applicationGateways.GetSubscriptionID(), want)
 	}
 }
+
+// pagedSender answers requests with pages of a single item, the first ones linking to a next page,
+// failing like an HTTP client once the request context is done
+func pagedSender(item string) (autorest.Sender, *int) {
+	requests := 0
+	return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		if err := r.Context().Err(); err != nil {
+			return nil, err
+		}
+		requests++
+		rr := httptest.NewRecorder()
+		rr.Header().Set("Content-Type", "application/json")
+		nextLink := ""
+		if requests < 3 {
+			nextLink = fmt.Sprintf("https://management.azure.com/next?page=%d", requests+1)
+		}
+		fmt.Fprintf(rr, `{"value": [%s], "nextLink": "%s"}`, item, nextLink)
+		resp := rr.Result()
+		resp.Request = r
+		return resp, nil
+	}), &requests
+}
+
+func TestResourceHealthClient_ForEachAvailabilityStatus_Canceled(t *testing.T) {
+	sender, requests := pagedSender(`{"id": "/subscriptions/my_subscription/providers/Microsoft.ResourceHealth/availabilityStatuses/current", "properties": {"availabilityState": "Available"}}`)
+	client := NewResourceHealth(&AzureSession{SubscriptionID: "my_subscription", Authorizer: autorest.NullAuthorizer{}, Sender: sender})
+
+	// The following pages are not requested once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := client.ForEachAvailabilityStatus(ctx, "", func(as *resourcehealth.AvailabilityStatus) error {
+		cancel()
+		return nil
+	})
+	if err == nil {
+		t.Errorf("Want an error, got none")
+	}
+	if *requests != 1 {
+		t.Errorf("Unexpected requests: got %v, want %v", *requests, 1)
+	}
+}
+
+func TestResourceHealthClient_ForEachAvailabilityStatus_Expand(t *testing.T) {
+	for _, expand := range []string{ExpandRecommendedActions, ""} {
+		var got []string
+		sender := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			got = append(got, r.URL.Query().Get("$expand"))
+			rr := httptest.NewRecorder()
+			rr.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(rr, `{"value": []}`)
+			resp := rr.Result()
+			resp.Request = r
+			return resp, nil
+		})
+		client := NewResourceHealth(&AzureSession{SubscriptionID: "my_subscription", Authorizer: autorest.NullAuthorizer{}, Sender: sender})
+
+		err := client.ForEachAvailabilityStatus(context.Background(), expand, func(as *resourcehealth.AvailabilityStatus) error {
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if len(got) != 1 || got[0] != expand {
+			t.Errorf("Unexpected $expand: got %v, want %q", got, expand)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/prometheus/common/log"
+)
+
+// ResourceHistory is the availability history of a configured resource, as kept by Resource Health
+type ResourceHistory struct {
+	ResourceID string
+	Resource   resources.GenericResource
+	// Labels identify the resource in metrics
+	Labels map[string]string
+	// States are the availability states entered by the resource, oldest first
+	States []HistoricalState
+}
+
+// HistoricalState is an availability state entered by a resource
+type HistoricalState struct {
+	Occurred   time.Time
+	State      string
+	ReasonType string
+	Summary    string
+}
+
+// forEachResourceHistory streams the history of the configured resources of a subscription accepted by selector,
+// nil accepting all of them. A failed subscription or resource is skipped, and the number of failures returned.
+func forEachResourceHistory(ctx context.Context, subscription subscriptionClients, selector func(*resources.GenericResource) bool, fn func(*ResourceHistory)) int {
+	subscriptionID := subscription.resourceHealth.GetSubscriptionID()
+
+	// Resources are listed before fetching their history, as both are paged
+	var histories []*ResourceHistory
+	err := subscription.resources.ForEachResource(ctx, config.ListedResourceTypes(), func(resource *resources.GenericResource) error {
+		labels, ok, err := monitoredResourceLabels(subscriptionID, resource)
+		if !ok || (selector != nil && !selector(resource)) {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("Failed to parse resource ID: %v", err)
+			return nil
+		}
+		histories = append(histories, &ResourceHistory{ResourceID: *resource.ID, Resource: *resource, Labels: labels})
+		return nil
+	})
+	if err != nil {
+		log.Errorf("Failed to get resource list in subscription %s: %v", subscriptionID, err)
+		return 1
+	}
+
+	failures := 0
+	for _, history := range histories {
+		err := subscription.resourceHealth.ForEachAvailabilityStatusHistory(ctx, history.ResourceID, func(as *resourcehealth.AvailabilityStatus) error {
+			if as.Properties == nil || as.Properties.OccuredTime == nil {
+				return nil
+			}
+			state := HistoricalState{
+				Occurred: as.Properties.OccuredTime.Time,
+				State:    availabilityState(as),
+			}
+			if as.Properties.ReasonType != nil {
+				state.ReasonType = *as.Properties.ReasonType
+			}
+			if as.Properties.Summary != nil {
+				state.Summary = *as.Properties.Summary
+			}
+			history.States = append(history.States, state)
+			return nil
+		})
+		if err != nil {
+			log.Errorf("Failed to get availability status history of resource %s: %v", history.ResourceID, err)
+			failures++
+			continue
+		}
+
+		sort.Slice(history.States, func(i, j int) bool {
+			return history.States[i].Occurred.Before(history.States[j].Occurred)
+		})
+		fn(history)
+	}
+	return failures
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+)
+
+// ResourceIndex indexes the position of resources by normalized resource ID,
+// so that availability statuses can be joined with them as they are streamed
+type ResourceIndex map[string]int
+
+// Add indexes the position of a resource
+// The first position of a resource ID is kept
+func (index ResourceIndex) Add(resourceID string, position int) {
+	id := normalizeResourceID(resourceID)
+	if _, ok := index[id]; !ok {
+		index[id] = position
+	}
+}
+
+// Lookup returns the position of a resource
+func (index ResourceIndex) Lookup(resourceID string) (int, bool) {
+	position, ok := index[normalizeResourceID(resourceID)]
+	return position, ok
+}
+
+// LookupAvailabilityStatus returns the position of the resource a current availability status belongs to
+func (index ResourceIndex) LookupAvailabilityStatus(as *resourcehealth.AvailabilityStatus) (int, bool) {
+	if as.ID == nil {
+		return 0, false
+	}
+	id := *as.ID
+	resourceIDLength := len(id) - len(AvailabilityStatusIDSuffix)
+	if resourceIDLength < 0 || !strings.EqualFold(id[resourceIDLength:], AvailabilityStatusIDSuffix) {
+		return 0, false
+	}
+	position, ok := index[normalizeResourceID(id[:resourceIDLength])]
+	return position, ok
+}
+
+// normalizeResourceID returns the resource ID as indexed, Azure resource IDs being case insensitive
+// Azure mostly returns lower cased IDs, which are then returned without allocation
+func normalizeResourceID(resourceID string) string {
+	return strings.ToLower(resourceID)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+)
+
+const syntheticResourceType = "Microsoft.Compute/virtualMachines"
+
+// syntheticSubscription returns count resources, and their availability statuses with Azure's lower cased IDs
+func syntheticSubscription(count int) ([]resources.GenericResource, []resourcehealth.AvailabilityStatus) {
+	resourceList := make([]resources.GenericResource, count)
+	asList := make([]resourcehealth.AvailabilityStatus, count)
+	resourceType := syntheticResourceType
+	monitoring := "enabled"
+	for i := 0; i < count; i++ {
+		resourceID := fmt.Sprintf("/subscriptions/my_subscription/resourceGroups/my_rg_%d/providers/Microsoft.Compute/virtualMachines/my_instance_%d", i%100, i)
+		asID := fmt.Sprintf("/subscriptions/my_subscription/resourcegroups/my_rg_%d/providers/microsoft.compute/virtualmachines/my_instance_%d", i%100, i) + AvailabilityStatusIDSuffix
+		resourceList[i] = resources.GenericResource{
+			ID:   &resourceID,
+			Type: &resourceType,
+			Tags: map[string]*string{"Monitoring": &monitoring},
+		}
+		asList[i] = resourcehealth.AvailabilityStatus{
+			ID: &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{
+				AvailabilityState: resourcehealth.Available,
+			},
+		}
+	}
+	return resourceList, asList
+}
+
+func TestResourceIndex_LookupAvailabilityStatus(t *testing.T) {
+	resourceList, asList := syntheticSubscription(3)
+	otherID := "/subscriptions/my_subscription/providers/Microsoft.ResourceHealth/events/my_event"
+
+	index := make(ResourceIndex)
+	for i, resource := range resourceList {
+		index.Add(*resource.ID, i)
+	}
+	index.Add(*resourceList[0].ID, 3)
+
+	for i := range asList {
+		position, ok := index.LookupAvailabilityStatus(&asList[i])
+		if !ok {
+			t.Errorf("Missing resource of %v", *asList[i].ID)
+			continue
+		}
+		if position != i {
+			t.Errorf("Unexpected position of %v: got %v, want %v", *asList[i].ID, position, i)
+		}
+	}
+
+	for _, as := range []resourcehealth.AvailabilityStatus{
+		resourcehealth.AvailabilityStatus{ID: &otherID},
+		resourcehealth.AvailabilityStatus{},
+	} {
+		if _, ok := index.LookupAvailabilityStatus(&as); ok {
+			t.Errorf("Unexpected resource of availability status %v", as.ID)
+		}
+	}
+}
+
+func BenchmarkResourceIndex_Add_100k(b *testing.B) {
+	resourceList, _ := syntheticSubscription(100000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index := make(ResourceIndex)
+		for j := range resourceList {
+			index.Add(*resourceList[j].ID, j)
+		}
+	}
+}
+
+func BenchmarkResourceIndex_LookupAvailabilityStatus_100k(b *testing.B) {
+	resourceList, asList := syntheticSubscription(100000)
+	index := make(ResourceIndex)
+	for i := range resourceList {
+		index.Add(*resourceList[i].ID, i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := range asList {
+			index.LookupAvailabilityStatus(&asList[j])
+		}
+	}
+}
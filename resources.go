@@ -3,76 +3,137 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 
+	"github.com/Azure/azure-sdk-for-go/services/resourcegraph/mgmt/2019-04-01/resourcegraph"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/pkg/errors"
 )
 
 // ResourcesClient is the client implementation to VirtualMachines API
 type ResourcesClient struct {
-	Session *AzureSession
-	Client  *resources.Client
+	Session     *AzureSession
+	Client      *resources.Client
+	GraphClient *resourcegraph.BaseClient
 }
 
 // Resources client interface
 type Resources interface {
-	GetResources(resourceType string, resourceTags map[string]string) (*[]resources.GenericResource, error)
+	ForEachResource(ctx context.Context, resourceTypes []string, fn func(*resources.GenericResource) error) error
+	ForEachResourceProperties(ctx context.Context, resourceTypes []string, fn func(resourceID string, properties interface{}) error) error
 }
 
 // NewResources returns a new Resources client
 func NewResources(session *AzureSession) Resources {
 	client := resources.NewClient(session.SubscriptionID)
 	client.Authorizer = session.Authorizer
+	graphClient := resourcegraph.New()
+	graphClient.Authorizer = session.Authorizer
+	if session.Sender != nil {
+		client.Sender = session.Sender
+		graphClient.Sender = session.Sender
+	}
 
 	return &ResourcesClient{
-		Session: session,
-		Client:  &client,
+		Session:     session,
+		Client:      &client,
+		GraphClient: &graphClient,
 	}
 }
 
-// GetResources return resources by type and tags
-// A resource must match all tag parameters in order to be fetched
-func (rc *ResourcesClient) GetResources(resourceType string, resourceTags map[string]string) (*[]resources.GenericResource, error) {
-
-	filter := fmt.Sprintf("resourceType eq '%s'", resourceType)
-	resList, err := rc.list(filter)
-	if err != nil {
-		return nil, err
+// ForEachResource streams resources of any of the given types to fn, holding a single page in memory
+// All resources are listed if no type is given. Streaming stops on the first error returned by fn.
+func (rc *ResourcesClient) ForEachResource(ctx context.Context, resourceTypes []string, fn func(*resources.GenericResource) error) error {
+	it, err := rc.Client.ListComplete(ctx, resourceTypesFilter(resourceTypes), "", nil)
+	for ; err == nil && it.NotDone(); err = it.NextWithContext(ctx) {
+		resource := it.Value()
+		if err := fn(&resource); err != nil {
+			return err
+		}
 	}
+	return err
+}
 
-	// Filtering by tag is done manually, as Azure does not support
-	// to filter both by resource type and by tag name/value
-	var filteredList []resources.GenericResource
-	for _, resource := range *resList {
-		include := true
-
-		if resourceTags != nil {
-			for name, value := range resourceTags {
-				if resVal, ok := resource.Tags[name]; (ok && *resVal != value) || !ok {
-					include = false
-					break
-				}
+// ForEachResourceProperties streams the properties of the resources of any of the given types to fn, a page at a time
+// Resources are listed without their properties, which are thus queried from Resource Graph.
+func (rc *ResourcesClient) ForEachResourceProperties(ctx context.Context, resourceTypes []string, fn func(resourceID string, properties interface{}) error) error {
+	query := resourcePropertiesQuery(resourceTypes)
+	request := resourcegraph.QueryRequest{
+		Subscriptions: &[]string{rc.Session.SubscriptionID},
+		Query:         &query,
+		Options:       &resourcegraph.QueryRequestOptions{ResultFormat: resourcegraph.ResultFormatObjectArray},
+	}
+	for {
+		response, err := rc.GraphClient.Resources(ctx, request)
+		if err != nil {
+			return err
+		}
+		rows, ok := response.Data.([]interface{})
+		if !ok {
+			return errors.Errorf("unexpected Resource Graph data: %T", response.Data)
+		}
+		for _, row := range rows {
+			columns, ok := row.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			resourceID, ok := columns["id"].(string)
+			if !ok {
+				continue
+			}
+			if err := fn(resourceID, columns["properties"]); err != nil {
+				return err
 			}
-		} else {
-			continue
 		}
-
-		if include {
-			filteredList = append(filteredList, resource)
+		if response.SkipToken == nil || *response.SkipToken == "" {
+			return nil
 		}
+		request.Options.SkipToken = response.SkipToken
 	}
+}
 
-	return &filteredList, nil
+// resourcePropertiesQuery returns the Resource Graph query of the IDs and properties of the resources of the given types
+func resourcePropertiesQuery(resourceTypes []string) string {
+	var quoted []string
+	for _, resourceType := range resourceTypes {
+		quoted = append(quoted, "'"+strings.Replace(resourceType, "'", "\\'", -1)+"'")
+	}
+	return fmt.Sprintf("Resources | where type in~ (%s) | project id, properties", strings.Join(quoted, ", "))
 }
 
-func (rc *ResourcesClient) list(filter string) (*[]resources.GenericResource, error) {
-	var resourceList []resources.GenericResource
+// resourceTypesFilter returns the $filter OR-ing the given resource types
+func resourceTypesFilter(resourceTypes []string) string {
+	var conditions []string
+	for _, resourceType := range resourceTypes {
+		conditions = append(conditions, fmt.Sprintf("resourceType eq '%s'", resourceType))
+	}
+	return strings.Join(conditions, " or ")
+}
 
-	for it, err := rc.Client.ListComplete(context.Background(), filter, "", nil); it.NotDone(); err = it.Next() {
-		if err != nil {
-			return nil, err
+// Matches returns whether a resource is selected by the configuration
+// A resource must be of one of the configured types, and match all the configured tags.
+// Filtering by tag is done locally, as Azure does not support
+// to filter both by resource type and by tag name/value
+func (rc *ResourceConfiguration) Matches(resource *resources.GenericResource) bool {
+	if rc.ResourceTags == nil || resource.Type == nil {
+		return false
+	}
+
+	typeMatch := false
+	for _, resourceType := range rc.ResourceTypes {
+		if strings.EqualFold(resourceType, *resource.Type) {
+			typeMatch = true
+			break
 		}
-		resourceList = append(resourceList, it.Value())
+	}
+	if !typeMatch {
+		return false
 	}
 
-	return &resourceList, nil
+	for name, value := range rc.ResourceTags {
+		if resVal, ok := resource.Tags[name]; !ok || resVal == nil || *resVal != value {
+			return false
+		}
+	}
+	return true
 }
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest"
 )
 
 func TestNewResources_OK(t *testing.T) {
@@ -12,3 +21,117 @@ func TestNewResources_OK(t *testing.T) {
 
 	_ = NewResources(session)
 }
+
+func TestResourceTypesFilter(t *testing.T) {
+	want := "resourceType eq 'Microsoft.Web/sites' or resourceType eq 'Microsoft.Web/serverfarms'"
+	if got := resourceTypesFilter([]string{"Microsoft.Web/sites", "Microsoft.Web/serverfarms"}); got != want {
+		t.Errorf("Unexpected filter: got %v, want %v", got, want)
+	}
+
+	if got := resourceTypesFilter(nil); got != "" {
+		t.Errorf("Unexpected filter: got %v, want none", got)
+	}
+}
+
+func TestResourcePropertiesQuery(t *testing.T) {
+	want := "Resources | where type in~ ('Microsoft.Web/sites', 'Microsoft.Web/serverfarms') | project id, properties"
+	if got := resourcePropertiesQuery([]string{"Microsoft.Web/sites", "Microsoft.Web/serverfarms"}); got != want {
+		t.Errorf("Unexpected query: got %v, want %v", got, want)
+	}
+}
+
+func TestResourcesClient_ForEachResourceProperties(t *testing.T) {
+	var skipTokens []string
+	sender := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		var request struct {
+			Subscriptions []string `json:"subscriptions"`
+			Options       struct {
+				SkipToken string `json:"$skipToken"`
+			} `json:"options"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &request); err != nil {
+			return nil, err
+		}
+		if len(request.Subscriptions) != 1 || request.Subscriptions[0] != "my_subscription" {
+			t.Errorf("Unexpected subscriptions: %v", request.Subscriptions)
+		}
+		skipTokens = append(skipTokens, request.Options.SkipToken)
+
+		rr := httptest.NewRecorder()
+		rr.Header().Set("Content-Type", "application/json")
+		skipToken := ""
+		if len(skipTokens) < 2 {
+			skipToken = "page2"
+		}
+		fmt.Fprintf(rr, `{"data": [{"id": "my_site_%d", "properties": {"serverFarmId": "my_plan"}}], "$skipToken": "%s"}`, len(skipTokens), skipToken)
+		resp := rr.Result()
+		resp.Request = r
+		return resp, nil
+	})
+	client := NewResources(&AzureSession{SubscriptionID: "my_subscription", Authorizer: autorest.NullAuthorizer{}, Sender: sender})
+
+	properties := make(map[string]interface{})
+	err := client.ForEachResourceProperties(context.Background(), []string{"Microsoft.Web/sites"}, func(resourceID string, resourceProperties interface{}) error {
+		properties[resourceID] = resourceProperties
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(skipTokens) != 2 || skipTokens[0] != "" || skipTokens[1] != "page2" {
+		t.Errorf("Unexpected skip tokens: %v", skipTokens)
+	}
+	if len(properties) != 2 {
+		t.Errorf("Unexpected properties: %v", properties)
+	}
+	if siteProperties, ok := properties["my_site_1"].(map[string]interface{}); !ok || siteProperties["serverFarmId"] != "my_plan" {
+		t.Errorf("Unexpected properties of my_site_1: %v", properties["my_site_1"])
+	}
+}
+
+func TestResourceConfiguration_Matches(t *testing.T) {
+	resourceType := "Microsoft.Web/sites"
+	client := "Alice"
+	resource := resources.GenericResource{
+		Type: &resourceType,
+		Tags: map[string]*string{"Client": &client},
+	}
+
+	cases := []struct {
+		name          string
+		configuration ResourceConfiguration
+		want          bool
+	}{
+		{"match", ResourceConfiguration{ResourceTypes: []string{"microsoft.web/sites"}, ResourceTags: map[string]string{"Client": "Alice"}}, true},
+		{"other type", ResourceConfiguration{ResourceTypes: []string{"Microsoft.Web/serverfarms"}, ResourceTags: map[string]string{"Client": "Alice"}}, false},
+		{"other tag value", ResourceConfiguration{ResourceTypes: []string{"Microsoft.Web/sites"}, ResourceTags: map[string]string{"Client": "Bob"}}, false},
+		{"missing tag", ResourceConfiguration{ResourceTypes: []string{"Microsoft.Web/sites"}, ResourceTags: map[string]string{"Client": "Alice", "Env": "Prod"}}, false},
+		{"no tags", ResourceConfiguration{ResourceTypes: []string{"Microsoft.Web/sites"}}, false},
+	}
+
+	for _, c := range cases {
+		if got := c.configuration.Matches(&resource); got != c.want {
+			t.Errorf("Unexpected match for %s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestResourcesClient_ForEachResource_Canceled(t *testing.T) {
+	sender, requests := pagedSender(`{"id": "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Web/sites/my_site", "type": "Microsoft.Web/sites"}`)
+	client := NewResources(&AzureSession{SubscriptionID: "my_subscription", Authorizer: autorest.NullAuthorizer{}, Sender: sender})
+
+	// The following pages are not requested once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := client.ForEachResource(ctx, []string{"Microsoft.Web/sites"}, func(resource *resources.GenericResource) error {
+		cancel()
+		return nil
+	})
+	if err == nil {
+		t.Errorf("Want an error, got none")
+	}
+	if *requests != 1 {
+		t.Errorf("Unexpected requests: got %v, want %v", *requests, 1)
+	}
+}
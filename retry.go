@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+)
+
+// RetryOptions configures retries of Azure API requests
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts of a request, including the first one
+	MaxAttempts int
+	// MinBackoff is the delay before the first retry, doubled on each following retry
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between two attempts
+	MaxBackoff time.Duration
+	// RequestTimeout bounds the duration of a single attempt, 0 meaning no timeout
+	RequestTimeout time.Duration
+}
+
+// retryableStatusCodes are the HTTP status codes worth retrying
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// DoRetryWithBackoff returns a SendDecorator retrying throttled, server and network errors
+// with a jittered exponential backoff. The Retry-After header is honoured when present, up to MaxBackoff.
+func DoRetryWithBackoff(options RetryOptions) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (resp *http.Response, err error) {
+			rr := autorest.NewRetriableRequest(r)
+			for attempt := 0; ; attempt++ {
+				err = rr.Prepare()
+				if err != nil {
+					return resp, err
+				}
+
+				resp, err = sendWithTimeout(s, rr.Request(), options.RequestTimeout)
+				if attempt+1 >= options.MaxAttempts || !isRetryable(resp, err) {
+					return resp, err
+				}
+
+				delay := backoffDelay(options, attempt)
+				if retryAfter, ok := parseRetryAfter(resp); ok {
+					delay = retryAfter
+					// A long Retry-After would spend the whole scrape budget waiting
+					if options.MaxBackoff > 0 && delay > options.MaxBackoff {
+						delay = options.MaxBackoff
+					}
+				}
+				if resp != nil {
+					autorest.Respond(resp, autorest.ByDiscardingBody(), autorest.ByClosing())
+				}
+
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					return nil, r.Context().Err()
+				}
+			}
+		})
+	}
+}
+
+// sendWithTimeout sends a request bound to a timeout, which is released once the response body is closed
+func sendWithTimeout(s autorest.Sender, r *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return s.Do(r)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	resp, err := s.Do(r.WithContext(ctx))
+	if err != nil || resp == nil || resp.Body == nil {
+		cancel()
+		return resp, err
+	}
+
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp != nil && retryableStatusCodes[resp.StatusCode]
+}
+
+// backoffDelay returns the exponential backoff of an attempt, with a random jitter of up to half of it
+func backoffDelay(options RetryOptions, attempt int) time.Duration {
+	backoff := options.MinBackoff
+	for i := 0; i < attempt && backoff < options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if options.MaxBackoff > 0 && backoff > options.MaxBackoff {
+		backoff = options.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// parseRetryAfter returns the delay requested by the Retry-After header, in seconds or as an HTTP date
+func parseRetryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	retryAfter := resp.Header.Get("Retry-After")
+	if retryAfter == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+func responseSender(statusCodes ...int) (autorest.Sender, *int) {
+	attempts := 0
+	return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		statusCode := statusCodes[len(statusCodes)-1]
+		if attempts < len(statusCodes) {
+			statusCode = statusCodes[attempts]
+		}
+		attempts++
+		rr := httptest.NewRecorder()
+		rr.WriteHeader(statusCode)
+		return rr.Result(), nil
+	}), &attempts
+}
+
+func TestDoRetryWithBackoff_RetriesUntilSuccess(t *testing.T) {
+	s, attempts := responseSender(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK)
+	sender := autorest.DecorateSender(s, DoRetryWithBackoff(RetryOptions{MaxAttempts: 5, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+
+	resp, err := sender.Do(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	if *attempts != 3 {
+		t.Errorf("Unexpected attempts: got %v, want %v", *attempts, 3)
+	}
+}
+
+func TestDoRetryWithBackoff_MaxAttempts(t *testing.T) {
+	s, attempts := responseSender(http.StatusInternalServerError)
+	sender := autorest.DecorateSender(s, DoRetryWithBackoff(RetryOptions{MaxAttempts: 2}))
+
+	resp, _ := sender.Do(httptest.NewRequest("GET", "/", nil))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Wrong status code: got %v, want %v", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if *attempts != 2 {
+		t.Errorf("Unexpected attempts: got %v, want %v", *attempts, 2)
+	}
+}
+
+func TestDoRetryWithBackoff_RetryAfterCapped(t *testing.T) {
+	attempts := 0
+	s := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		rr := httptest.NewRecorder()
+		if attempts == 1 {
+			rr.Header().Set("Retry-After", "3600")
+			rr.WriteHeader(http.StatusTooManyRequests)
+		}
+		return rr.Result(), nil
+	})
+	sender := autorest.DecorateSender(s, DoRetryWithBackoff(RetryOptions{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}))
+
+	start := time.Now()
+	resp, err := sender.Do(httptest.NewRequest("GET", "/", nil))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected response: %v %v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retry-After was not capped by the maximum backoff: waited %v", elapsed)
+	}
+}
+
+func TestDoRetryWithBackoff_NotRetryable(t *testing.T) {
+	s, attempts := responseSender(http.StatusNotFound)
+	sender := autorest.DecorateSender(s, DoRetryWithBackoff(RetryOptions{MaxAttempts: 3}))
+
+	sender.Do(httptest.NewRequest("GET", "/", nil))
+	if *attempts != 1 {
+		t.Errorf("Unexpected attempts: got %v, want %v", *attempts, 1)
+	}
+}
+
+func TestDoRetryWithBackoff_ContextCanceled(t *testing.T) {
+	s, _ := responseSender(http.StatusServiceUnavailable)
+	sender := autorest.DecorateSender(s, DoRetryWithBackoff(RetryOptions{MaxAttempts: 3, MinBackoff: time.Hour, MaxBackoff: time.Hour}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := sender.Do(httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if err != context.Canceled {
+		t.Errorf("Unexpected error: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDoRetryWithBackoff_NetworkError(t *testing.T) {
+	attempts := 0
+	s := autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		return nil, errors.New("connection reset")
+	})
+	sender := autorest.DecorateSender(s, DoRetryWithBackoff(RetryOptions{MaxAttempts: 2}))
+
+	if _, err := sender.Do(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("Want an error, got none")
+	}
+	if attempts != 2 {
+		t.Errorf("Unexpected attempts: got %v, want %v", attempts, 2)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	options := RetryOptions{MinBackoff: time.Second, MaxBackoff: 4 * time.Second}
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		delay := backoffDelay(options, attempt)
+		if delay < want/2 || delay > want {
+			t.Errorf("Unexpected delay for attempt %v: got %v, want between %v and %v", attempt, delay, want/2, want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	if _, ok := parseRetryAfter(resp); ok {
+		t.Errorf("Unexpected Retry-After without header")
+	}
+
+	resp.Header.Set("Retry-After", "7")
+	if delay, ok := parseRetryAfter(resp); !ok || delay != 7*time.Second {
+		t.Errorf("Unexpected Retry-After: got %v, want %v", delay, 7*time.Second)
+	}
+
+	resp.Header.Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	if delay, ok := parseRetryAfter(resp); !ok || delay != 0 {
+		t.Errorf("Unexpected Retry-After: got %v, want %v", delay, 0)
+	}
+}
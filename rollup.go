@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rollupByResourceGroupDesc = prometheus.NewDesc(
+		"azure_resource_health_resources_by_resource_group",
+		"Number of monitored resources in each availability state, per resource group",
+		[]string{"subscription_id", "resource_group", "state"}, nil,
+	)
+	rollupByResourceTypeDesc = prometheus.NewDesc(
+		"azure_resource_health_resources_by_resource_type",
+		"Number of monitored resources in each availability state, per resource type",
+		[]string{"resource_type", "state"}, nil,
+	)
+	rollupByLocationDesc = prometheus.NewDesc(
+		"azure_resource_health_resources_by_location",
+		"Number of monitored resources in each availability state, per location",
+		[]string{"location", "state"}, nil,
+	)
+	rollupByTagDesc = prometheus.NewDesc(
+		"azure_resource_health_resources_by_tag",
+		"Number of monitored resources in each availability state, per value of the configured rollup tags",
+		[]string{"tag", "value", "state"}, nil,
+	)
+
+	// rollupStates are always exported, so that a state without any resource reads 0 rather than nothing
+	rollupStates = []string{string(resourcehealth.Available), string(resourcehealth.Unavailable), string(resourcehealth.Unknown)}
+)
+
+// rollup counts resources per group and availability state
+type rollup struct {
+	desc   *prometheus.Desc
+	groups map[string]*rollupGroup
+}
+
+type rollupGroup struct {
+	labelValues []string
+	states      map[string]int
+}
+
+func newRollup(desc *prometheus.Desc) *rollup {
+	return &rollup{desc: desc, groups: make(map[string]*rollupGroup)}
+}
+
+// add counts a resource in state in the group identified by labelValues
+func (r *rollup) add(state string, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	group, ok := r.groups[key]
+	if !ok {
+		group = &rollupGroup{labelValues: labelValues, states: make(map[string]int)}
+		for _, rollupState := range rollupStates {
+			group.states[rollupState] = 0
+		}
+		r.groups[key] = group
+	}
+	group.states[state]++
+}
+
+func (r *rollup) collect(ch chan<- prometheus.Metric) {
+	for _, group := range r.groups {
+		for state, count := range group.states {
+			labelValues := append(append([]string(nil), group.labelValues...), state)
+			ch <- prometheus.MustNewConstMetric(r.desc, prometheus.GaugeValue, float64(count), labelValues...)
+		}
+	}
+}
+
+// CollectRollups exports the number of monitored resources in each availability state,
+// per resource group, resource type, location and value of the configured rollup tags
+func (c *ResourceHealthCollector) CollectRollups(ch chan<- prometheus.Metric, snapshot *Snapshot) {
+	byResourceGroup := newRollup(rollupByResourceGroupDesc)
+	byResourceType := newRollup(rollupByResourceTypeDesc)
+	byLocation := newRollup(rollupByLocationDesc)
+	byTag := newRollup(rollupByTagDesc)
+
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		for i := range subscriptionSnapshot.Resources {
+			resource := &subscriptionSnapshot.Resources[i]
+			state := availabilityState(&resource.AvailabilityStatus)
+
+			byResourceGroup.add(state, subscriptionSnapshot.SubscriptionID, resource.Labels["resource_group"])
+			byResourceType.add(state, resource.Labels["resource_type"])
+			location := ""
+			if resource.Resource.Location != nil {
+				location = *resource.Resource.Location
+			}
+			byLocation.add(state, location)
+
+			for _, tag := range config.RollupTags {
+				if value, ok := resource.Resource.Tags[tag]; ok && value != nil {
+					byTag.add(state, tag, *value)
+				}
+			}
+		}
+	}
+
+	byResourceGroup.collect(ch)
+	byResourceType.collect(ch)
+	byLocation.collect(ch)
+	byTag.collect(ch)
+}
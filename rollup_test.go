@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCollect_Rollups(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	for _, instance := range []struct {
+		group    string
+		name     string
+		location string
+		env      string
+		state    resourcehealth.AvailabilityStateValues
+	}{
+		{"rg1", "web1", "canadaeast", "prod", resourcehealth.Available},
+		{"rg1", "web2", "canadaeast", "prod", resourcehealth.Unavailable},
+		{"rg2", "web3", "canadacentral", "dev", resourcehealth.Available},
+	} {
+		resourceID := "/subscriptions/my_subscription/resourceGroups/" + instance.group + "/providers/Microsoft.Compute/virtualMachines/" + instance.name
+		asID := resourceID + AvailabilityStatusIDSuffix
+		location := instance.location
+		env := instance.env
+		resList = append(resList, resources.GenericResource{
+			ID:       &resourceID,
+			Type:     &resourceType,
+			Location: &location,
+			Tags:     map[string]*string{"Monitoring": &monitoring, "Env": &env},
+		})
+		asList = append(asList, resourcehealth.AvailabilityStatus{
+			ID:         &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: instance.state},
+		})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+rollup_tags:
+  - Env
+`)
+
+	for _, want := range []string{
+		`azure_resource_health_resources_by_resource_group{resource_group="rg1",state="Available",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_resources_by_resource_group{resource_group="rg1",state="Unavailable",subscription_id="my_subscription"} 1`,
+		`azure_resource_health_resources_by_resource_group{resource_group="rg2",state="Unavailable",subscription_id="my_subscription"} 0`,
+		`azure_resource_health_resources_by_resource_type{resource_type="Microsoft.Compute/virtualMachines",state="Available"} 2`,
+		`azure_resource_health_resources_by_location{location="canadaeast",state="Unavailable"} 1`,
+		`azure_resource_health_resources_by_location{location="canadacentral",state="Available"} 1`,
+		`azure_resource_health_resources_by_tag{state="Available",tag="Env",value="prod"} 1`,
+		`azure_resource_health_resources_by_tag{state="Unavailable",tag="Env",value="prod"} 1`,
+		`azure_resource_health_resources_by_tag{state="Available",tag="Env",value="dev"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+}
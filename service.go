@@ -0,0 +1,189 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Service rules, telling how many members of a service must be healthy for the service to be up
+const (
+	ServiceRuleAll     = "all"
+	ServiceRuleAny     = "any"
+	ServiceRuleAtLeast = "at_least"
+	ServiceRulePercent = "percent"
+)
+
+var (
+	serviceUpDesc = prometheus.NewDesc(
+		"azure_service_availability_up",
+		"Whether enough members of the service are healthy according to its rule",
+		[]string{"service"}, nil,
+	)
+	serviceMembersDesc = prometheus.NewDesc(
+		"azure_service_members",
+		"Number of monitored resources of the service",
+		[]string{"service"}, nil,
+	)
+	serviceHealthyMembersDesc = prometheus.NewDesc(
+		"azure_service_healthy_members",
+		"Number of healthy monitored resources of the service",
+		[]string{"service"}, nil,
+	)
+)
+
+// ServiceConfig is a logical service made of many resources
+// Members are selected like resource configurations do, by types and tags, and/or by resource IDs.
+type ServiceConfig struct {
+	Name          string            `yaml:"name"`
+	ResourceTags  map[string]string `yaml:"resource_tags"`
+	ResourceTypes []string          `yaml:"resource_types"`
+	ResourceIDs   []string          `yaml:"resource_ids"`
+	// Rule is one of all (default), any, at_least or percent
+	Rule string `yaml:"rule"`
+	// MinHealthy is the number of healthy members required by the at_least rule
+	MinHealthy int `yaml:"min_healthy"`
+	// MinHealthyPercent is the percentage of healthy members required by the percent rule
+	MinHealthyPercent float64 `yaml:"min_healthy_percent"`
+}
+
+// init validates the service, and sets its defaults
+func (s *ServiceConfig) init() error {
+	if s.Name == "" {
+		return errors.New("service name is mandatory")
+	}
+	if len(s.ResourceTags) > 0 && len(s.ResourceTypes) == 0 {
+		return errors.Errorf("service %s selects resources by tags without resource_types", s.Name)
+	}
+	if len(s.ResourceTypes) > 0 && len(s.ResourceTags) == 0 {
+		return errors.Errorf("service %s selects resources by types without resource_tags", s.Name)
+	}
+	if len(s.ResourceTypes) == 0 && len(s.ResourceIDs) == 0 {
+		return errors.Errorf("service %s does not select any resource", s.Name)
+	}
+	if s.Rule == "" {
+		s.Rule = ServiceRuleAll
+	}
+	switch s.Rule {
+	case ServiceRuleAll, ServiceRuleAny:
+	case ServiceRuleAtLeast:
+		if s.MinHealthy <= 0 {
+			return errors.Errorf("service %s min_healthy must be positive", s.Name)
+		}
+	case ServiceRulePercent:
+		if s.MinHealthyPercent <= 0 || s.MinHealthyPercent > 100 {
+			return errors.Errorf("service %s min_healthy_percent must be between 0 excluded and 100", s.Name)
+		}
+	default:
+		return errors.Errorf("service %s has an unknown rule %s", s.Name, s.Rule)
+	}
+	return nil
+}
+
+// checkServiceNames returns an error if several services have the same name, whose series would collide
+func checkServiceNames(services []ServiceConfig) error {
+	names := make(map[string]bool)
+	for _, service := range services {
+		if names[service.Name] {
+			return errors.Errorf("service %s is defined several times", service.Name)
+		}
+		names[service.Name] = true
+	}
+	return nil
+}
+
+// MayContain returns whether the service may have members in a subscription
+func (s *ServiceConfig) MayContain(subscriptionID string) bool {
+	if len(s.ResourceTypes) > 0 {
+		return true
+	}
+	for _, resourceID := range s.ResourceIDs {
+		if strings.HasPrefix(strings.ToLower(resourceID), strings.ToLower("/subscriptions/"+subscriptionID+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains returns whether a resource is a member of the service
+func (s *ServiceConfig) Contains(resource *MonitoredResource) bool {
+	for _, resourceID := range s.ResourceIDs {
+		if strings.EqualFold(resourceID, *resource.Resource.ID) {
+			return true
+		}
+	}
+	selector := ResourceConfiguration{ResourceTags: s.ResourceTags, ResourceTypes: s.ResourceTypes}
+	return selector.Matches(&resource.Resource)
+}
+
+// IsUp returns whether enough members are healthy according to the service rule
+// A service without any member is down, as its health is unknown.
+func (s *ServiceConfig) IsUp(healthy int, total int) bool {
+	if total == 0 {
+		return false
+	}
+	switch s.Rule {
+	case ServiceRuleAny:
+		return healthy > 0
+	case ServiceRuleAtLeast:
+		return healthy >= s.MinHealthy
+	case ServiceRulePercent:
+		return float64(healthy)*100 >= s.MinHealthyPercent*float64(total)
+	}
+	return healthy == total
+}
+
+// CollectServices exports the availability of the configured services, along with their failing members
+// The availability of a service is unknown, and not exported, while a subscription which may contain
+// some of its members failed to be fetched.
+func (c *ResourceHealthCollector) CollectServices(ch chan<- prometheus.Metric, snapshot *Snapshot) {
+	for i := range config.Services {
+		service := &config.Services[i]
+		healthy, total := 0, 0
+		known := !snapshot.TimedOut
+
+		for _, subscriptionSnapshot := range snapshot.Subscriptions {
+			if !subscriptionSnapshot.Fetched() && service.MayContain(subscriptionSnapshot.SubscriptionID) {
+				known = false
+			}
+			for j := range subscriptionSnapshot.Resources {
+				resource := &subscriptionSnapshot.Resources[j]
+				if !service.Contains(resource) {
+					continue
+				}
+				total++
+
+				// Only the `Unavailable` status can be used with confidence to consider a member failing
+				if availabilityState(&resource.AvailabilityStatus) != string(resourcehealth.Unavailable) {
+					healthy++
+					continue
+				}
+				labels := prometheus.Labels{"service": service.Name}
+				for _, name := range []string{"subscription_id", "resource_group", "resource_name", "resource_type"} {
+					labels[name] = resource.Labels[name]
+				}
+				if subResourceName, ok := resource.Labels["sub_resource_name"]; ok {
+					labels["sub_resource_name"] = subResourceName
+				}
+				ch <- prometheus.MustNewConstMetric(
+					prometheus.NewDesc("azure_service_failing_member_info", "Failing member of a service", nil, labels),
+					prometheus.GaugeValue,
+					1,
+				)
+			}
+		}
+
+		if !known {
+			continue
+		}
+		up := 0.0
+		if service.IsUp(healthy, total) {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(serviceUpDesc, prometheus.GaugeValue, up, service.Name)
+		ch <- prometheus.MustNewConstMetric(serviceMembersDesc, prometheus.GaugeValue, float64(total), service.Name)
+		ch <- prometheus.MustNewConstMetric(serviceHealthyMembersDesc, prometheus.GaugeValue, float64(healthy), service.Name)
+	}
+}
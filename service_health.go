@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+)
+
+// ServiceHealthEventStatusResolved is the status of a service health event which is not reported anymore
+const ServiceHealthEventStatusResolved = "Resolved"
+
+// ServiceHealthEventUpdate is a service health event impacting a resource, as reported by its availability status,
+// which is new or changed since the previous fetch
+type ServiceHealthEventUpdate struct {
+	ResourceID     string            `json:"resource_id"`
+	SubscriptionID string            `json:"subscription_id"`
+	ResourceGroup  string            `json:"resource_group"`
+	ResourceName   string            `json:"resource_name"`
+	ResourceType   string            `json:"resource_type"`
+	Labels         map[string]string `json:"labels"`
+	EventID        string            `json:"event_id"`
+	Status         string            `json:"status"`
+	Title          string            `json:"title,omitempty"`
+	Service        string            `json:"service,omitempty"`
+	Region         string            `json:"region,omitempty"`
+	IncidentType   string            `json:"incident_type,omitempty"`
+	StartTime      *time.Time        `json:"start_time,omitempty"`
+	LastModified   *time.Time        `json:"last_modified,omitempty"`
+}
+
+// ServiceHealthNotifier is a Notifier also notified of the service health event updates of each new snapshot
+type ServiceHealthNotifier interface {
+	NotifyServiceHealthEvents(updates []ServiceHealthEventUpdate)
+}
+
+// serviceHealthTracker remembers the service health events impacting resources between fetches
+type serviceHealthTracker struct {
+	mutex  sync.Mutex
+	events map[string]ServiceHealthEventUpdate
+}
+
+func newServiceHealthTracker() *serviceHealthTracker {
+	return &serviceHealthTracker{events: make(map[string]ServiceHealthEventUpdate)}
+}
+
+// Update tracks the service health events of a new snapshot, and returns the new and changed ones,
+// along with the ones not reported anymore as resolved. Events of subscriptions which failed to be fetched are kept.
+func (t *serviceHealthTracker) Update(snapshot *Snapshot) []ServiceHealthEventUpdate {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var updates []ServiceHealthEventUpdate
+	seen := make(map[string]bool)
+	fetchedSubscriptions := make(map[string]bool)
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		if subscriptionSnapshot.TypeSuccess[AvailabilityStatusesResourceType] {
+			fetchedSubscriptions[subscriptionSnapshot.SubscriptionID] = true
+		}
+		for i := range subscriptionSnapshot.Resources {
+			for _, event := range serviceHealthEvents(&subscriptionSnapshot.Resources[i]) {
+				key := normalizeResourceID(event.ResourceID) + "|" + event.EventID
+				seen[key] = true
+				if previous, ok := t.events[key]; !ok || previous.changed(&event) {
+					updates = append(updates, event)
+				}
+				t.events[key] = event
+			}
+		}
+	}
+
+	var keys []string
+	for key := range t.events {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		event := t.events[key]
+		if seen[key] || !fetchedSubscriptions[event.SubscriptionID] {
+			continue
+		}
+		delete(t.events, key)
+		event.Status = ServiceHealthEventStatusResolved
+		updates = append(updates, event)
+	}
+	return updates
+}
+
+// changed returns whether an event was updated
+func (e *ServiceHealthEventUpdate) changed(event *ServiceHealthEventUpdate) bool {
+	if e.Status != event.Status || e.Title != event.Title {
+		return true
+	}
+	if e.LastModified == nil || event.LastModified == nil {
+		return e.LastModified != event.LastModified
+	}
+	return !e.LastModified.Equal(*event.LastModified)
+}
+
+// serviceHealthEvents returns the service health events reported by the availability status of a resource
+func serviceHealthEvents(resource *MonitoredResource) []ServiceHealthEventUpdate {
+	properties := resource.AvailabilityStatus.Properties
+	if properties == nil || properties.ServiceImpactingEvents == nil {
+		return nil
+	}
+
+	var events []ServiceHealthEventUpdate
+	for _, impacting := range *properties.ServiceImpactingEvents {
+		if impacting.CorrelationID == nil {
+			continue
+		}
+		event := ServiceHealthEventUpdate{
+			ResourceID:     *resource.Resource.ID,
+			SubscriptionID: resource.Labels["subscription_id"],
+			ResourceGroup:  resource.Labels["resource_group"],
+			ResourceName:   resource.Labels["resource_name"],
+			ResourceType:   resource.Labels["resource_type"],
+			Labels:         copyLabels(resource.Labels),
+			EventID:        *impacting.CorrelationID,
+		}
+		if impacting.Status != nil && impacting.Status.Value != nil {
+			event.Status = *impacting.Status.Value
+		}
+		if incident := impacting.IncidentProperties; incident != nil {
+			event.Title = stringValue(incident.Title)
+			event.Service = stringValue(incident.Service)
+			event.Region = stringValue(incident.Region)
+			event.IncidentType = stringValue(incident.IncidentType)
+		}
+		if impacting.EventStartTime != nil {
+			startTime := impacting.EventStartTime.Time
+			event.StartTime = &startTime
+		}
+		if impacting.EventStatusLastModifiedTime != nil {
+			lastModified := impacting.EventStatusLastModifiedTime.Time
+			event.LastModified = &lastModified
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// isActiveServiceHealthEvent returns whether a service impacting event is still active
+func isActiveServiceHealthEvent(event *resourcehealth.ServiceImpactingEvent) bool {
+	return event.Status != nil && event.Status.Value != nil && strings.EqualFold(*event.Status.Value, "Active")
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
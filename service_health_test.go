@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/stretchr/testify/mock"
+)
+
+func serviceHealthSnapshot(events ...resourcehealth.ServiceImpactingEvent) *Snapshot {
+	return trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available, ServiceImpactingEvents: &events})
+}
+
+func serviceImpactingEvent(id string, status string, lastModified time.Time) resourcehealth.ServiceImpactingEvent {
+	title := "Virtual machines in Canada Central"
+	return resourcehealth.ServiceImpactingEvent{
+		CorrelationID:               &id,
+		Status:                      &resourcehealth.ServiceImpactingEventStatus{Value: &status},
+		EventStatusLastModifiedTime: &date.Time{Time: lastModified},
+		IncidentProperties:          &resourcehealth.ServiceImpactingEventIncidentProperties{Title: &title},
+	}
+}
+
+func TestServiceHealthTracker_Update(t *testing.T) {
+	tracker := newServiceHealthTracker()
+	start := time.Unix(1500000000, 0)
+
+	tests := []struct {
+		snapshot *Snapshot
+		want     []string
+	}{
+		{serviceHealthSnapshot(serviceImpactingEvent("ABC-123", "Active", start)), []string{"ABC-123 Active"}},
+		{serviceHealthSnapshot(serviceImpactingEvent("ABC-123", "Active", start)), nil},
+		{serviceHealthSnapshot(serviceImpactingEvent("ABC-123", "Active", start.Add(time.Minute)), serviceImpactingEvent("DEF-456", "Active", start)), []string{"ABC-123 Active", "DEF-456 Active"}},
+		{serviceHealthSnapshot(serviceImpactingEvent("DEF-456", "Active", start)), []string{"ABC-123 " + ServiceHealthEventStatusResolved}},
+	}
+
+	for i, test := range tests {
+		var got []string
+		for _, update := range tracker.Update(test.snapshot) {
+			if update.ResourceName != "my_instance" || update.Title == "" {
+				t.Errorf("Unexpected update %d: %+v", i, update)
+			}
+			got = append(got, update.EventID+" "+update.Status)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("Unexpected updates %d: got %v, want %v", i, got, test.want)
+			continue
+		}
+		for j := range got {
+			if got[j] != test.want[j] {
+				t.Errorf("Unexpected updates %d: got %v, want %v", i, got, test.want)
+			}
+		}
+	}
+
+	// Events are kept while their subscription fails to be fetched
+	failed := serviceHealthSnapshot()
+	failed.Subscriptions[0].Resources = nil
+	failed.Subscriptions[0].SetTypeResult(AvailabilityStatusesResourceType, false)
+	if updates := tracker.Update(failed); len(updates) != 0 {
+		t.Errorf("Unexpected updates of a failed subscription: %+v", updates)
+	}
+}
+
+func TestCollect_ServiceHealthEvents(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	stream := NewEventStream("/azure-health-exporter")
+	collector.WithNotifier(stream)
+	events, _, cancel := stream.Subscribe("")
+	defer cancel()
+
+	resourceID := trackedResourceID
+	asID := resourceID + AvailabilityStatusIDSuffix
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{
+			AvailabilityState:      resourcehealth.Available,
+			ServiceImpactingEvents: &[]resourcehealth.ServiceImpactingEvent{serviceImpactingEvent("ABC-123", "Active", time.Unix(1500000000, 0))},
+		}},
+	}, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	configFile := `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+`
+	CallExporterWithConfig(collector, configFile)
+	CallExporterWithConfig(collector, configFile)
+
+	if len(events) != 1 {
+		t.Fatalf("Unexpected number of events: %v", len(events))
+	}
+	if event := <-events; event.Type != EventTypeServiceHealthUpdated || event.Data.(*ServiceHealthEventUpdate).EventID != "ABC-123" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestServiceConfig_IsUp(t *testing.T) {
+	tests := []struct {
+		service ServiceConfig
+		healthy int
+		total   int
+		want    bool
+	}{
+		{ServiceConfig{Rule: ServiceRuleAll}, 3, 3, true},
+		{ServiceConfig{Rule: ServiceRuleAll}, 2, 3, false},
+		{ServiceConfig{Rule: ServiceRuleAll}, 0, 0, false},
+		{ServiceConfig{Rule: ServiceRuleAny}, 1, 3, true},
+		{ServiceConfig{Rule: ServiceRuleAny}, 0, 3, false},
+		{ServiceConfig{Rule: ServiceRuleAtLeast, MinHealthy: 2}, 2, 3, true},
+		{ServiceConfig{Rule: ServiceRuleAtLeast, MinHealthy: 2}, 1, 3, false},
+		{ServiceConfig{Rule: ServiceRulePercent, MinHealthyPercent: 75}, 3, 4, true},
+		{ServiceConfig{Rule: ServiceRulePercent, MinHealthyPercent: 75}, 2, 4, false},
+	}
+
+	for _, test := range tests {
+		if got := test.service.IsUp(test.healthy, test.total); got != test.want {
+			t.Errorf("Unexpected result of rule %s with %d/%d healthy: got %v, want %v", test.service.Rule, test.healthy, test.total, got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigContent_Services(t *testing.T) {
+	got, err := loadConfigContent([]byte(`
+services:
+  - name: checkout
+    resource_ids:
+      - "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
+`))
+	if err != nil {
+		t.Fatalf("Error on loading config %v", err)
+	}
+	if got.Services[0].Rule != ServiceRuleAll {
+		t.Errorf("Unexpected default rule: %v", got.Services[0].Rule)
+	}
+
+	members := "    resource_ids: [my_id]\n"
+	for _, configFile := range []string{
+		"services:\n  - rule: any\n" + members,
+		"services:\n  - name: checkout\n    rule: most\n" + members,
+		"services:\n  - name: checkout\n    rule: at_least\n" + members,
+		"services:\n  - name: checkout\n    rule: percent\n    min_healthy_percent: 150\n" + members,
+		"services:\n  - name: checkout\n",
+		"services:\n  - name: checkout\n    resource_tags: {App: checkout}\n",
+		"services:\n  - name: checkout\n    resource_types: [Microsoft.Web/sites]\n",
+		"services:\n  - name: checkout\n" + members + "  - name: checkout\n" + members,
+	} {
+		if _, err := loadConfigContent([]byte(configFile)); err == nil {
+			t.Errorf("Should have an error loading %v", configFile)
+		}
+	}
+}
+
+func TestCollect_Services(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	app := "checkout"
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	for _, instance := range []struct {
+		name  string
+		state resourcehealth.AvailabilityStateValues
+	}{
+		{"web1", resourcehealth.Available},
+		{"web2", resourcehealth.Unavailable},
+		{"web3", resourcehealth.Unknown},
+	} {
+		resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/" + instance.name
+		asID := resourceID + AvailabilityStatusIDSuffix
+		resList = append(resList, resources.GenericResource{
+			ID:   &resourceID,
+			Type: &resourceType,
+			Tags: map[string]*string{"Monitoring": &monitoring, "App": &app},
+		})
+		asList = append(asList, resourcehealth.AvailabilityStatus{
+			ID:         &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: instance.state},
+		})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+services:
+  - name: checkout
+    resource_tags:
+      App: "checkout"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+  - name: checkout_quorum
+    resource_tags:
+      App: "checkout"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+    rule: at_least
+    min_healthy: 2
+  - name: single
+    resource_ids:
+      - "/subscriptions/my_subscription/resourcegroups/my_rg/providers/microsoft.compute/virtualmachines/web1"
+`)
+
+	for _, want := range []string{
+		`azure_service_availability_up{service="checkout"} 0`,
+		`azure_service_availability_up{service="checkout_quorum"} 1`,
+		`azure_service_availability_up{service="single"} 1`,
+		`azure_service_members{service="checkout"} 3`,
+		`azure_service_healthy_members{service="checkout"} 2`,
+		`azure_service_members{service="single"} 1`,
+		`azure_service_failing_member_info{resource_group="my_rg",resource_name="web2",resource_type="Microsoft.Compute/virtualMachines",service="checkout",subscription_id="my_subscription"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+	if strings.Contains(rr.Body.String(), `resource_name="web3",resource_type="Microsoft.Compute/virtualMachines",service="checkout"`) {
+		t.Errorf("Unknown member reported as failing in body %v", rr.Body.String())
+	}
+}
+
+func TestCollect_ServicesFailedSubscription(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{}, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{}, errors.New("Unable to fetch availability statuses"))
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+services:
+  - name: checkout
+    resource_tags:
+      App: "checkout"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+  - name: other_subscription
+    resource_ids:
+      - "/subscriptions/other_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/web1"
+`)
+
+	// The members of the failed subscription are unknown, rather than absent
+	if strings.Contains(rr.Body.String(), `azure_service_availability_up{service="checkout"}`) {
+		t.Errorf("Unexpected availability of a service with unknown members in body %v", rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), `azure_service_availability_up{service="other_subscription"} 0`) {
+		t.Errorf("Missing availability of a service of another subscription in body %v", rr.Body.String())
+	}
+}
+
+func TestCollect_ServicesSubResources(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	resourceType := "Microsoft.Sql/servers/databases"
+	monitoring := "enabled"
+	var resList []resources.GenericResource
+	var asList []resourcehealth.AvailabilityStatus
+	for _, database := range []string{"db1", "db2"} {
+		resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Sql/servers/my_server/databases/" + database
+		asID := resourceID + AvailabilityStatusIDSuffix
+		resList = append(resList, resources.GenericResource{
+			ID:   &resourceID,
+			Type: &resourceType,
+			Tags: map[string]*string{"Monitoring": &monitoring},
+		})
+		asList = append(asList, resourcehealth.AvailabilityStatus{
+			ID:         &asID,
+			Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable},
+		})
+	}
+	r.On("ForEachResource", mock.Anything).Return(&resList, nil)
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&asList, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	rr := CallExporterWithConfig(collector, `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Sql/servers/databases"
+services:
+  - name: billing
+    resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Sql/servers/databases"
+`)
+
+	if rr.Code != 200 {
+		t.Fatalf("Wrong status code: got %v, want %v: %v", rr.Code, 200, rr.Body.String())
+	}
+	for _, database := range []string{"db1", "db2"} {
+		want := `azure_service_failing_member_info{resource_group="my_rg",resource_name="my_server",resource_type="Microsoft.Sql/servers/databases",service="billing",sub_resource_name="` + database + `",subscription_id="my_subscription"} 1`
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Default SLO settings
+const (
+	DefaultSLOWindow         = 30 * 24 * time.Hour
+	DefaultSLOBurnRateWindow = time.Hour
+)
+
+// SLOConfig is an availability objective of the resources of a configuration
+type SLOConfig struct {
+	// Name identifies the objective in metrics, slo_<configuration index> by default
+	Name string `yaml:"name"`
+	// Target is the expected availability ratio, e.g. 0.999
+	Target float64 `yaml:"target"`
+	// Window is the rolling window over which availability is computed
+	Window time.Duration `yaml:"window"`
+	// BurnRateWindow is the rolling window over which the error budget burn rate is computed
+	BurnRateWindow time.Duration `yaml:"burn_rate_window"`
+	// BadStates are the availability states counting against the error budget, only Unavailable by default
+	BadStates []string `yaml:"bad_states"`
+	// GroupByTags are the tags grouping resources into aggregated objectives
+	GroupByTags []string `yaml:"group_by_tags"`
+}
+
+// init validates the objective of the configuration at index, and sets its defaults
+func (s *SLOConfig) init(index int) error {
+	if s.Name == "" {
+		s.Name = fmt.Sprintf("slo_%d", index)
+	}
+	if s.Target <= 0 || s.Target >= 1 {
+		return errors.Errorf("SLO %s target must be between 0 and 1 excluded, got %v", s.Name, s.Target)
+	}
+	if s.Window == 0 {
+		s.Window = DefaultSLOWindow
+	}
+	if s.BurnRateWindow == 0 {
+		s.BurnRateWindow = DefaultSLOBurnRateWindow
+	}
+	if s.Window < 0 || s.BurnRateWindow < 0 {
+		return errors.Errorf("SLO %s windows must be positive", s.Name)
+	}
+	if len(s.BadStates) == 0 {
+		s.BadStates = []string{"Unavailable"}
+	}
+	groupLabels := make(map[string]bool)
+	for _, tag := range s.GroupByTags {
+		label := sloGroupLabel(tag)
+		if groupLabels[label] {
+			return errors.Errorf("SLO %s groups by tags sharing the %s label", s.Name, label)
+		}
+		groupLabels[label] = true
+	}
+	return nil
+}
+
+// checkSLONames returns an error if several configurations define objectives with the same name,
+// whose series would collide
+func checkSLONames(configurations []ResourceConfiguration) error {
+	names := make(map[string]bool)
+	for _, resourceConfiguration := range configurations {
+		if slo := resourceConfiguration.SLO; slo != nil {
+			if names[slo.Name] {
+				return errors.Errorf("SLO %s is defined by several resource configurations", slo.Name)
+			}
+			names[slo.Name] = true
+		}
+	}
+	return nil
+}
+
+// sloGroupLabel returns the label of a group_by_tags tag
+func sloGroupLabel(tag string) string {
+	return invalidLabelChars.ReplaceAllString("tag_"+strings.ToLower(tag), "_")
+}
+
+// isBad returns whether a state counts against the error budget
+func (s *SLOConfig) isBad(state string) bool {
+	for _, badState := range s.BadStates {
+		if strings.EqualFold(badState, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// sloCompliance accumulates the time spent in good and bad states over the window and the burn rate window
+type sloCompliance struct {
+	good, bad                 time.Duration
+	burnRateGood, burnRateBad time.Duration
+}
+
+func (c *sloCompliance) add(slo *SLOConfig, window map[string]time.Duration, burnRateWindow map[string]time.Duration) {
+	for state, duration := range window {
+		if slo.isBad(state) {
+			c.bad += duration
+		} else {
+			c.good += duration
+		}
+	}
+	for state, duration := range burnRateWindow {
+		if slo.isBad(state) {
+			c.burnRateBad += duration
+		} else {
+			c.burnRateGood += duration
+		}
+	}
+}
+
+// collect exports the availability ratio, remaining error budget and burn rate, if anything was observed
+func (c *sloCompliance) collect(ch chan<- prometheus.Metric, prefix string, slo *SLOConfig, labels map[string]string) {
+	if c.good+c.bad <= 0 {
+		return
+	}
+	errorBudget := 1 - slo.Target
+
+	badRatio := c.bad.Seconds() / (c.good + c.bad).Seconds()
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(prefix+"_availability_ratio", "Ratio of time spent in good availability states over the SLO window", nil, labels),
+		prometheus.GaugeValue,
+		1-badRatio,
+	)
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(prefix+"_error_budget_remaining_ratio", "Ratio of the error budget remaining over the SLO window, negative once exhausted", nil, labels),
+		prometheus.GaugeValue,
+		1-badRatio/errorBudget,
+	)
+
+	if c.burnRateGood+c.burnRateBad <= 0 {
+		return
+	}
+	burnRateBadRatio := c.burnRateBad.Seconds() / (c.burnRateGood + c.burnRateBad).Seconds()
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc(prefix+"_burn_rate", "Rate at which the error budget is consumed over the SLO burn rate window, 1 exhausting it exactly at the end of the SLO window", nil, labels),
+		prometheus.GaugeValue,
+		burnRateBadRatio/errorBudget,
+	)
+}
+
+// resourceSLO returns the objective of the first configuration of a resource defining one
+func resourceSLO(resource *MonitoredResource) *SLOConfig {
+	for i := range config.ResourceConfigurations {
+		resourceConfiguration := &config.ResourceConfigurations[i]
+		if resourceConfiguration.SLO != nil && resourceConfiguration.Matches(&resource.Resource) {
+			return resourceConfiguration.SLO
+		}
+	}
+	return nil
+}
+
+// CollectSLOs exports the compliance of the resources of a snapshot to their objectives,
+// per resource and per group of resources sharing the group_by_tags values
+func (c *ResourceHealthCollector) CollectSLOs(ch chan<- prometheus.Metric, snapshot *Snapshot) {
+	now := c.now()
+	groups := make(map[string]*sloCompliance)
+	groupLabels := make(map[string]map[string]string)
+	groupSLOs := make(map[string]*SLOConfig)
+
+	for i := range config.ResourceConfigurations {
+		if slo := config.ResourceConfigurations[i].SLO; slo != nil {
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc("azure_resource_health_slo_target", "Availability ratio targeted by the SLO", nil, prometheus.Labels{"slo": slo.Name}),
+				prometheus.GaugeValue,
+				slo.Target,
+			)
+		}
+	}
+
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		for i := range subscriptionSnapshot.Resources {
+			resource := &subscriptionSnapshot.Resources[i]
+			slo := resourceSLO(resource)
+			if slo == nil {
+				continue
+			}
+			window := c.states.StateDurations(*resource.Resource.ID, now.Add(-slo.Window), now)
+			if window == nil {
+				continue
+			}
+			burnRateWindow := c.states.StateDurations(*resource.Resource.ID, now.Add(-slo.BurnRateWindow), now)
+
+			compliance := &sloCompliance{}
+			compliance.add(slo, window, burnRateWindow)
+			labels := copyLabels(resource.Labels)
+			labels["slo"] = slo.Name
+			compliance.collect(ch, "azure_resource_health_slo", slo, labels)
+
+			if len(slo.GroupByTags) == 0 {
+				continue
+			}
+			labels = prometheus.Labels{"slo": slo.Name}
+			key := slo.Name
+			for _, tag := range slo.GroupByTags {
+				value := ""
+				if tagValue, ok := resource.Resource.Tags[tag]; ok && tagValue != nil {
+					value = *tagValue
+				}
+				labels[sloGroupLabel(tag)] = value
+				key += "\xff" + value
+			}
+			if groups[key] == nil {
+				groups[key] = &sloCompliance{}
+				groupLabels[key] = labels
+				groupSLOs[key] = slo
+			}
+			groups[key].add(slo, window, burnRateWindow)
+		}
+	}
+
+	for key, compliance := range groups {
+		compliance.collect(ch, "azure_resource_health_group_slo", groupSLOs[key], groupLabels[key])
+	}
+}
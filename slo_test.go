@@ -0,0 +1,171 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/stretchr/testify/mock"
+)
+
+const sloConfig = `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+    slo:
+      name: vms
+      target: 0.5
+      window: 10h
+      group_by_tags:
+        - Monitoring
+`
+
+func TestLoadConfigContent_SLODefaults(t *testing.T) {
+	got, err := loadConfigContent([]byte(`
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+    slo:
+      target: 0.999
+`))
+	if err != nil {
+		t.Fatalf("Error on loading config %v", err)
+	}
+
+	slo := got.ResourceConfigurations[0].SLO
+	if slo.Name != "slo_0" || slo.Window != DefaultSLOWindow || slo.BurnRateWindow != DefaultSLOBurnRateWindow {
+		t.Errorf("Unexpected defaults: %+v", slo)
+	}
+	if !slo.isBad("Unavailable") || slo.isBad("Unknown") {
+		t.Errorf("Unexpected bad states: %v", slo.BadStates)
+	}
+	if got.MaxSLOWindow() != DefaultSLOWindow {
+		t.Errorf("Unexpected max SLO window: %v", got.MaxSLOWindow())
+	}
+}
+
+func TestLoadConfigContent_SLOInvalidTarget(t *testing.T) {
+	_, err := loadConfigContent([]byte(`
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+    slo:
+      target: 99.9
+`))
+	if err == nil {
+		t.Errorf("Should have an error with a target above 1")
+	}
+}
+
+func TestLoadConfigContent_SLOCollisions(t *testing.T) {
+	for name, slos := range map[string][2]string{
+		"same name":        {"{name: gold, target: 0.9}", "{name: gold, target: 0.99}"},
+		"same default":     {"{name: slo_1, target: 0.9}", "{target: 0.99}"},
+		"same group label": {"{target: 0.9, group_by_tags: [Env, env]}", "{target: 0.99}"},
+	} {
+		_, err := loadConfigContent([]byte(`
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+    slo: ` + slos[0] + `
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Web/sites"
+    slo: ` + slos[1] + `
+`))
+		if err == nil {
+			t.Errorf("Should have an error with SLOs of the %s", name)
+		}
+	}
+}
+
+func TestCollect_SLOs(t *testing.T) {
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+	now := time.Unix(1500000000, 0)
+	collector.now = func() time.Time { return now }
+	collector.states.now = collector.now
+
+	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	asID := resourceID + AvailabilityStatusIDSuffix
+	rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+		{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable}},
+	}, nil)
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	// Unavailable for the last 30 minutes of the 10h window, and half of the 1h burn rate window
+	collector.states.Restore(map[string]*ResourceState{
+		normalizeResourceID(resourceID): &ResourceState{
+			Labels:     map[string]string{"subscription_id": "my_subscription"},
+			State:      "Unavailable",
+			Since:      now.Add(-30 * time.Minute),
+			LastUpdate: now,
+			History: []StatePeriod{
+				{State: "Available", Start: now.Add(-100 * time.Hour)},
+				{State: "Unavailable", Start: now.Add(-30 * time.Minute)},
+			},
+		},
+	})
+
+	rr := CallExporterWithConfig(collector, sloConfig)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Wrong status code: got %v, want %v", status, http.StatusOK)
+	}
+
+	resourceLabels := `resource_group="my_rg",resource_name="my_instance",resource_type="Microsoft.Compute/virtualMachines",slo="vms",subscription_id="my_subscription"`
+	for _, want := range []string{
+		`azure_resource_health_slo_target{slo="vms"} 0.5`,
+		`azure_resource_health_slo_availability_ratio{` + resourceLabels + `} 0.95`,
+		`azure_resource_health_slo_error_budget_remaining_ratio{` + resourceLabels + `} 0.9`,
+		`azure_resource_health_slo_burn_rate{` + resourceLabels + `} 1`,
+		`azure_resource_health_group_slo_availability_ratio{slo="vms",tag_monitoring="enabled"} 0.95`,
+		`azure_resource_health_group_slo_error_budget_remaining_ratio{slo="vms",tag_monitoring="enabled"} 0.9`,
+		`azure_resource_health_group_slo_burn_rate{slo="vms",tag_monitoring="enabled"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Missing %v in body %v", want, rr.Body.String())
+		}
+	}
+}
+
+func TestStateTracker_StateDurations(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tracker := NewStateTracker()
+	tracker.Restore(map[string]*ResourceState{
+		normalizeResourceID(trackedResourceID): &ResourceState{
+			State: "Available",
+			History: []StatePeriod{
+				{State: "Available", Start: now.Add(-3 * time.Hour)},
+				{State: "Unknown", Start: now.Add(-2 * time.Hour)},
+				{State: "Available", Start: now.Add(-time.Hour)},
+			},
+		},
+	})
+
+	durations := tracker.StateDurations(trackedResourceID, now.Add(-90*time.Minute), now)
+	if durations["Available"] != time.Hour || durations["Unknown"] != time.Hour/2 {
+		t.Errorf("Unexpected durations: %v", durations)
+	}
+	if tracker.StateDurations("unknown_resource", now.Add(-time.Hour), now) != nil {
+		t.Error("Unexpected durations of an unknown resource")
+	}
+}
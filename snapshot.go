@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+)
+
+// Snapshot is the state of the monitored resources, as fetched from Azure
+type Snapshot struct {
+	Subscriptions []*SubscriptionSnapshot
+	TimedOut      bool
+	FetchedAt     time.Time
+}
+
+// SubscriptionSnapshot is the state of the monitored resources of a subscription
+type SubscriptionSnapshot struct {
+	SubscriptionID string
+	// ResourceTypes lists the collected resource types, in configuration order
+	ResourceTypes      []string
+	TypeSuccess        map[string]bool
+	Resources          []MonitoredResource
+	RateLimitRemaining string
+}
+
+// MonitoredResource is a configured resource along with its availability status
+type MonitoredResource struct {
+	Resource           resources.GenericResource
+	AvailabilityStatus resourcehealth.AvailabilityStatus
+	// Labels identify the resource in metrics
+	Labels map[string]string
+	// Children are the availability statuses of the child resources, fetched for configurations enabling child_resources
+	Children []resourcehealth.AvailabilityStatus
+}
+
+// NewSubscriptionSnapshot returns an empty subscription snapshot
+func NewSubscriptionSnapshot(subscriptionID string) *SubscriptionSnapshot {
+	return &SubscriptionSnapshot{
+		SubscriptionID: subscriptionID,
+		TypeSuccess:    make(map[string]bool),
+	}
+}
+
+// SetTypeResult records the collect result of a resource type
+// A resource type may be part of many configurations, it is successful only if all of them succeed
+func (s *SubscriptionSnapshot) SetTypeResult(resourceType string, success bool) {
+	previous, ok := s.TypeSuccess[resourceType]
+	if !ok {
+		s.ResourceTypes = append(s.ResourceTypes, resourceType)
+		previous = true
+	}
+	s.TypeSuccess[resourceType] = previous && success
+}
+
+// Fetched returns whether the availability statuses of the subscription were fetched,
+// its resources being unknown otherwise
+func (s *SubscriptionSnapshot) Fetched() bool {
+	return s.TypeSuccess[AvailabilityStatusesResourceType]
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ResourceState is the availability state history of a resource, as tracked between fetches
+type ResourceState struct {
+	Labels map[string]string `json:"labels"`
+	State  string            `json:"state"`
+	// Since is when the resource entered its current state
+	Since time.Time `json:"since"`
+	// LastUpdate is the time up to which Seconds have been accounted
+	LastUpdate time.Time `json:"last_update"`
+	// Transitions counts transitions by previous and next state
+	Transitions map[string]map[string]float64 `json:"transitions"`
+	// Seconds is the total time spent in each state
+	Seconds map[string]float64 `json:"seconds"`
+	// History lists the states entered by the resource, oldest first, as far back as the longest SLO or flapping window
+	History []StatePeriod `json:"history"`
+	// Exported is the state exported once settled according to the hysteresis of the resource
+	Exported string `json:"exported_state,omitempty"`
+	// Candidate is the state waiting to settle, seen for CandidatePolls consecutive fetches
+	Candidate      string `json:"candidate_state,omitempty"`
+	CandidatePolls int    `json:"candidate_polls,omitempty"`
+}
+
+// StatePeriod is an availability state and the time the resource entered it
+type StatePeriod struct {
+	State string    `json:"state"`
+	Start time.Time `json:"start"`
+}
+
+// StateTransition is a change of the availability state of a resource
+type StateTransition struct {
+	ResourceID   string
+	ResourceType string
+	Tags         map[string]*string
+	Labels       map[string]string
+	From         string
+	To           string
+	Time         time.Time
+	ReasonType   string
+	Summary      string
+}
+
+// StateTracker remembers the availability state of resources between fetches
+type StateTracker struct {
+	mutex  sync.Mutex
+	states map[string]*ResourceState
+	now    func() time.Time
+}
+
+// NewStateTracker returns a tracker without any known state
+func NewStateTracker() *StateTracker {
+	return &StateTracker{
+		states: make(map[string]*ResourceState),
+		now:    time.Now,
+	}
+}
+
+// Update tracks the availability states of a new snapshot, and returns the transitions of the exported states
+// Transitions detected late are backdated to the time Azure reports them to have occurred.
+// For resources with hysteresis, a transition is only returned once the new state has settled.
+// Resources which are no longer monitored are forgotten, unless their subscription failed to be fetched.
+func (t *StateTracker) Update(snapshot *Snapshot) []StateTransition {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.now()
+	var transitions []StateTransition
+	seen := make(map[string]bool)
+	fetchedSubscriptions := make(map[string]bool)
+
+	for _, subscriptionSnapshot := range snapshot.Subscriptions {
+		if subscriptionSnapshot.TypeSuccess[AvailabilityStatusesResourceType] {
+			fetchedSubscriptions[subscriptionSnapshot.SubscriptionID] = true
+		}
+		for i := range subscriptionSnapshot.Resources {
+			resource := &subscriptionSnapshot.Resources[i]
+			id := normalizeResourceID(*resource.Resource.ID)
+			seen[id] = true
+			transitions = append(transitions, t.observe(id, resource, now)...)
+		}
+	}
+
+	cutoff := now.Add(-config.HistoryRetention())
+	for id, state := range t.states {
+		if !seen[id] && fetchedSubscriptions[state.Labels["subscription_id"]] {
+			delete(t.states, id)
+			continue
+		}
+		state.pruneHistory(cutoff)
+	}
+
+	return transitions
+}
+
+// observe tracks the current availability status of a resource
+func (t *StateTracker) observe(id string, resource *MonitoredResource, now time.Time) []StateTransition {
+	properties := resource.AvailabilityStatus.Properties
+	current := availabilityState(&resource.AvailabilityStatus)
+	occurred := now
+	if properties != nil && properties.OccuredTime != nil {
+		occurred = properties.OccuredTime.Time
+	}
+
+	state, ok := t.states[id]
+	if !ok {
+		since := clampTime(occurred, time.Time{}, now)
+		t.states[id] = &ResourceState{
+			Labels:      copyLabels(resource.Labels),
+			State:       current,
+			Since:       since,
+			LastUpdate:  now,
+			Transitions: make(map[string]map[string]float64),
+			Seconds:     make(map[string]float64),
+			History:     []StatePeriod{{State: current, Start: since}},
+			Exported:    current,
+		}
+		return nil
+	}
+	state.Labels = copyLabels(resource.Labels)
+
+	var transitions []StateTransition
+	record := func(from string, to string, at time.Time, summary *string) {
+		state.Seconds[from] += at.Sub(state.LastUpdate).Seconds()
+		if state.Transitions[from] == nil {
+			state.Transitions[from] = make(map[string]float64)
+		}
+		state.Transitions[from][to]++
+		state.State = to
+		state.Since = at
+		state.LastUpdate = at
+		state.History = append(state.History, StatePeriod{State: to, Start: at})
+
+		transitions = append(transitions, newStateTransition(resource, from, to, at, summary))
+	}
+
+	// An unavailability which started and was resolved between two fetches is only
+	// reported by Azure as a recently resolved state
+	if properties != nil && state.State == string(resourcehealth.Available) && current == string(resourcehealth.Available) {
+		if resolved := properties.RecentlyResolvedState; resolved != nil && resolved.ResolvedTime != nil && resolved.UnavailableOccurredTime != nil &&
+			resolved.ResolvedTime.Time.After(state.LastUpdate) {
+			resolvedAt := clampTime(resolved.ResolvedTime.Time, state.LastUpdate, now)
+			unavailableAt := clampTime(resolved.UnavailableOccurredTime.Time, state.LastUpdate, resolvedAt)
+			record(string(resourcehealth.Available), string(resourcehealth.Unavailable), unavailableAt, resolved.UnavailabilitySummary)
+			record(string(resourcehealth.Unavailable), string(resourcehealth.Available), resolvedAt, properties.Summary)
+		}
+	}
+
+	if current != state.State {
+		var summary *string
+		if properties != nil {
+			summary = properties.Summary
+		}
+		record(state.State, current, clampTime(occurred, state.LastUpdate, now), summary)
+	}
+
+	state.Seconds[state.State] += now.Sub(state.LastUpdate).Seconds()
+	state.LastUpdate = now
+
+	exported := state.Exported
+	hysteresis := resourceHysteresis(resource)
+	changed := state.debounce(hysteresis, now)
+	if hysteresis == nil {
+		return transitions
+	}
+	if !changed {
+		return nil
+	}
+	var summary *string
+	if properties != nil {
+		summary = properties.Summary
+	}
+	return []StateTransition{newStateTransition(resource, exported, state.Exported, state.Since, summary)}
+}
+
+// newStateTransition returns a transition of a resource, with the reason of its current availability status
+func newStateTransition(resource *MonitoredResource, from string, to string, at time.Time, summary *string) StateTransition {
+	transition := StateTransition{
+		ResourceID: *resource.Resource.ID,
+		Tags:       resource.Resource.Tags,
+		Labels:     copyLabels(resource.Labels),
+		From:       from,
+		To:         to,
+		Time:       at,
+	}
+	if resource.Resource.Type != nil {
+		transition.ResourceType = *resource.Resource.Type
+	}
+	if properties := resource.AvailabilityStatus.Properties; properties != nil && properties.ReasonType != nil {
+		transition.ReasonType = *properties.ReasonType
+	}
+	if summary != nil {
+		transition.Summary = *summary
+	}
+	return transition
+}
+
+// States returns a copy of the tracked states
+func (t *StateTracker) States() map[string]*ResourceState {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	states := make(map[string]*ResourceState, len(t.states))
+	for id, state := range t.states {
+		copied := *state
+		copied.Labels = copyLabels(state.Labels)
+		copied.Transitions = make(map[string]map[string]float64, len(state.Transitions))
+		for from, toCounts := range state.Transitions {
+			copied.Transitions[from] = make(map[string]float64, len(toCounts))
+			for to, count := range toCounts {
+				copied.Transitions[from][to] = count
+			}
+		}
+		copied.Seconds = make(map[string]float64, len(state.Seconds))
+		for availabilityState, seconds := range state.Seconds {
+			copied.Seconds[availabilityState] = seconds
+		}
+		copied.History = append([]StatePeriod(nil), state.History...)
+		states[id] = &copied
+	}
+	return states
+}
+
+// Restore replaces the tracked states, e.g. with the ones saved before a restart
+// The time during which the exporter was down is accounted to the restored state on the next update.
+func (t *StateTracker) Restore(states map[string]*ResourceState) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.states = make(map[string]*ResourceState, len(states))
+	for id, state := range states {
+		if state.Transitions == nil {
+			state.Transitions = make(map[string]map[string]float64)
+		}
+		if state.Seconds == nil {
+			state.Seconds = make(map[string]float64)
+		}
+		if len(state.History) == 0 {
+			state.History = []StatePeriod{{State: state.State, Start: state.Since}}
+		}
+		t.states[id] = state
+	}
+}
+
+// StateDurations returns the time spent by a resource in each state between start and end,
+// as far as its history goes. It returns nil if the resource is not tracked.
+func (t *StateTracker) StateDurations(resourceID string, start time.Time, end time.Time) map[string]time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	state, ok := t.states[normalizeResourceID(resourceID)]
+	if !ok {
+		return nil
+	}
+
+	durations := make(map[string]time.Duration)
+	for i, period := range state.History {
+		periodEnd := end
+		if i+1 < len(state.History) {
+			periodEnd = state.History[i+1].Start
+		}
+		periodStart := clampTime(period.Start, start, end)
+		periodEnd = clampTime(periodEnd, start, end)
+		if periodEnd.After(periodStart) {
+			durations[period.State] += periodEnd.Sub(periodStart)
+		}
+	}
+	return durations
+}
+
+// pruneHistory forgets the states left before cutoff
+func (s *ResourceState) pruneHistory(cutoff time.Time) {
+	first := 0
+	for first+1 < len(s.History) && !s.History[first+1].Start.After(cutoff) {
+		first++
+	}
+	s.History = s.History[first:]
+}
+
+// Collect exports the tracked states
+func (t *StateTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, state := range t.states {
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("azure_resource_health_current_state_since_timestamp", "Timestamp at which the resource entered its current availability state", nil, state.Labels),
+			prometheus.GaugeValue,
+			float64(state.Since.UnixNano())/1e9,
+		)
+
+		for from, toCounts := range state.Transitions {
+			for to, count := range toCounts {
+				labels := copyLabels(state.Labels)
+				labels["from"] = from
+				labels["to"] = to
+				ch <- prometheus.MustNewConstMetric(
+					prometheus.NewDesc("azure_resource_health_state_transitions_total", "Total number of availability state transitions of the resource", nil, labels),
+					prometheus.CounterValue,
+					count,
+				)
+			}
+		}
+
+		for availabilityState, seconds := range state.Seconds {
+			labels := copyLabels(state.Labels)
+			labels["state"] = availabilityState
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc("azure_resource_health_state_seconds_total", "Total time spent by the resource in each availability state", nil, labels),
+				prometheus.CounterValue,
+				seconds,
+			)
+		}
+	}
+}
+
+// availabilityState returns the availability state of a status, Unknown if not provided
+func availabilityState(as *resourcehealth.AvailabilityStatus) string {
+	if as.Properties == nil || as.Properties.AvailabilityState == "" {
+		return string(resourcehealth.Unknown)
+	}
+	return string(as.Properties.AvailabilityState)
+}
+
+// clampTime returns t bounded by min and max
+func clampTime(t time.Time, min time.Time, max time.Time) time.Time {
+	if t.Before(min) {
+		return min
+	}
+	if t.After(max) {
+		return max
+	}
+	return t
+}
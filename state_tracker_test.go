@@ -0,0 +1,164 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+const trackedResourceID = "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/my_instance"
+
+func trackedSnapshot(properties *resourcehealth.AvailabilityStatusProperties) *Snapshot {
+	resourceID := trackedResourceID
+	snapshot := NewSubscriptionSnapshot("my_subscription")
+	snapshot.SetTypeResult(AvailabilityStatusesResourceType, true)
+	snapshot.Resources = append(snapshot.Resources, MonitoredResource{
+		Resource:           resources.GenericResource{ID: &resourceID},
+		AvailabilityStatus: resourcehealth.AvailabilityStatus{Properties: properties},
+		Labels:             map[string]string{"subscription_id": "my_subscription", "resource_name": "my_instance"},
+	})
+	return &Snapshot{Subscriptions: []*SubscriptionSnapshot{snapshot}}
+}
+
+func TestStateTracker_Update_BackdatesTransitions(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tracker := NewStateTracker()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Update(trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}))
+
+	now = now.Add(time.Minute)
+	occurred := date.Time{Time: now.Add(-20 * time.Second)}
+	transitions := tracker.Update(trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{
+		AvailabilityState: resourcehealth.Unavailable,
+		OccuredTime:       &occurred,
+	}))
+
+	if len(transitions) != 1 {
+		t.Fatalf("Unexpected transitions: %v", transitions)
+	}
+	if transitions[0].From != "Available" || transitions[0].To != "Unavailable" || !transitions[0].Time.Equal(occurred.Time) {
+		t.Errorf("Unexpected transition: %v", transitions[0])
+	}
+
+	state := tracker.states[normalizeResourceID(trackedResourceID)]
+	if !state.Since.Equal(occurred.Time) {
+		t.Errorf("Unexpected since: got %v, want %v", state.Since, occurred.Time)
+	}
+	if state.Seconds["Available"] != 40 || state.Seconds["Unavailable"] != 20 {
+		t.Errorf("Unexpected seconds: %v", state.Seconds)
+	}
+	if state.Transitions["Available"]["Unavailable"] != 1 {
+		t.Errorf("Unexpected transitions count: %v", state.Transitions)
+	}
+}
+
+func TestStateTracker_Update_ClampsOccurredTime(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tracker := NewStateTracker()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Update(trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}))
+
+	// A transition can not be backdated before the previous update
+	now = now.Add(time.Minute)
+	occurred := date.Time{Time: now.Add(-time.Hour)}
+	tracker.Update(trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{
+		AvailabilityState: resourcehealth.Unavailable,
+		OccuredTime:       &occurred,
+	}))
+
+	state := tracker.states[normalizeResourceID(trackedResourceID)]
+	if !state.Since.Equal(now.Add(-time.Minute)) {
+		t.Errorf("Unexpected since: got %v, want %v", state.Since, now.Add(-time.Minute))
+	}
+	if state.Seconds["Available"] != 0 || state.Seconds["Unavailable"] != 60 {
+		t.Errorf("Unexpected seconds: %v", state.Seconds)
+	}
+}
+
+func TestStateTracker_Update_RecentlyResolved(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tracker := NewStateTracker()
+	tracker.now = func() time.Time { return now }
+
+	tracker.Update(trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}))
+
+	now = now.Add(time.Minute)
+	properties := &resourcehealth.AvailabilityStatusProperties{
+		AvailabilityState: resourcehealth.Available,
+		RecentlyResolvedState: &resourcehealth.AvailabilityStatusPropertiesRecentlyResolvedState{
+			UnavailableOccurredTime: &date.Time{Time: now.Add(-50 * time.Second)},
+			ResolvedTime:            &date.Time{Time: now.Add(-30 * time.Second)},
+		},
+	}
+	transitions := tracker.Update(trackedSnapshot(properties))
+	if len(transitions) != 2 {
+		t.Fatalf("Unexpected transitions: %v", transitions)
+	}
+
+	// The same resolved state is only counted once
+	now = now.Add(time.Minute)
+	transitions = tracker.Update(trackedSnapshot(properties))
+	if len(transitions) != 0 {
+		t.Fatalf("Unexpected transitions: %v", transitions)
+	}
+
+	state := tracker.states[normalizeResourceID(trackedResourceID)]
+	if state.Transitions["Available"]["Unavailable"] != 1 || state.Transitions["Unavailable"]["Available"] != 1 {
+		t.Errorf("Unexpected transitions count: %v", state.Transitions)
+	}
+	if state.Seconds["Available"] != 100 || state.Seconds["Unavailable"] != 20 {
+		t.Errorf("Unexpected seconds: %v", state.Seconds)
+	}
+}
+
+func TestStateTracker_Update_Prunes(t *testing.T) {
+	tracker := NewStateTracker()
+	tracker.Update(trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Available}))
+
+	// Resources are kept while their subscription fails to be fetched
+	failed := NewSubscriptionSnapshot("my_subscription")
+	failed.SetTypeResult(AvailabilityStatusesResourceType, false)
+	tracker.Update(&Snapshot{Subscriptions: []*SubscriptionSnapshot{failed}})
+	if len(tracker.states) != 1 {
+		t.Errorf("Unexpected states: %v", tracker.states)
+	}
+
+	succeeded := NewSubscriptionSnapshot("my_subscription")
+	succeeded.SetTypeResult(AvailabilityStatusesResourceType, true)
+	tracker.Update(&Snapshot{Subscriptions: []*SubscriptionSnapshot{succeeded}})
+	if len(tracker.states) != 0 {
+		t.Errorf("Unexpected states: %v", tracker.states)
+	}
+}
+
+func TestStateTracker_Update_PrunesHistory(t *testing.T) {
+	loadConfigContent([]byte(`
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+    slo:
+      target: 0.99
+      window: 1h
+`))
+	now := time.Unix(1500000000, 0)
+	tracker := NewStateTracker()
+	tracker.now = func() time.Time { return now }
+
+	for _, state := range []resourcehealth.AvailabilityStateValues{resourcehealth.Available, resourcehealth.Unavailable, resourcehealth.Available} {
+		tracker.Update(trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: state}))
+		now = now.Add(time.Hour)
+	}
+
+	// The state entered before the window is kept, as it lasted into the window
+	history := tracker.states[normalizeResourceID(trackedResourceID)].History
+	if len(history) != 2 || history[0].State != "Unavailable" {
+		t.Errorf("Unexpected history: %v", history)
+	}
+}
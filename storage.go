@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/pkg/errors"
+)
+
+// StorageFileName is the name of the state file in the storage directory
+const StorageFileName = "state.json"
+
+// storageVersion is the version of the state file format
+const storageVersion = 1
+
+// Store persists the exporter state to disk, as a JSON snapshot file
+type Store struct {
+	path string
+}
+
+// PersistedState is the exporter state saved after each fetch
+type PersistedState struct {
+	Snapshot           *Snapshot
+	States             map[string]*ResourceState
+	MaintenanceWindows []*MaintenanceWindow
+}
+
+// storedState is the on-disk representation of a PersistedState
+type storedState struct {
+	Version            int                       `json:"version"`
+	FetchedAt          time.Time                 `json:"fetched_at"`
+	Subscriptions      []storedSubscription      `json:"subscriptions"`
+	States             map[string]*ResourceState `json:"states"`
+	MaintenanceWindows []*MaintenanceWindow      `json:"maintenance_windows,omitempty"`
+}
+
+type storedSubscription struct {
+	SubscriptionID     string           `json:"subscription_id"`
+	ResourceTypes      []string         `json:"resource_types"`
+	TypeSuccess        map[string]bool  `json:"type_success"`
+	RateLimitRemaining string           `json:"rate_limit_remaining"`
+	Resources          []storedResource `json:"resources"`
+}
+
+// storedResource holds the resource fields in use, as the SDK does not marshal read-only fields such as the ID
+type storedResource struct {
+	ID                 *string                             `json:"id"`
+	Name               *string                             `json:"name,omitempty"`
+	Type               *string                             `json:"type,omitempty"`
+	Location           *string                             `json:"location,omitempty"`
+	Kind               *string                             `json:"kind,omitempty"`
+	Tags               map[string]*string                  `json:"tags,omitempty"`
+	ManagedBy          *string                             `json:"managed_by,omitempty"`
+	Properties         interface{}                         `json:"properties,omitempty"`
+	AvailabilityStatus resourcehealth.AvailabilityStatus   `json:"availability_status"`
+	Labels             map[string]string                   `json:"labels"`
+	Children           []resourcehealth.AvailabilityStatus `json:"children,omitempty"`
+}
+
+// NewStore returns a store saving its state file in the directory path
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// Save writes the state, replacing the previous one atomically
+func (s *Store) Save(state *PersistedState) error {
+	stored := storedState{
+		Version:            storageVersion,
+		FetchedAt:          state.Snapshot.FetchedAt,
+		States:             state.States,
+		MaintenanceWindows: state.MaintenanceWindows,
+	}
+	for _, subscription := range state.Snapshot.Subscriptions {
+		storedSubscription := storedSubscription{
+			SubscriptionID:     subscription.SubscriptionID,
+			ResourceTypes:      subscription.ResourceTypes,
+			TypeSuccess:        subscription.TypeSuccess,
+			RateLimitRemaining: subscription.RateLimitRemaining,
+		}
+		for _, resource := range subscription.Resources {
+			storedSubscription.Resources = append(storedSubscription.Resources, storedResource{
+				ID:                 resource.Resource.ID,
+				Name:               resource.Resource.Name,
+				Type:               resource.Resource.Type,
+				Location:           resource.Resource.Location,
+				Kind:               resource.Resource.Kind,
+				Tags:               resource.Resource.Tags,
+				ManagedBy:          resource.Resource.ManagedBy,
+				Properties:         resource.Resource.Properties,
+				AvailabilityStatus: resource.AvailabilityStatus,
+				Labels:             resource.Labels,
+				Children:           resource.Children,
+			})
+		}
+		stored.Subscriptions = append(stored.Subscriptions, storedSubscription)
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return errors.Wrap(err, "error encoding state")
+	}
+
+	if err := os.MkdirAll(s.path, 0755); err != nil {
+		return errors.Wrap(err, "error creating storage directory")
+	}
+	tmpFile, err := ioutil.TempFile(s.path, StorageFileName+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "error creating state file")
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return errors.Wrap(err, "error writing state file")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrap(err, "error writing state file")
+	}
+	return errors.Wrap(os.Rename(tmpFile.Name(), filepath.Join(s.path, StorageFileName)), "error replacing state file")
+}
+
+// Load reads the saved state, nil if none was saved yet
+func (s *Store) Load() (*PersistedState, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.path, StorageFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading state file")
+	}
+
+	var stored storedState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, errors.Wrap(err, "error decoding state file")
+	}
+	if stored.Version != storageVersion {
+		return nil, errors.Errorf("unsupported state file version %d", stored.Version)
+	}
+
+	state := &PersistedState{
+		Snapshot:           &Snapshot{FetchedAt: stored.FetchedAt},
+		States:             stored.States,
+		MaintenanceWindows: stored.MaintenanceWindows,
+	}
+	if state.States == nil {
+		state.States = make(map[string]*ResourceState)
+	}
+	for _, storedSubscription := range stored.Subscriptions {
+		subscription := NewSubscriptionSnapshot(storedSubscription.SubscriptionID)
+		subscription.ResourceTypes = storedSubscription.ResourceTypes
+		subscription.RateLimitRemaining = storedSubscription.RateLimitRemaining
+		for resourceType, success := range storedSubscription.TypeSuccess {
+			subscription.TypeSuccess[resourceType] = success
+		}
+		for _, resource := range storedSubscription.Resources {
+			subscription.Resources = append(subscription.Resources, MonitoredResource{
+				Resource: resources.GenericResource{
+					ID:         resource.ID,
+					Name:       resource.Name,
+					Type:       resource.Type,
+					Location:   resource.Location,
+					Kind:       resource.Kind,
+					Tags:       resource.Tags,
+					ManagedBy:  resource.ManagedBy,
+					Properties: resource.Properties,
+				},
+				AvailabilityStatus: resource.AvailabilityStatus,
+				Labels:             resource.Labels,
+				Children:           resource.Children,
+			})
+		}
+		state.Snapshot.Subscriptions = append(state.Snapshot.Subscriptions, subscription)
+	}
+	return state, nil
+}
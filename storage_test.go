@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+)
+
+func TestStore_Load_Missing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-health-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state, err := NewStore(dir).Load()
+	if err != nil {
+		t.Errorf("Error occured %s", err)
+	}
+	if state != nil {
+		t.Errorf("Unexpected state: %v", state)
+	}
+}
+
+func TestStore_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azure-health-exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot := trackedSnapshot(&resourcehealth.AvailabilityStatusProperties{AvailabilityState: resourcehealth.Unavailable})
+	snapshot.FetchedAt = time.Unix(1500000000, 0).UTC()
+	resourceType := "Microsoft.Compute/virtualMachines"
+	snapshot.Subscriptions[0].Resources[0].Resource.Type = &resourceType
+	snapshot.Subscriptions[0].RateLimitRemaining = "99"
+	states := map[string]*ResourceState{
+		normalizeResourceID(trackedResourceID): &ResourceState{
+			Labels:      map[string]string{"subscription_id": "my_subscription"},
+			State:       "Unavailable",
+			Since:       time.Unix(1400000000, 0).UTC(),
+			LastUpdate:  time.Unix(1500000000, 0).UTC(),
+			Transitions: map[string]map[string]float64{"Available": {"Unavailable": 1}},
+			Seconds:     map[string]float64{"Available": 10, "Unavailable": 20},
+		},
+	}
+
+	windows := []*MaintenanceWindow{{
+		ID:               "upgrade",
+		Name:             "upgrade",
+		Source:           MaintenanceSourceAPI,
+		Start:            time.Unix(1500000000, 0).UTC(),
+		End:              time.Unix(1500003600, 0).UTC(),
+		ResourceSelector: ResourceSelector{ResourceIDs: []string{trackedResourceID}},
+	}}
+
+	store := NewStore(dir)
+	if err := store.Save(&PersistedState{Snapshot: snapshot, States: states, MaintenanceWindows: windows}); err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+	state, err := store.Load()
+	if err != nil {
+		t.Fatalf("Error occured %s", err)
+	}
+
+	if !reflect.DeepEqual(state.Snapshot, snapshot) {
+		t.Errorf("Unexpected snapshot: got %+v, want %+v", state.Snapshot, snapshot)
+	}
+	if !reflect.DeepEqual(state.States, states) {
+		t.Errorf("Unexpected states: got %+v, want %+v", state.States, states)
+	}
+	if !reflect.DeepEqual(state.MaintenanceWindows, windows) {
+		t.Errorf("Unexpected maintenance windows: got %+v, want %+v", state.MaintenanceWindows, windows)
+	}
+}
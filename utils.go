@@ -34,6 +34,15 @@ func ParseResourceID(resourceID string) (map[string]string, error) {
 	return info, nil
 }
 
+// copyLabels returns a copy of a labels map
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
 // CreateAllLabels creates label from Tags map and existing labels map
 func CreateAllLabels(tags map[string]*string, resourceType *string, labels map[string]string) map[string]string {
 	labels["resource_type"] = *resourceType
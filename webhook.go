@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Defaults of the webhook delivery options
+const (
+	DefaultWebhookMaxAttempts = 3
+	DefaultWebhookMinBackoff  = time.Second
+	DefaultWebhookMaxBackoff  = 30 * time.Second
+	DefaultWebhookTimeout     = 10 * time.Second
+	DefaultWebhookQueueSize   = 1000
+)
+
+// Results of notifications
+const (
+	NotificationResultSuccess = "success"
+	NotificationResultFailure = "failure"
+	NotificationResultDropped = "dropped"
+)
+
+// WebhookConfig is a URL to which availability state transitions are posted
+type WebhookConfig struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// Template of the payload, executed on the WebhookEvent, the event as JSON by default
+	Template    string        `yaml:"template"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	MinBackoff  time.Duration `yaml:"min_backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// Transitions of all the monitored resources are posted when no resource is selected
+	ResourceSelector `yaml:",inline"`
+
+	template *template.Template
+}
+
+// WebhookEvent is the availability state transition posted to webhooks
+type WebhookEvent struct {
+	ResourceID     string            `json:"resource_id"`
+	SubscriptionID string            `json:"subscription_id"`
+	ResourceGroup  string            `json:"resource_group"`
+	ResourceName   string            `json:"resource_name"`
+	ResourceType   string            `json:"resource_type"`
+	Labels         map[string]string `json:"labels"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	PreviousState  string            `json:"previous_state"`
+	State          string            `json:"state"`
+	ReasonType     string            `json:"reason_type,omitempty"`
+	Summary        string            `json:"summary,omitempty"`
+	// OccurredAt is when Azure reports the transition to have occurred, DetectedAt when the exporter noticed it
+	OccurredAt time.Time `json:"occurred_at"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// webhookTemplateFuncs are the functions available to payload templates
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// init validates the webhook and sets its defaults
+func (w *WebhookConfig) init() error {
+	if w.Name == "" {
+		return errors.New("webhook name is mandatory")
+	}
+	if parsed, err := url.Parse(w.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.Errorf("webhook %s url %q must be an absolute http(s) URL", w.Name, w.URL)
+	}
+	if w.MaxAttempts < 0 || w.MinBackoff < 0 || w.MaxBackoff < 0 || w.Timeout < 0 {
+		return errors.Errorf("webhook %s delivery options must not be negative", w.Name)
+	}
+	if w.MaxAttempts == 0 {
+		w.MaxAttempts = DefaultWebhookMaxAttempts
+	}
+	if w.MinBackoff == 0 {
+		w.MinBackoff = DefaultWebhookMinBackoff
+	}
+	if w.MaxBackoff == 0 {
+		w.MaxBackoff = DefaultWebhookMaxBackoff
+	}
+	if w.Timeout == 0 {
+		w.Timeout = DefaultWebhookTimeout
+	}
+	if w.Template != "" {
+		var err error
+		if w.template, err = template.New(w.Name).Funcs(webhookTemplateFuncs).Parse(w.Template); err != nil {
+			return errors.Wrapf(err, "webhook %s template", w.Name)
+		}
+	}
+	return nil
+}
+
+// selects returns whether the transition of a resource is posted to the webhook
+func (w *WebhookConfig) selects(transition *StateTransition) bool {
+	return w.ResourceSelector.empty() || w.ResourceSelector.selects(transition.ResourceID, transition.ResourceType, transition.Tags)
+}
+
+// payload returns the body posted for an event
+func (w *WebhookConfig) payload(event *WebhookEvent) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(event)
+	}
+	var buffer bytes.Buffer
+	err := w.template.Execute(&buffer, event)
+	return buffer.Bytes(), err
+}
+
+// newWebhookEvent returns the event of a transition detected at detectedAt
+func newWebhookEvent(transition *StateTransition, detectedAt time.Time) *WebhookEvent {
+	event := &WebhookEvent{
+		ResourceID:     transition.ResourceID,
+		SubscriptionID: transition.Labels["subscription_id"],
+		ResourceGroup:  transition.Labels["resource_group"],
+		ResourceName:   transition.Labels["resource_name"],
+		ResourceType:   transition.ResourceType,
+		Labels:         copyLabels(transition.Labels),
+		PreviousState:  transition.From,
+		State:          transition.To,
+		ReasonType:     transition.ReasonType,
+		Summary:        transition.Summary,
+		OccurredAt:     transition.Time,
+		DetectedAt:     detectedAt,
+	}
+	if len(transition.Tags) > 0 {
+		event.Tags = make(map[string]string, len(transition.Tags))
+		for name, value := range transition.Tags {
+			if value != nil {
+				event.Tags[name] = *value
+			}
+		}
+	}
+	return event
+}
+
+// WebhookNotifier posts availability state transitions to the configured webhooks
+// Each webhook is delivered in order by its own goroutine, so that a slow webhook does not delay the others.
+type WebhookNotifier struct {
+	sinks         []*webhookSink
+	mutex         sync.RWMutex
+	closed        bool
+	stop          chan struct{}
+	wait          sync.WaitGroup
+	now           func() time.Time
+	notifications *prometheus.CounterVec
+}
+
+// webhookSink is the delivery queue of a webhook
+type webhookSink struct {
+	config *WebhookConfig
+	client *http.Client
+	queue  chan *WebhookEvent
+	stop   <-chan struct{}
+}
+
+// NewWebhookNotifier returns a notifier of webhooks, delivering their events until closed
+func NewWebhookNotifier(webhooks []WebhookConfig) *WebhookNotifier {
+	n := &WebhookNotifier{
+		stop: make(chan struct{}),
+		now:  time.Now,
+		notifications: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "azure_health_exporter_webhook_notifications_total",
+				Help: "Total number of availability state transitions notified to a webhook by result",
+			},
+			[]string{"webhook", "result"},
+		),
+	}
+	for i := range webhooks {
+		sink := &webhookSink{
+			config: &webhooks[i],
+			client: &http.Client{Timeout: webhooks[i].Timeout},
+			queue:  make(chan *WebhookEvent, DefaultWebhookQueueSize),
+			stop:   n.stop,
+		}
+		n.sinks = append(n.sinks, sink)
+		n.wait.Add(1)
+		go func() {
+			defer n.wait.Done()
+			n.deliver(sink)
+		}()
+	}
+	return n
+}
+
+// Notify queues the transitions for the webhooks selecting their resource
+// Events are dropped when the queue of a webhook is full.
+func (n *WebhookNotifier) Notify(transitions []StateTransition) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if n.closed {
+		return
+	}
+
+	detectedAt := n.now()
+	for i := range transitions {
+		event := newWebhookEvent(&transitions[i], detectedAt)
+		for _, sink := range n.sinks {
+			if !sink.config.selects(&transitions[i]) {
+				continue
+			}
+			select {
+			case sink.queue <- event:
+			default:
+				log.Warnf("Webhook %s queue is full, dropping the transition of %s", sink.config.Name, event.ResourceID)
+				n.notifications.WithLabelValues(sink.config.Name, NotificationResultDropped).Inc()
+			}
+		}
+	}
+}
+
+// Close stops accepting events, and waits for the queued ones to be delivered
+// Retries are not waited for anymore, so that the queued events are attempted once more at most.
+// Events notified during or after the close are ignored.
+func (n *WebhookNotifier) Close() {
+	n.mutex.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.stop)
+		for _, sink := range n.sinks {
+			close(sink.queue)
+		}
+	}
+	n.mutex.Unlock()
+	n.wait.Wait()
+}
+
+// deliver posts the events of a webhook until its queue is closed
+func (n *WebhookNotifier) deliver(sink *webhookSink) {
+	for event := range sink.queue {
+		result := NotificationResultSuccess
+		if err := sink.post(event); err != nil {
+			log.Errorf("Error notifying webhook %s of the transition of %s: %v", sink.config.Name, event.ResourceID, err)
+			result = NotificationResultFailure
+		}
+		n.notifications.WithLabelValues(sink.config.Name, result).Inc()
+	}
+}
+
+// post sends an event to the webhook, retrying network errors, throttling and server errors with backoff
+func (s *webhookSink) post(event *WebhookEvent) error {
+	body, err := s.config.payload(event)
+	if err != nil {
+		return errors.Wrap(err, "rendering payload")
+	}
+	options := RetryOptions{
+		MaxAttempts: s.config.MaxAttempts,
+		MinBackoff:  s.config.MinBackoff,
+		MaxBackoff:  s.config.MaxBackoff,
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range s.config.Headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := s.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return nil
+			}
+		}
+		retryable := isRetryable(resp, err)
+		if err == nil {
+			err = errors.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		if attempt+1 >= options.MaxAttempts || !retryable {
+			return errors.Wrapf(err, "after %d attempts", attempt+1)
+		}
+
+		delay := backoffDelay(options, attempt)
+		if retryAfter, ok := parseRetryAfter(resp); ok {
+			delay = retryAfter
+			// A long Retry-After would hold the following events of the webhook
+			if delay > options.MaxBackoff {
+				delay = options.MaxBackoff
+			}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return errors.Wrapf(err, "after %d attempts, retries interrupted by close", attempt+1)
+		}
+	}
+}
+
+// Describe to satisfy the collector interface.
+func (n *WebhookNotifier) Describe(ch chan<- *prometheus.Desc) {
+	n.notifications.Describe(ch)
+}
+
+// Collect exports the notification counts
+func (n *WebhookNotifier) Collect(ch chan<- prometheus.Metric) {
+	n.notifications.Collect(ch)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/resourcehealth/mgmt/2017-07-01/resourcehealth"
+	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2019-05-01/resources"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/mock"
+)
+
+// webhookStandIn is a local HTTP server recording the bodies posted to it
+type webhookStandIn struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	bodies   []string
+	headers  []http.Header
+	statuses []int
+	// retryAfter is sent along with the given status codes when set
+	retryAfter string
+}
+
+// newWebhookStandIn returns a stand-in answering the given status codes in turn, then 200
+func newWebhookStandIn(statuses ...int) *webhookStandIn {
+	s := &webhookStandIn{statuses: statuses}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.bodies = append(s.bodies, string(body))
+		s.headers = append(s.headers, r.Header)
+		if len(s.statuses) > 0 {
+			if s.retryAfter != "" {
+				w.Header().Set("Retry-After", s.retryAfter)
+			}
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+		}
+	}))
+	return s
+}
+
+// waitNotifications waits for count notifications of a webhook to complete
+func waitNotifications(t *testing.T, notifier *WebhookNotifier, webhook string, count float64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := testutil.ToFloat64(notifier.notifications.WithLabelValues(webhook, NotificationResultSuccess)) +
+			testutil.ToFloat64(notifier.notifications.WithLabelValues(webhook, NotificationResultFailure))
+		if got >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %v notifications, got %v", count, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func webhookTransition(name string, env string) StateTransition {
+	resourceID := "/subscriptions/my_subscription/resourceGroups/my_rg/providers/Microsoft.Compute/virtualMachines/" + name
+	return StateTransition{
+		ResourceID:   resourceID,
+		ResourceType: "Microsoft.Compute/virtualMachines",
+		Tags:         map[string]*string{"Env": &env},
+		Labels:       map[string]string{"subscription_id": "my_subscription", "resource_group": "my_rg", "resource_name": name},
+		From:         "Available",
+		To:           "Unavailable",
+		Time:         time.Unix(1500000000, 0).UTC(),
+		ReasonType:   "Unplanned",
+		Summary:      "The virtual machine is down",
+	}
+}
+
+func TestLoadConfigContent_Webhooks(t *testing.T) {
+	got, err := loadConfigContent([]byte("webhooks:\n  - name: ops\n    url: https://example.com/hook\n"))
+	if err != nil {
+		t.Fatalf("Error on loading config %v", err)
+	}
+	if webhook := got.Webhooks[0]; webhook.MaxAttempts != DefaultWebhookMaxAttempts || webhook.MinBackoff != DefaultWebhookMinBackoff || webhook.Timeout != DefaultWebhookTimeout {
+		t.Errorf("Unexpected webhook defaults: %+v", webhook)
+	}
+
+	for _, configFile := range []string{
+		"webhooks:\n  - url: https://example.com/hook\n",
+		"webhooks:\n  - name: ops\n",
+		"webhooks:\n  - name: ops\n    url: example.com/hook\n",
+		"webhooks:\n  - name: ops\n    url: https://example.com/hook\n    max_attempts: -1\n",
+		"webhooks:\n  - name: ops\n    url: https://example.com/hook\n    template: \"{{ .State \"\n",
+	} {
+		if _, err := loadConfigContent([]byte(configFile)); err == nil {
+			t.Errorf("Should have an error loading %v", configFile)
+		}
+	}
+}
+
+func TestWebhookNotifier_Notify(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.server.Close()
+	filtered := newWebhookStandIn()
+	defer filtered.server.Close()
+
+	loadConfigContent([]byte(`
+webhooks:
+  - name: all
+    url: ` + standIn.server.URL + `
+    headers:
+      Authorization: "Bearer secret"
+  - name: prod
+    url: ` + filtered.server.URL + `
+    resource_tags:
+      Env: "prod"
+    template: '{"text": {{ printf "%s is %s: %s" .ResourceName .State .Summary | json }}}'
+`))
+	notifier := NewWebhookNotifier(config.Webhooks)
+	notifier.now = func() time.Time { return time.Unix(1500000060, 0).UTC() }
+	notifier.Notify([]StateTransition{webhookTransition("web1", "dev"), webhookTransition("web2", "prod")})
+	notifier.Close()
+
+	if len(standIn.bodies) != 2 {
+		t.Fatalf("Unexpected number of notifications: %v", standIn.bodies)
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal([]byte(standIn.bodies[0]), &event); err != nil {
+		t.Fatalf("Error decoding %v: %v", standIn.bodies[0], err)
+	}
+	if event.ResourceName != "web1" || event.PreviousState != "Available" || event.State != "Unavailable" || event.ReasonType != "Unplanned" ||
+		event.Tags["Env"] != "dev" || !event.OccurredAt.Equal(time.Unix(1500000000, 0)) || !event.DetectedAt.Equal(time.Unix(1500000060, 0)) {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+	if standIn.headers[0].Get("Authorization") != "Bearer secret" || standIn.headers[0].Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected headers: %v", standIn.headers[0])
+	}
+
+	if len(filtered.bodies) != 1 || filtered.bodies[0] != `{"text": "web2 is Unavailable: The virtual machine is down"}` {
+		t.Errorf("Unexpected filtered notifications: %v", filtered.bodies)
+	}
+	if got := testutil.ToFloat64(notifier.notifications.WithLabelValues("all", NotificationResultSuccess)); got != 2 {
+		t.Errorf("Unexpected number of successful notifications: %v", got)
+	}
+}
+
+func TestWebhookNotifier_Retries(t *testing.T) {
+	standIn := newWebhookStandIn(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadRequest)
+	defer standIn.server.Close()
+
+	loadConfigContent([]byte(`
+webhooks:
+  - name: ops
+    url: ` + standIn.server.URL + `
+    max_attempts: 3
+    min_backoff: 1ms
+    max_backoff: 2ms
+`))
+	notifier := NewWebhookNotifier(config.Webhooks)
+	// Retried twice, then failed on a client error which is not retried
+	notifier.Notify([]StateTransition{webhookTransition("web1", "dev"), webhookTransition("web2", "dev")})
+	waitNotifications(t, notifier, "ops", 2)
+	notifier.Close()
+
+	if len(standIn.bodies) != 4 {
+		t.Errorf("Unexpected number of attempts: %v", len(standIn.bodies))
+	}
+	if got := testutil.ToFloat64(notifier.notifications.WithLabelValues("ops", NotificationResultSuccess)); got != 1 {
+		t.Errorf("Unexpected number of successful notifications: %v", got)
+	}
+	if got := testutil.ToFloat64(notifier.notifications.WithLabelValues("ops", NotificationResultFailure)); got != 1 {
+		t.Errorf("Unexpected number of failed notifications: %v", got)
+	}
+}
+
+func TestWebhookNotifier_RetryAfterCapped(t *testing.T) {
+	standIn := newWebhookStandIn(http.StatusTooManyRequests)
+	standIn.retryAfter = "3600"
+	defer standIn.server.Close()
+
+	loadConfigContent([]byte(`
+webhooks:
+  - name: ops
+    url: ` + standIn.server.URL + `
+    min_backoff: 1ms
+    max_backoff: 2ms
+`))
+	notifier := NewWebhookNotifier(config.Webhooks)
+	defer notifier.Close()
+	notifier.Notify([]StateTransition{webhookTransition("web1", "dev")})
+	waitNotifications(t, notifier, "ops", 1)
+
+	if got := testutil.ToFloat64(notifier.notifications.WithLabelValues("ops", NotificationResultSuccess)); got != 1 {
+		t.Errorf("Unexpected number of successful notifications: %v", got)
+	}
+}
+
+func TestWebhookNotifier_CloseInterruptsRetries(t *testing.T) {
+	standIn := newWebhookStandIn(http.StatusServiceUnavailable)
+	defer standIn.server.Close()
+
+	loadConfigContent([]byte(`
+webhooks:
+  - name: ops
+    url: ` + standIn.server.URL + `
+    min_backoff: 1h
+    max_backoff: 1h
+`))
+	notifier := NewWebhookNotifier(config.Webhooks)
+	notifier.Notify([]StateTransition{webhookTransition("web1", "dev")})
+	for {
+		standIn.mutex.Lock()
+		attempts := len(standIn.bodies)
+		standIn.mutex.Unlock()
+		if attempts > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	notifier.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close did not interrupt the retry backoff: took %v", elapsed)
+	}
+	if got := testutil.ToFloat64(notifier.notifications.WithLabelValues("ops", NotificationResultFailure)); got != 1 {
+		t.Errorf("Unexpected number of failed notifications: %v", got)
+	}
+}
+
+func TestWebhookNotifier_NotifyAfterClose(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.server.Close()
+
+	loadConfigContent([]byte(`
+webhooks:
+  - name: ops
+    url: ` + standIn.server.URL + `
+`))
+	notifier := NewWebhookNotifier(config.Webhooks)
+	notifier.Close()
+	notifier.Notify([]StateTransition{webhookTransition("web1", "dev")})
+	notifier.Close()
+
+	standIn.mutex.Lock()
+	defer standIn.mutex.Unlock()
+	if len(standIn.bodies) != 0 {
+		t.Errorf("Unexpected notifications after close: %d", len(standIn.bodies))
+	}
+}
+
+func TestCollect_Webhooks(t *testing.T) {
+	standIn := newWebhookStandIn()
+	defer standIn.server.Close()
+
+	r := MockedResources{}
+	rh := MockedResourceHealth{}
+	collector := NewMockedCollector(&rh, &r)
+
+	resourceID := trackedResourceID
+	asID := resourceID + AvailabilityStatusIDSuffix
+	resourceType := "Microsoft.Compute/virtualMachines"
+	monitoring := "enabled"
+	r.On("ForEachResource", mock.Anything).Return(&[]resources.GenericResource{
+		{ID: &resourceID, Type: &resourceType, Tags: map[string]*string{"Monitoring": &monitoring}},
+	}, nil)
+	for _, state := range []resourcehealth.AvailabilityStateValues{resourcehealth.Available, resourcehealth.Unavailable} {
+		rh.On("ForEachAvailabilityStatus", mock.Anything).Return(&[]resourcehealth.AvailabilityStatus{
+			{ID: &asID, Properties: &resourcehealth.AvailabilityStatusProperties{AvailabilityState: state}},
+		}, nil).Once()
+	}
+	rh.On("GetSubscriptionID").Return("my_subscription")
+	rh.On("GetLastRatelimitRemaining").Return("99")
+
+	configFile := `
+resource_configurations:
+  - resource_tags:
+      Monitoring: "enabled"
+    resource_types:
+      - "Microsoft.Compute/virtualMachines"
+webhooks:
+  - name: ops
+    url: ` + standIn.server.URL + `
+`
+	loadConfigContent([]byte(configFile))
+	notifier := NewWebhookNotifier(config.Webhooks)
+	collector.WithNotifier(notifier)
+
+	CallExporterWithConfig(collector, configFile)
+	CallExporterWithConfig(collector, configFile)
+	notifier.Close()
+
+	if len(standIn.bodies) != 1 || !strings.Contains(standIn.bodies[0], `"previous_state":"Available","state":"Unavailable"`) {
+		t.Errorf("Unexpected notifications: %v", standIn.bodies)
+	}
+}